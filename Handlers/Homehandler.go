@@ -10,16 +10,19 @@ import (
 	"time"
 )
 
-// GetRecentPosts fetches recent posts from the database
-func GetRecentPosts(limit int) ([]Post, error) {
+// GetRecentPosts fetches recent posts from the database, pinned posts first,
+// leaving out authors the viewer muted. viewerID is 0 for guests.
+func GetRecentPosts(limit, viewerID int) ([]Post, error) {
 	query := `
-        SELECT p.id, p.title, p.content, u.username, p.created_at
+        SELECT p.id, p.title, p.content, u.username, u.id, COALESCE(u.avatar_key, ''), p.created_at, p.pinned, p.locked
         FROM posts p
         JOIN users u ON p.user_id = u.id
-        ORDER BY p.created_at DESC
+        WHERE p.deleted_at IS NULL
+          AND p.user_id NOT IN (SELECT muted_id FROM user_mutes WHERE muter_id = ?)
+        ORDER BY p.pinned DESC, p.created_at DESC
         LIMIT ?
     `
-	rows, err := DB.Query(query, limit)
+	rows, err := DB.Query(query, viewerID, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -28,10 +31,12 @@ func GetRecentPosts(limit int) ([]Post, error) {
 	var posts []Post
 	for rows.Next() {
 		var p Post
-		err := rows.Scan(&p.ID, &p.Title, &p.Content, &p.Author, &p.CreatedAt)
+		var avatarKey string
+		err := rows.Scan(&p.ID, &p.Title, &p.Content, &p.Author, &p.AuthorID, &avatarKey, &p.CreatedAt, &p.Pinned, &p.Locked)
 		if err != nil {
 			return nil, err
 		}
+		p.AvatarURL = AvatarURL(p.AuthorID, avatarKey, AvatarSizeSmall)
 		posts = append(posts, p)
 	}
 	return posts, nil
@@ -47,11 +52,20 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 	loggedIn := err == nil && user != nil
 	var username string
 	var isGuest bool
+	var isAdmin bool
+	var isStaff bool
 	var sessionDuration time.Duration
+	var unread, unreadMessages int
+	var viewerID int
 
 	if loggedIn {
+		viewerID = user.ID
 		username = user.Username
+		isAdmin = user.IsAdmin()
+		isStaff = user.IsStaff()
 		isGuest = false
+		unread = UnreadNotificationCount(user.ID)
+		unreadMessages = UnreadMessageCount(user.ID)
 	} else {
 		isGuest = true
 	}
@@ -74,13 +88,13 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 			Error400Handler(w, r)
 			return
 		}
-		posts, fetchErr = GetPostsByCategory(selectedCategoryID)
+		posts, fetchErr = GetPostsByCategory(selectedCategoryID, viewerID)
 	} else if filter == "created" && loggedIn {
 		posts, fetchErr = GetPostsByUser(user.ID)
 	} else if filter == "liked" && loggedIn {
 		posts, fetchErr = GetLikedPostsByUser(user.ID)
 	} else {
-		posts, fetchErr = GetRecentPosts(10)
+		posts, fetchErr = GetRecentPosts(10, viewerID)
 	}
 
 	if fetchErr != nil {
@@ -97,23 +111,33 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data := struct {
-		Posts            []Post
-		Categories       []Category
-		LoggedIn         bool
-		Username         string
-		IsGuest          bool
-		SessionDuration  string
-		Filter           string
-		SelectedCategory int
+		Posts               []Post
+		Categories          []Category
+		LoggedIn            bool
+		Username            string
+		IsGuest             bool
+		IsAdmin             bool
+		IsStaff             bool
+		SessionDuration     string
+		Filter              string
+		SelectedCategory    int
+		Held                bool
+		UnreadNotifications int
+		UnreadMessages      int
 	}{
-		Posts:            posts,
-		Categories:       categories,
-		LoggedIn:         loggedIn,
-		Username:         username,
-		IsGuest:          isGuest,
-		SessionDuration:  sessionDuration.Round(time.Second).String(),
-		Filter:           filter,
-		SelectedCategory: selectedCategoryID,
+		Posts:               posts,
+		Categories:          categories,
+		LoggedIn:            loggedIn,
+		Username:            username,
+		IsGuest:             isGuest,
+		IsAdmin:             isAdmin,
+		IsStaff:             isStaff,
+		SessionDuration:     sessionDuration.Round(time.Second).String(),
+		Filter:              filter,
+		SelectedCategory:    selectedCategoryID,
+		Held:                r.URL.Query().Get("held") == "1",
+		UnreadNotifications: unread,
+		UnreadMessages:      unreadMessages,
 	}
 
 	templatesDir := GetTemplatesDir()
@@ -130,7 +154,7 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tmpl, err := template.ParseFiles(templatePath)
+	tmpl, err := template.New("home.html").Funcs(templateFuncs).ParseFiles(templatePath)
 	if err != nil {
 		log.Printf("Failed to parse template: %v", err)
 		Error500Handler(w, r)
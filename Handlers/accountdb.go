@@ -0,0 +1,289 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Account deletion modes
+const (
+	DeleteModeAnonymize = "anonymize"
+	DeleteModeDelete    = "delete"
+)
+
+// emailVerificationTTL is how long an email change link stays valid
+const emailVerificationTTL = 24 * time.Hour
+
+var (
+	// ErrEmailTaken is returned when another account already uses the email
+	ErrEmailTaken = errors.New("email already in use")
+	// ErrUsernameTaken is returned when another account already uses a matching username
+	ErrUsernameTaken = errors.New("username already in use")
+	// ErrInvalidVerification is returned for unknown or expired email verification tokens
+	ErrInvalidVerification = errors.New("invalid or expired verification token")
+)
+
+// UsernameChange is one entry of a user's username history
+type UsernameChange struct {
+	Username  string    `json:"username"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// ChangePassword stores a new password hash and signs the user out everywhere.
+// The caller is expected to start a fresh session afterwards.
+func ChangePassword(userID int, hashedPassword string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE users SET password = ?, has_password = 1 WHERE id = ?", hashedPassword, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM pending_logins WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateEmailChange records a pending email change confirmed by token.
+// Any earlier pending change for the user is replaced.
+func CreateEmailChange(userID int, email, token string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkEmailFree(tx, email, userID); err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM email_verifications WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO email_verifications (token, user_id, email, expiry) VALUES (?, ?, ?, ?)",
+		token, userID, email, time.Now().Add(emailVerificationTTL))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ConfirmEmailChange applies the pending email change for token and returns the user it belongs to
+func ConfirmEmailChange(token string) (int, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var email string
+	var expiry time.Time
+	err = tx.QueryRow("SELECT user_id, email, expiry FROM email_verifications WHERE token = ?", token).Scan(&userID, &email, &expiry)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidVerification
+	}
+	if err != nil {
+		return 0, err
+	}
+	if time.Now().After(expiry) {
+		return 0, ErrInvalidVerification
+	}
+
+	if err := checkEmailFree(tx, email, userID); err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("UPDATE users SET email = ?, email_verified = 1 WHERE id = ?", email, userID)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("DELETE FROM email_verifications WHERE user_id = ?", userID)
+	if err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
+
+// GetPendingEmailChange returns the address waiting for verification, if any
+func GetPendingEmailChange(userID int) (string, error) {
+	var email string
+	err := DB.QueryRow("SELECT email FROM email_verifications WHERE user_id = ? AND expiry > ?", userID, time.Now()).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return email, err
+}
+
+// ChangeUsername renames the user and appends the old name to their history
+func ChangeUsername(userID int, newUsername string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var taken bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username_key = ? AND id != ?)",
+		UsernameKey(newUsername), userID).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrUsernameTaken
+	}
+
+	var oldUsername string
+	err = tx.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&oldUsername)
+	if err != nil {
+		return err
+	}
+	if oldUsername == newUsername {
+		return nil
+	}
+
+	_, err = tx.Exec("INSERT INTO username_history (user_id, username, changed_at) VALUES (?, ?, ?)",
+		userID, oldUsername, time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE users SET username = ?, username_key = ? WHERE id = ?",
+		newUsername, UsernameKey(newUsername), userID)
+	if isUsernameConflict(err) {
+		return ErrUsernameTaken
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetUsernameHistory returns the user's previous usernames, newest first
+func GetUsernameHistory(userID int) ([]UsernameChange, error) {
+	rows, err := DB.Query("SELECT username, changed_at FROM username_history WHERE user_id = ? ORDER BY changed_at DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []UsernameChange
+	for rows.Next() {
+		var c UsernameChange
+		if err := rows.Scan(&c.Username, &c.ChangedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, c)
+	}
+	return history, nil
+}
+
+// DeleteAccount removes the user's personal data. In anonymize mode their posts and
+// comments stay up under a placeholder name; in delete mode they are removed too.
+func DeleteAccount(userID int, mode string) error {
+	if mode != DeleteModeAnonymize && mode != DeleteModeDelete {
+		return fmt.Errorf("unknown delete mode %q", mode)
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	personal := []string{
+		"DELETE FROM sessions WHERE user_id = ?",
+		"DELETE FROM pending_logins WHERE user_id = ?",
+		"DELETE FROM recovery_codes WHERE user_id = ?",
+		"DELETE FROM user_identities WHERE user_id = ?",
+		"DELETE FROM oauth_states WHERE link_user_id = ?",
+		"DELETE FROM email_verifications WHERE user_id = ?",
+		"DELETE FROM username_history WHERE user_id = ?",
+		"DELETE FROM data_exports WHERE user_id = ?",
+		"DELETE FROM mentions WHERE user_id = ?",
+		"DELETE FROM notifications WHERE user_id = ?",
+		"DELETE FROM notification_preferences WHERE user_id = ?",
+		"DELETE FROM user_blocks WHERE ? IN (blocker_id, blocked_id)",
+		"DELETE FROM user_mutes WHERE ? IN (muter_id, muted_id)",
+		"DELETE FROM conversation_members WHERE user_id = ?",
+		"DELETE FROM reports WHERE reporter_id = ?",
+		"DELETE FROM reports WHERE target_type = 'user' AND target_id = ?",
+		"DELETE FROM user_sanctions WHERE user_id = ?",
+		"DELETE FROM held_content WHERE user_id = ?",
+		"DELETE FROM content_fingerprints WHERE user_id = ?",
+	}
+	for _, query := range personal {
+		if _, err := tx.Exec(query, userID); err != nil {
+			return err
+		}
+	}
+
+	if mode == DeleteModeAnonymize {
+		// Square brackets can never pass ValidateUsername, so nobody can register the placeholder
+		placeholder := fmt.Sprintf("[deleted-%d]", userID)
+		_, err = tx.Exec(`
+			UPDATE users SET username = ?, username_key = ?, email = ?, email_verified = 0, password = '', role = ?,
+				totp_secret = NULL, totp_enabled = 0, totp_last_step = 0, has_password = 0,
+				bio = '', location = '', website = '', deleted_at = ?
+			WHERE id = ?
+		`, placeholder, UsernameKey(placeholder), placeholder+"@deleted.invalid", RoleUser, time.Now(), userID)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	content := []string{
+		// Likes given by the user and likes on anything the user wrote
+		"DELETE FROM likes WHERE user_id = ?",
+		"DELETE FROM likes WHERE post_id IN (SELECT id FROM posts WHERE user_id = ?)",
+		"DELETE FROM likes WHERE comment_id IN (SELECT id FROM comments WHERE user_id = ? OR post_id IN (SELECT id FROM posts WHERE user_id = ?))",
+		"DELETE FROM mentions WHERE author_id = ? OR post_id IN (SELECT id FROM posts WHERE user_id = ?)",
+		"DELETE FROM notifications WHERE actor_id = ? OR post_id IN (SELECT id FROM posts WHERE user_id = ?) OR comment_id IN (SELECT id FROM comments WHERE user_id = ?)",
+		"DELETE FROM chat_messages WHERE user_id = ?",
+		"DELETE FROM message_reports WHERE reporter_id = ? OR message_id IN (SELECT id FROM messages WHERE user_id = ?)",
+		"DELETE FROM reports WHERE target_type = 'post' AND target_id IN (SELECT id FROM posts WHERE user_id = ?)",
+		"DELETE FROM reports WHERE target_type = 'comment' AND target_id IN (SELECT id FROM comments WHERE user_id = ? OR post_id IN (SELECT id FROM posts WHERE user_id = ?))",
+		"DELETE FROM messages WHERE user_id = ?",
+		// Comments by the user and comments left under the user's posts
+		"DELETE FROM comments WHERE user_id = ? OR post_id IN (SELECT id FROM posts WHERE user_id = ?)",
+		"DELETE FROM held_content WHERE post_id IN (SELECT id FROM posts WHERE user_id = ?)",
+		"DELETE FROM post_categories WHERE post_id IN (SELECT id FROM posts WHERE user_id = ?)",
+		"DELETE FROM attachments WHERE post_id IN (SELECT id FROM posts WHERE user_id = ?)",
+		"DELETE FROM posts WHERE user_id = ?",
+		"DELETE FROM users WHERE id = ?",
+	}
+	for _, query := range content {
+		args := make([]interface{}, strings.Count(query, "?"))
+		for i := range args {
+			args[i] = userID
+		}
+		if _, err := tx.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// checkEmailFree returns ErrEmailTaken if another user already has email
+func checkEmailFree(tx *sql.Tx, email string, userID int) error {
+	var taken bool
+	err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email) = LOWER(?) AND id != ?)", email, userID).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrEmailTaken
+	}
+	return nil
+}
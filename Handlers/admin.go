@@ -0,0 +1,311 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StaffMember is a moderator or admin listed in the admin area
+type StaffMember struct {
+	ID          int
+	Username    string
+	Role        string
+	TOTPEnabled bool
+}
+
+// requireStaff returns the current user if they hold a staff role. Admin-only
+// pages pass adminOnly. Staff who still owe a 2FA enrollment under the site
+// policy are sent to enroll first.
+func requireStaff(w http.ResponseWriter, r *http.Request, adminOnly bool) (*User, bool) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil, false
+	}
+	if !user.IsStaff() || (adminOnly && !user.IsAdmin()) {
+		Error404Handler(w, r)
+		return nil, false
+	}
+	if staffNeeds2FA(user) {
+		http.Redirect(w, r, "/settings/2fa?required=1", http.StatusSeeOther)
+		return nil, false
+	}
+	// A suspension is read-only for staff too, moderation included
+	if msg := suspendedMessage(user.ID); msg != "" {
+		http.Error(w, msg, http.StatusForbidden)
+		return nil, false
+	}
+	return user, true
+}
+
+// AdminHandler shows the admin dashboard with site policies
+func AdminHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, true)
+	if !ok {
+		return
+	}
+
+	staff, err := getStaffMembers()
+	if err != nil {
+		log.Printf("Error fetching staff: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	suspiciousIPs, suspiciousEvents := suspicion.counts(time.Now())
+	data := map[string]interface{}{
+		"LoggedIn":         true,
+		"Username":         user.Username,
+		"Staff":            staff,
+		"RequireStaff2FA":  GetBoolSetting(SettingRequireStaff2FA, false),
+		"TrustProxy":       GetBoolSetting(SettingTrustProxy, false),
+		"ProxyHops":        GetIntSetting(SettingProxyHops, 1),
+		"SiteURL":          GetSetting(SettingSiteURL, "http://localhost:8080"),
+		"OAuthProviders":   getOAuthProviderSettings(),
+		"MaxFileMB":        GetIntSetting(SettingAttachmentMaxFileMB, DefaultAttachmentMaxFileMB),
+		"MaxPostMB":        GetIntSetting(SettingAttachmentMaxPostMB, DefaultAttachmentMaxPostMB),
+		"ChatScrollback":   GetIntSetting(SettingChatScrollback, DefaultChatScrollback),
+		"SpamRejectWords":  GetSetting(SettingSpamRejectWords, ""),
+		"SpamHoldWords":    GetSetting(SettingSpamHoldWords, ""),
+		"SpamNewDays":      GetIntSetting(SettingSpamNewAccountDays, DefaultSpamNewAccountDays),
+		"SpamNewLinks":     GetIntSetting(SettingSpamNewAccountLinks, DefaultSpamNewAccountLinks),
+		"CaptchaMode":      GetSetting(SettingCaptchaMode, CaptchaSuspicious),
+		"SuspiciousIPs":    suspiciousIPs,
+		"SuspiciousEvents": suspiciousEvents,
+		"SiteWideCaptcha":  siteWideSuspicion,
+		"Saved":            r.URL.Query().Get("saved") == "1",
+	}
+
+	err = RenderTemplate(w, "admin.html", data)
+	if err != nil {
+		Error500Handler(w, r)
+	}
+}
+
+// AdminSettingsHandler saves site policies from the admin dashboard
+func AdminSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, true)
+	if !ok {
+		return
+	}
+	ip := clientIP(r)
+
+	proxyHops, err := strconv.Atoi(r.FormValue("proxy_hops"))
+	if err != nil || proxyHops < 1 || proxyHops > 10 {
+		Error400Handler(w, r)
+		return
+	}
+
+	keys := []string{SettingRequireStaff2FA, SettingTrustProxy, SettingProxyHops}
+	before := settingsSnapshot(keys...)
+	for key, value := range map[string]string{
+		SettingRequireStaff2FA: strconv.FormatBool(r.FormValue("require_staff_2fa") == "on"),
+		SettingTrustProxy:      strconv.FormatBool(r.FormValue("trust_proxy") == "on"),
+		SettingProxyHops:       strconv.Itoa(proxyHops),
+	} {
+		if err := SetSetting(key, value); err != nil {
+			log.Printf("Error saving settings: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+	}
+	// Log the change as made from the address the request came from before
+	// the proxy settings changed how that address is read
+	recordSettingsChange(user, ip, before, settingsSnapshot(keys...))
+
+	http.Redirect(w, r, "/admin?saved=1", http.StatusSeeOther)
+}
+
+// AdminAttachmentSettingsHandler saves the attachment size limits
+func AdminAttachmentSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, true)
+	if !ok {
+		return
+	}
+
+	maxFile, err1 := strconv.Atoi(r.FormValue("max_file_mb"))
+	maxPost, err2 := strconv.Atoi(r.FormValue("max_post_mb"))
+	if err1 != nil || err2 != nil || maxFile < 1 || maxPost < maxFile || maxPost > 1024 {
+		Error400Handler(w, r)
+		return
+	}
+
+	before := settingsSnapshot(SettingAttachmentMaxFileMB, SettingAttachmentMaxPostMB)
+	for key, value := range map[string]int{SettingAttachmentMaxFileMB: maxFile, SettingAttachmentMaxPostMB: maxPost} {
+		if err := SetSetting(key, strconv.Itoa(value)); err != nil {
+			log.Printf("Error saving settings: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+	}
+	recordSettingsChange(user, clientIP(r), before, settingsSnapshot(SettingAttachmentMaxFileMB, SettingAttachmentMaxPostMB))
+
+	http.Redirect(w, r, "/admin?saved=1", http.StatusSeeOther)
+}
+
+// AdminChatSettingsHandler saves the chat scrollback limit
+func AdminChatSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, true)
+	if !ok {
+		return
+	}
+
+	scrollback, err := strconv.Atoi(r.FormValue("scrollback"))
+	if err != nil || scrollback < 1 || scrollback > MaxChatScrollback {
+		Error400Handler(w, r)
+		return
+	}
+	before := settingsSnapshot(SettingChatScrollback)
+	if err := SetSetting(SettingChatScrollback, strconv.Itoa(scrollback)); err != nil {
+		log.Printf("Error saving settings: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	recordSettingsChange(user, clientIP(r), before, settingsSnapshot(SettingChatScrollback))
+	http.Redirect(w, r, "/admin?saved=1", http.StatusSeeOther)
+}
+
+// AdminSpamSettingsHandler saves the spam filter's word lists and the link
+// limit for new accounts
+func AdminSpamSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, true)
+	if !ok {
+		return
+	}
+
+	days, err1 := strconv.Atoi(r.FormValue("new_account_days"))
+	links, err2 := strconv.Atoi(r.FormValue("new_account_links"))
+	if err1 != nil || err2 != nil || days < 0 || days > 365 || links < 0 || links > 100 {
+		Error400Handler(w, r)
+		return
+	}
+	lists := map[string]string{
+		SettingSpamRejectWords: strings.TrimSpace(strings.ReplaceAll(r.FormValue("reject_words"), "\r\n", "\n")),
+		SettingSpamHoldWords:   strings.TrimSpace(strings.ReplaceAll(r.FormValue("hold_words"), "\r\n", "\n")),
+	}
+	for _, list := range lists {
+		if _, err := compileBlocklist(list); err != nil {
+			http.Error(w, "Invalid spam filter pattern: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	keys := []string{SettingSpamRejectWords, SettingSpamHoldWords, SettingSpamNewAccountDays, SettingSpamNewAccountLinks}
+	before := settingsSnapshot(keys...)
+	lists[SettingSpamNewAccountDays] = strconv.Itoa(days)
+	lists[SettingSpamNewAccountLinks] = strconv.Itoa(links)
+	for key, value := range lists {
+		if err := SetSetting(key, value); err != nil {
+			log.Printf("Error saving settings: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+	}
+	recordSettingsChange(user, clientIP(r), before, settingsSnapshot(keys...))
+	http.Redirect(w, r, "/admin?saved=1", http.StatusSeeOther)
+}
+
+// AdminCaptchaSettingsHandler saves when registration and login ask for a CAPTCHA
+func AdminCaptchaSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, true)
+	if !ok {
+		return
+	}
+
+	mode := r.FormValue("captcha_mode")
+	if !slices.Contains(captchaModes, mode) {
+		Error400Handler(w, r)
+		return
+	}
+	before := settingsSnapshot(SettingCaptchaMode)
+	if err := SetSetting(SettingCaptchaMode, mode); err != nil {
+		log.Printf("Error saving settings: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	recordSettingsChange(user, clientIP(r), before, settingsSnapshot(SettingCaptchaMode))
+	http.Redirect(w, r, "/admin?saved=1", http.StatusSeeOther)
+}
+
+// AdminRoleHandler changes the role of a user
+func AdminRoleHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, true)
+	if !ok {
+		return
+	}
+
+	username := r.FormValue("username")
+	role := r.FormValue("role")
+	if username == "" || (role != RoleUser && role != RoleModerator && role != RoleAdmin) {
+		Error400Handler(w, r)
+		return
+	}
+
+	var targetID int
+	var oldRole string
+	err := DB.QueryRow("SELECT id, role FROM users WHERE username = ?", username).Scan(&targetID, &oldRole)
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	}
+	if err == nil {
+		_, err = DB.Exec("UPDATE users SET role = ? WHERE id = ?", role, targetID)
+	}
+	if err != nil {
+		log.Printf("Error changing role: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	if oldRole != role {
+		recordAudit(user, clientIP(r), AuditEvent{Action: AuditRoleChange, TargetType: "user", TargetID: targetID,
+			Target: username, Before: map[string]string{"role": oldRole}, After: map[string]string{"role": role}})
+	}
+
+	http.Redirect(w, r, "/admin?saved=1", http.StatusSeeOther)
+}
+
+func getStaffMembers() ([]StaffMember, error) {
+	rows, err := DB.Query(`
+		SELECT id, username, role, totp_enabled
+		FROM users
+		WHERE role IN (?, ?)
+		ORDER BY role, username
+	`, RoleAdmin, RoleModerator)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var staff []StaffMember
+	for rows.Next() {
+		var s StaffMember
+		if err := rows.Scan(&s.ID, &s.Username, &s.Role, &s.TOTPEnabled); err != nil {
+			return nil, err
+		}
+		staff = append(staff, s)
+	}
+	return staff, nil
+}
+
+// PromoteUsers grants role to each of the given usernames. It is used at
+// startup to bootstrap the first admins from configuration.
+func PromoteUsers(role string, usernames []string) error {
+	for _, username := range usernames {
+		if username == "" {
+			continue
+		}
+		result, err := DB.Exec("UPDATE users SET role = ? WHERE username = ?", role, username)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			log.Printf("Cannot promote %s to %s: no such user", username, role)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,438 @@
+package RebootForums
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Site setting keys for attachment limits, in megabytes
+const (
+	SettingAttachmentMaxFileMB = "attachment_max_file_mb"
+	SettingAttachmentMaxPostMB = "attachment_max_post_mb"
+)
+
+// Default attachment limits, in megabytes
+const (
+	DefaultAttachmentMaxFileMB = 5
+	DefaultAttachmentMaxPostMB = 20
+)
+
+// Attachment limits that are not configurable
+const (
+	MaxAttachmentsPerPost  = 10
+	MaxAttachmentDimension = 5000
+	MaxAttachmentNameRunes = 100
+	AttachmentThumbSize    = 320
+)
+
+// attachmentTypes maps each accepted content type, as sniffed from the file
+// itself, to the extension it is stored with
+var attachmentTypes = map[string]string{
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+	"application/zip": ".zip",
+	"text/plain":      ".txt",
+}
+
+// Attachment is a file uploaded with a post
+type Attachment struct {
+	ID          int
+	PostID      int
+	BlobKey     string
+	ThumbKey    string
+	Filename    string
+	ContentType string
+	Size        int64
+	Width       int
+	Height      int
+}
+
+// IsImage reports whether the attachment is shown inline as a picture
+func (a Attachment) IsImage() bool {
+	return a.ThumbKey != ""
+}
+
+// URL is the address the full file is downloaded from
+func (a Attachment) URL() string {
+	return "/attachments/" + strconv.Itoa(a.ID)
+}
+
+// ThumbURL is the address of the thumbnail of an image attachment. It goes
+// through AttachmentThumbHandler rather than the blob store so the thumbnail
+// goes away with the post.
+func (a Attachment) ThumbURL() string {
+	return a.URL() + "/thumb"
+}
+
+// FormattedSize returns the file size in a human readable unit
+func (a Attachment) FormattedSize() string {
+	return formatBytes(a.Size)
+}
+
+// attachmentUpload is a validated file waiting to be stored
+type attachmentUpload struct {
+	filename    string
+	contentType string
+	data        []byte
+	img         image.Image
+}
+
+// attachmentLimits returns the configured per-file and per-post limits in bytes
+func attachmentLimits() (int64, int64) {
+	maxFile := int64(GetIntSetting(SettingAttachmentMaxFileMB, DefaultAttachmentMaxFileMB)) << 20
+	maxPost := int64(GetIntSetting(SettingAttachmentMaxPostMB, DefaultAttachmentMaxPostMB)) << 20
+	return maxFile, maxPost
+}
+
+// readAttachments checks the uploaded files against the size limits and the
+// allowed types. The browser's file name and content type are only used for display.
+func readAttachments(files []*multipart.FileHeader) ([]attachmentUpload, ValidationErrors) {
+	errs := ValidationErrors{}
+	maxFile, maxPost := attachmentLimits()
+
+	var uploads []attachmentUpload
+	var total int64
+	for _, fh := range files {
+		// Browsers send an empty part when no file was chosen
+		if fh.Filename == "" && fh.Size == 0 {
+			continue
+		}
+		if len(uploads) == MaxAttachmentsPerPost {
+			errs.Add("attachments", fmt.Sprintf("A post can have at most %d attachments", MaxAttachmentsPerPost))
+			return nil, errs
+		}
+		name := cleanAttachmentName(fh.Filename)
+		if fh.Size > maxFile {
+			errs.Add("attachments", fmt.Sprintf("%s is larger than the %s limit per file", name, formatBytes(maxFile)))
+			return nil, errs
+		}
+		total += fh.Size
+		if total > maxPost {
+			errs.Add("attachments", fmt.Sprintf("Attachments can be at most %s per post", formatBytes(maxPost)))
+			return nil, errs
+		}
+
+		upload, msg := readAttachment(fh, name, maxFile)
+		if msg != "" {
+			errs.Add("attachments", msg)
+			return nil, errs
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, errs
+}
+
+func readAttachment(fh *multipart.FileHeader, name string, maxFile int64) (attachmentUpload, string) {
+	f, err := fh.Open()
+	if err != nil {
+		log.Printf("Error opening attachment: %v", err)
+		return attachmentUpload{}, "An error occurred. Please try again later."
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxFile+1))
+	if err != nil {
+		log.Printf("Error reading attachment: %v", err)
+		return attachmentUpload{}, "An error occurred. Please try again later."
+	}
+	if int64(len(data)) > maxFile {
+		return attachmentUpload{}, fmt.Sprintf("%s is larger than the %s limit per file", name, formatBytes(maxFile))
+	}
+	if len(data) == 0 {
+		return attachmentUpload{}, name + " is empty"
+	}
+
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	ext, ok := attachmentTypes[contentType]
+	if !ok {
+		return attachmentUpload{}, name + " is not an allowed file type. Upload images (PNG, JPEG, GIF, WebP), PDF, ZIP or plain text files."
+	}
+	if !strings.HasSuffix(strings.ToLower(name), ext) {
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + ext
+	}
+	upload := attachmentUpload{filename: name, contentType: contentType, data: data}
+
+	if strings.HasPrefix(contentType, "image/") {
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return attachmentUpload{}, name + " could not be read as an image"
+		}
+		// Checked before decoding so a tiny file cannot expand into a huge bitmap
+		if cfg.Width > MaxAttachmentDimension || cfg.Height > MaxAttachmentDimension {
+			return attachmentUpload{}, fmt.Sprintf("%s must be at most %d pixels wide and tall", name, MaxAttachmentDimension)
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil || cfg.Width < 1 || cfg.Height < 1 {
+			return attachmentUpload{}, name + " could not be read as an image"
+		}
+		upload.img = img
+	}
+	return upload, ""
+}
+
+// storeAttachments saves the uploads and their thumbnails to the blob store.
+// If anything fails, the blobs stored so far are removed again.
+func storeAttachments(userID int, uploads []attachmentUpload) ([]Attachment, error) {
+	store := getBlobStore()
+	var stored []Attachment
+	for _, u := range uploads {
+		token, err := generateSessionToken()
+		if err != nil {
+			deleteAttachmentBlobs(stored)
+			return nil, err
+		}
+		a := Attachment{
+			BlobKey:     fmt.Sprintf("attachments/%d/%s%s", userID, token, attachmentTypes[u.contentType]),
+			Filename:    u.filename,
+			ContentType: u.contentType,
+			Size:        int64(len(u.data)),
+		}
+		if u.img != nil {
+			b := u.img.Bounds()
+			a.Width, a.Height = b.Dx(), b.Dy()
+			thumb, ext, thumbType, err := renderThumbnail(u.img, u.contentType)
+			if err != nil {
+				deleteAttachmentBlobs(stored)
+				return nil, err
+			}
+			a.ThumbKey = fmt.Sprintf("attachments/%d/%s-thumb%s", userID, token, ext)
+			if err := store.Put(a.ThumbKey, bytes.NewReader(thumb), thumbType); err != nil {
+				deleteAttachmentBlobs(stored)
+				return nil, err
+			}
+		}
+		if err := store.Put(a.BlobKey, bytes.NewReader(u.data), u.contentType); err != nil {
+			deleteAttachmentBlobs(append(stored, Attachment{ThumbKey: a.ThumbKey}))
+			return nil, err
+		}
+		stored = append(stored, a)
+	}
+	return stored, nil
+}
+
+// renderThumbnail scales img to fit in an AttachmentThumbSize square. Photos are
+// encoded as JPEG and everything else as PNG to keep transparency.
+func renderThumbnail(img image.Image, contentType string) ([]byte, string, string, error) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > AttachmentThumbSize || h > AttachmentThumbSize {
+		if w >= h {
+			w, h = AttachmentThumbSize, h*AttachmentThumbSize/w
+		} else {
+			w, h = w*AttachmentThumbSize/h, AttachmentThumbSize
+		}
+		w, h = max(w, 1), max(h, 1)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+
+	var buf bytes.Buffer
+	if contentType == "image/jpeg" {
+		err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+		return buf.Bytes(), ".jpg", "image/jpeg", err
+	}
+	err := png.Encode(&buf, dst)
+	return buf.Bytes(), ".png", "image/png", err
+}
+
+// getPostAttachments returns the attachments of a post in upload order
+func getPostAttachments(postID int) ([]Attachment, error) {
+	rows, err := DB.Query(`
+		SELECT id, post_id, blob_key, COALESCE(thumb_key, ''), filename, content_type, size, width, height
+		FROM attachments WHERE post_id = ? ORDER BY id
+	`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanAttachments(rows)
+}
+
+// getUserAttachments returns every attachment on posts written by the user
+func getUserAttachments(userID int) ([]Attachment, error) {
+	rows, err := DB.Query(`
+		SELECT a.id, a.post_id, a.blob_key, COALESCE(a.thumb_key, ''), a.filename, a.content_type, a.size, a.width, a.height
+		FROM attachments a JOIN posts p ON p.id = a.post_id
+		WHERE p.user_id = ?
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanAttachments(rows)
+}
+
+func scanAttachments(rows *sql.Rows) ([]Attachment, error) {
+	var attachments []Attachment
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.ID, &a.PostID, &a.BlobKey, &a.ThumbKey, &a.Filename, &a.ContentType, &a.Size, &a.Width, &a.Height); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, nil
+}
+
+// deleteAttachmentBlobs removes the files of the given attachments. Failures
+// are only logged because the rows pointing at them are already gone.
+func deleteAttachmentBlobs(attachments []Attachment) {
+	store := getBlobStore()
+	for _, a := range attachments {
+		for _, key := range []string{a.BlobKey, a.ThumbKey} {
+			if key == "" {
+				continue
+			}
+			if err := store.Delete(key); err != nil {
+				log.Printf("Error deleting attachment blob %s: %v", key, err)
+			}
+		}
+	}
+}
+
+// AttachmentHandler downloads an attachment under its original file name
+func AttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		Error404Handler(w, r)
+		return
+	}
+
+	var a Attachment
+	err = DB.QueryRow(`
+		SELECT a.blob_key, a.filename, a.content_type, a.size FROM attachments a
+		JOIN posts p ON p.id = a.post_id
+		WHERE a.id = ? AND p.deleted_at IS NULL
+	`, id).
+		Scan(&a.BlobKey, &a.Filename, &a.ContentType, &a.Size)
+	if err != nil {
+		Error404Handler(w, r)
+		return
+	}
+
+	blob, err := getBlobStore().Get(a.BlobKey)
+	if err == ErrBlobNotFound {
+		Error404Handler(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error opening attachment %d: %v", id, err)
+		Error500Handler(w, r)
+		return
+	}
+	defer blob.Close()
+
+	disposition := "attachment"
+	if strings.HasPrefix(a.ContentType, "image/") {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	if _, err := io.Copy(w, blob); err != nil {
+		log.Printf("Error serving attachment %d: %v", id, err)
+	}
+}
+
+// AttachmentThumbHandler serves the thumbnail of an image attachment while its
+// post is not deleted. Browsers have to check back before reusing it so a
+// deleted post's pictures stop showing; the ETag keeps that check cheap.
+func AttachmentThumbHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		Error404Handler(w, r)
+		return
+	}
+
+	var thumbKey string
+	err = DB.QueryRow(`
+		SELECT COALESCE(a.thumb_key, '') FROM attachments a
+		JOIN posts p ON p.id = a.post_id
+		WHERE a.id = ? AND p.deleted_at IS NULL
+	`, id).Scan(&thumbKey)
+	if err != nil || thumbKey == "" {
+		Error404Handler(w, r)
+		return
+	}
+
+	etag := `"` + path.Base(thumbKey) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	blob, err := getBlobStore().Get(thumbKey)
+	if err == ErrBlobNotFound {
+		Error404Handler(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error opening thumbnail of attachment %d: %v", id, err)
+		Error500Handler(w, r)
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(thumbKey)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if _, err := io.Copy(w, blob); err != nil {
+		log.Printf("Error serving thumbnail of attachment %d: %v", id, err)
+	}
+}
+
+// cleanAttachmentName reduces an uploaded file name to something safe to show
+// and to offer as a download name
+func cleanAttachmentName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '"' || r == '/' {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(name, ""))
+	name = strings.TrimSpace(name)
+	if utf8.RuneCountInString(name) > MaxAttachmentNameRunes {
+		name = string([]rune(name)[:MaxAttachmentNameRunes])
+	}
+	if name == "" || name == "." {
+		name = "attachment"
+	}
+	return name
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return strconv.FormatFloat(math.Round(float64(n)/(1<<20)*10)/10, 'f', -1, 64) + " MB"
+	case n >= 1<<10:
+		return strconv.FormatInt(n>>10, 10) + " KB"
+	}
+	return strconv.FormatInt(n, 10) + " bytes"
+}
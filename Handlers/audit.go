@@ -0,0 +1,345 @@
+package RebootForums
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actions recorded in the audit log
+const (
+	AuditPostDelete     = "post.delete"
+	AuditCommentDelete  = "comment.delete"
+	AuditPostRestore    = "post.restore"
+	AuditCommentRestore = "comment.restore"
+	AuditPostState      = "post.state"
+	AuditSpamApprove    = "spam.approve"
+	AuditSpamReject     = "spam.reject"
+	AuditMessageDelete  = "message.delete"
+	AuditChatDelete     = "chat.delete"
+	AuditReportDismiss  = "report.dismiss"
+	AuditUserWarn       = "user.warn"
+	AuditUserSuspend    = "user.suspend"
+	AuditUserBan        = "user.ban"
+	AuditSanctionLift   = "sanction.lift"
+	AuditIPBan          = "ipban.add"
+	AuditIPBanLift      = "ipban.lift"
+	AuditRoleChange     = "user.role"
+	AuditSettingsChange = "settings.update"
+	AuditLoginUnlock    = "login.unlock"
+)
+
+// auditActions describes each action for the viewer's filter
+var auditActions = map[string]string{
+	AuditPostDelete:     "Deleted a post",
+	AuditCommentDelete:  "Deleted a comment",
+	AuditPostRestore:    "Restored a post",
+	AuditCommentRestore: "Restored a comment",
+	AuditPostState:      "Pinned, locked or announced a post",
+	AuditSpamApprove:    "Approved held content",
+	AuditSpamReject:     "Rejected held content",
+	AuditMessageDelete:  "Removed a private message",
+	AuditChatDelete:     "Deleted a chat message",
+	AuditReportDismiss:  "Dismissed reports",
+	AuditUserWarn:       "Warned a user",
+	AuditUserSuspend:    "Suspended a user",
+	AuditUserBan:        "Banned a user",
+	AuditSanctionLift:   "Lifted a suspension or ban",
+	AuditIPBan:          "Banned an IP range",
+	AuditIPBanLift:      "Lifted an IP ban",
+	AuditRoleChange:     "Changed a role",
+	AuditSettingsChange: "Changed site settings",
+	AuditLoginUnlock:    "Cleared a login throttle",
+}
+
+// auditPageSize is how many entries the viewer shows at a time
+const auditPageSize = 100
+
+// AuditEvent is one moderation or admin action about to be recorded. Before
+// and After are snapshots of the target and are stored as JSON.
+type AuditEvent struct {
+	Action     string
+	TargetType string
+	TargetID   int
+	Target     string
+	Before     interface{}
+	After      interface{}
+}
+
+// AuditEntry is a recorded action as shown in the viewer
+type AuditEntry struct {
+	ID         int
+	Actor      string
+	Action     string
+	TargetType string
+	TargetID   int
+	Target     string
+	Before     string
+	After      string
+	IP         string
+	CreatedAt  time.Time
+}
+
+// Description returns the human readable name of the action
+func (e AuditEntry) Description() string {
+	if d, ok := auditActions[e.Action]; ok {
+		return d
+	}
+	return e.Action
+}
+
+// recordAudit appends an action to the audit log. The action has already
+// happened, so a failure is logged rather than returned.
+func recordAudit(actor *User, ip string, e AuditEvent) {
+	before, err := auditSnapshot(e.Before)
+	if err == nil {
+		var after string
+		after, err = auditSnapshot(e.After)
+		if err == nil {
+			_, err = DB.Exec(`
+				INSERT INTO audit_log (actor_id, actor_name, action, target_type, target_id, target_label, before, after, ip, created_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			`, actor.ID, actor.Username, e.Action, e.TargetType, nullableID(e.TargetID), e.Target, before, after, ip, time.Now())
+		}
+	}
+	if err != nil {
+		log.Printf("Error recording %s by %s in the audit log: %v", e.Action, actor.Username, err)
+	}
+}
+
+func auditSnapshot(v interface{}) (string, error) {
+	if v == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+// settingsSnapshot reads the stored values of the given settings for the
+// audit log, hiding secrets
+func settingsSnapshot(keys ...string) map[string]string {
+	snapshot := make(map[string]string, len(keys))
+	for _, key := range keys {
+		value := GetSetting(key, "")
+		if strings.HasSuffix(key, "secret") && value != "" {
+			value = "(set)"
+		}
+		snapshot[key] = value
+	}
+	return snapshot
+}
+
+// recordSettingsChange logs the settings that differ between two snapshots
+func recordSettingsChange(actor *User, ip string, before, after map[string]string) {
+	changedBefore := make(map[string]string)
+	changedAfter := make(map[string]string)
+	for key, value := range after {
+		if before[key] != value {
+			changedBefore[key] = before[key]
+			changedAfter[key] = value
+		}
+	}
+	if len(changedAfter) == 0 {
+		return
+	}
+	recordAudit(actor, ip, AuditEvent{Action: AuditSettingsChange, TargetType: "settings",
+		Before: changedBefore, After: changedAfter})
+}
+
+// auditFilter narrows the audit log viewer and export
+type auditFilter struct {
+	Actor      string
+	Action     string
+	TargetType string
+	Target     string
+	From       string
+	To         string
+}
+
+// parseAuditFilter reads the filter from the query string. From and To are
+// dates; To includes the whole day.
+func parseAuditFilter(r *http.Request) (auditFilter, string, []interface{}, error) {
+	q := r.URL.Query()
+	f := auditFilter{
+		Actor:      strings.TrimSpace(q.Get("actor")),
+		Action:     q.Get("action"),
+		TargetType: q.Get("target_type"),
+		Target:     strings.TrimSpace(q.Get("target")),
+		From:       q.Get("from"),
+		To:         q.Get("to"),
+	}
+
+	var where []string
+	var args []interface{}
+	if f.Actor != "" {
+		where = append(where, "actor_name = ? COLLATE NOCASE")
+		args = append(args, f.Actor)
+	}
+	if f.Action != "" {
+		where = append(where, "action = ?")
+		args = append(args, f.Action)
+	}
+	if f.TargetType != "" {
+		where = append(where, "target_type = ?")
+		args = append(args, f.TargetType)
+	}
+	if f.Target != "" {
+		where = append(where, "(target_label = ? COLLATE NOCASE OR CAST(target_id AS TEXT) = ?)")
+		args = append(args, f.Target, f.Target)
+	}
+	if f.From != "" {
+		from, err := time.ParseInLocation("2006-01-02", f.From, time.Local)
+		if err != nil {
+			return f, "", nil, err
+		}
+		where = append(where, "created_at >= ?")
+		args = append(args, from)
+	}
+	if f.To != "" {
+		to, err := time.ParseInLocation("2006-01-02", f.To, time.Local)
+		if err != nil {
+			return f, "", nil, err
+		}
+		where = append(where, "created_at < ?")
+		args = append(args, to.AddDate(0, 0, 1))
+	}
+
+	clause := ""
+	if len(where) > 0 {
+		clause = "WHERE " + strings.Join(where, " AND ")
+	}
+	return f, clause, args, nil
+}
+
+// getAuditEntries returns matching entries, newest first. A positive limit
+// caps the result and beforeID skips entries at or after that id.
+func getAuditEntries(where string, args []interface{}, beforeID, limit int) ([]AuditEntry, error) {
+	if beforeID > 0 {
+		if where == "" {
+			where = "WHERE id < ?"
+		} else {
+			where += " AND id < ?"
+		}
+		args = append(args, beforeID)
+	}
+	query := `
+		SELECT id, actor_name, action, target_type, COALESCE(target_id, 0), target_label, before, after, ip, created_at
+		FROM audit_log ` + where + ` ORDER BY id DESC`
+	if limit > 0 {
+		query += " LIMIT " + strconv.Itoa(limit)
+	}
+
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.Actor, &e.Action, &e.TargetType, &e.TargetID, &e.Target, &e.Before, &e.After, &e.IP, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// AdminAuditHandler shows the audit log with filters
+func AdminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, true)
+	if !ok {
+		return
+	}
+
+	filter, where, args, err := parseAuditFilter(r)
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+	beforeID, _ := strconv.Atoi(r.URL.Query().Get("before"))
+
+	// Fetch one extra entry to know whether there is an older page
+	entries, err := getAuditEntries(where, args, beforeID, auditPageSize+1)
+	if err != nil {
+		log.Printf("Error fetching audit log: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	query.Del("before")
+	var olderLink string
+	if len(entries) > auditPageSize {
+		entries = entries[:auditPageSize]
+		query.Set("before", strconv.Itoa(entries[len(entries)-1].ID))
+		olderLink = "/admin/audit?" + query.Encode()
+		query.Del("before")
+	}
+
+	data := map[string]interface{}{
+		"LoggedIn":    true,
+		"Username":    user.Username,
+		"Entries":     entries,
+		"Filter":      filter,
+		"Actions":     auditActions,
+		"TargetTypes": []string{"post", "comment", "held", "user", "message", "chat", "sanction", "ip_ban", "settings", "login"},
+		"OlderLink":   olderLink,
+		"ExportLink":  "/admin/audit.csv?" + query.Encode(),
+	}
+	if err := RenderTemplate(w, "admin-audit.html", data); err != nil {
+		log.Printf("Error rendering audit log: %v", err)
+		Error500Handler(w, r)
+	}
+}
+
+// AdminAuditExportHandler downloads the filtered audit log as CSV
+func AdminAuditExportHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireStaff(w, r, true); !ok {
+		return
+	}
+
+	_, where, args, err := parseAuditFilter(r)
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+	entries, err := getAuditEntries(where, args, 0, 0)
+	if err != nil {
+		log.Printf("Error exporting audit log: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-log-%s.csv"`, time.Now().Format("2006-01-02")))
+	out := csv.NewWriter(w)
+	out.Write([]string{"id", "time", "actor", "action", "target_type", "target_id", "target", "before", "after", "ip"})
+	for _, e := range entries {
+		targetID := ""
+		if e.TargetID != 0 {
+			targetID = strconv.Itoa(e.TargetID)
+		}
+		out.Write([]string{strconv.Itoa(e.ID), e.CreatedAt.Format(time.RFC3339), csvSafe(e.Actor), e.Action,
+			e.TargetType, targetID, csvSafe(e.Target), csvSafe(e.Before), csvSafe(e.After), e.IP})
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		log.Printf("Error writing audit log export: %v", err)
+	}
+}
+
+// csvSafe stops spreadsheets from running user supplied text as a formula.
+// Some read a cell as one even after a leading tab or carriage return.
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -2,9 +2,11 @@ package RebootForums
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"math"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
@@ -13,43 +15,71 @@ import (
 
 func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		RenderTemplate(w, "register.html", nil)
+		renderRegister(w, r, RegistrationForm{}, nil, "")
 		return
 	}
 
 	if r.Method == "POST" {
-		username := strings.TrimSpace(r.FormValue("username"))
-		email := strings.TrimSpace(r.FormValue("email"))
-		password := strings.TrimSpace(r.FormValue("password"))
+		if ipBanned(clientIP(r)) {
+			w.WriteHeader(http.StatusForbidden)
+			renderRegister(w, r, RegistrationForm{}, nil, ipBanMessage)
+			return
+		}
 
-		if username == "" || email == "" || password == "" {
-			RenderTemplate(w, "register.html", map[string]interface{}{"Message": "All fields are required"})
+		submitted := RegistrationForm{Username: r.FormValue("username"), Email: r.FormValue("email")}
+		switch checkHumanForm(r, MinFormFillTime) {
+		case nil:
+		case errFormExpired:
+			w.WriteHeader(http.StatusBadRequest)
+			renderRegister(w, r, submitted, nil, "The form expired. Please submit it again.")
+			return
+		default:
+			// Deliberately vague so bots learn nothing about which check failed
+			w.WriteHeader(http.StatusBadRequest)
+			renderRegister(w, r, submitted, nil, "Your registration could not be accepted. Please check the form and try again.")
+			return
+		}
+		if !checkCaptcha(r) {
+			errs := ValidationErrors{}
+			errs.Add("captcha", "That did not match the digits shown. Please try the new code.")
+			renderRegister(w, r, submitted, errs, "")
 			return
 		}
 
-		var exists bool
-		err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ? OR email = ?)", username, email).Scan(&exists)
+		// The password is deliberately not trimmed: spaces are valid password characters
+		password := r.FormValue("password")
+
+		form, errs, err := validateRegistration(r.FormValue("username"), r.FormValue("email"), password)
 		if err != nil {
 			log.Printf("Database error during registration: %v", err)
-			RenderTemplate(w, "register.html", map[string]interface{}{"Message": "Database error"})
+			renderRegister(w, r, form, nil, "Database error")
 			return
 		}
-		if exists {
-			RenderTemplate(w, "register.html", map[string]interface{}{"Message": "Username or email already exists"})
+		if len(errs) > 0 {
+			renderRegister(w, r, form, errs, "")
 			return
 		}
+		username := form.Username
 
 		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 		if err != nil {
 			log.Printf("Error hashing password: %v", err)
-			RenderTemplate(w, "register.html", map[string]interface{}{"Message": "Error creating user"})
+			renderRegister(w, r, form, nil, "Error creating user")
 			return
 		}
 
-		_, err = DB.Exec("INSERT INTO users (username, email, password) VALUES (?, ?, ?)", username, email, string(hashedPassword))
+		_, err = DB.Exec("INSERT INTO users (username, username_key, email, password, created_at) VALUES (?, ?, ?, ?, ?)",
+			username, UsernameKey(username), form.Email, string(hashedPassword), time.Now())
+		if isUsernameConflict(err) {
+			// Someone else registered the name since it was validated
+			errs := ValidationErrors{}
+			errs.Add("username", "That username, or one that looks just like it, is already taken")
+			renderRegister(w, r, form, errs, "")
+			return
+		}
 		if err != nil {
 			log.Printf("Error creating user: %v", err)
-			RenderTemplate(w, "register.html", map[string]interface{}{"Message": "Error creating user"})
+			renderRegister(w, r, form, nil, "Error creating user")
 			return
 		}
 
@@ -58,7 +88,7 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		err = DB.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
 		if err != nil {
 			log.Printf("Error retrieving user ID: %v", err)
-			RenderTemplate(w, "register.html", map[string]interface{}{"Message": "Error retrieving user"})
+			renderRegister(w, r, form, nil, "Error retrieving user")
 			return
 		}
 
@@ -66,7 +96,7 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		sessionToken, err := generateSessionToken()
 		if err != nil {
 			log.Printf("Error generating session token: %v", err)
-			RenderTemplate(w, "register.html", map[string]interface{}{"Message": "Error creating session"})
+			renderRegister(w, r, form, nil, "Error creating session")
 			return
 		}
 
@@ -74,7 +104,7 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		err = UpsertSession(&userID, sessionToken, expiryTime, false)
 		if err != nil {
 			log.Printf("Error creating session: %v", err)
-			RenderTemplate(w, "register.html", map[string]interface{}{"Message": "Error creating session"})
+			renderRegister(w, r, form, nil, "Error creating session")
 			return
 		}
 
@@ -99,7 +129,7 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Query().Get("registered") == "true" {
 			message = "Registration successful. Please log in."
 		}
-		RenderTemplate(w, "login.html", map[string]interface{}{"Message": message})
+		renderLogin(w, r, message, false)
 		return
 	}
 
@@ -108,64 +138,166 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		password := r.FormValue("password")
 
 		if username == "" || password == "" {
-			RenderTemplate(w, "login.html", map[string]interface{}{"Message": "Username and password are required"})
+			renderLogin(w, r, "Username and password are required", true)
+			return
+		}
+
+		ip := clientIP(r)
+		switch checkHumanForm(r, MinLoginFillTime) {
+		case nil:
+		case errFormExpired:
+			renderLogin(w, r, "The login form expired. Please try again.", true)
+			return
+		default:
+			// As vague as on registration
+			w.WriteHeader(http.StatusBadRequest)
+			renderLogin(w, r, "Your login could not be accepted. Please try again.", true)
+			return
+		}
+		if !checkCaptcha(r) {
+			renderLogin(w, r, "Please enter the digits shown in the picture.", true)
+			return
+		}
+		// The attempt counts as a failure from here until the password is
+		// found to be right
+		if wait := reserveLoginAttempt(username, ip, time.Now()); wait > 0 {
+			recordLoginAttempt(r, username, ip, LoginFailThrottled)
+			renderThrottledLogin(w, r, username, ip, wait)
 			return
 		}
 
 		var user User
 		var hashedPassword string
-		err := DB.QueryRow("SELECT id, username, password FROM users WHERE username = ?", username).Scan(&user.ID, &user.Username, &hashedPassword)
+		err := DB.QueryRow("SELECT id, username, password, role, totp_enabled FROM users WHERE username = ?", username).Scan(&user.ID, &user.Username, &hashedPassword, &user.Role, &user.TOTPEnabled)
 		if err != nil {
 			if err == sql.ErrNoRows {
-				RenderTemplate(w, "login.html", map[string]interface{}{"Message": "Invalid username or password"})
+				recordLoginAttempt(r, username, ip, LoginFailUnknownUser)
+				renderLogin(w, r, "Invalid username or password", true)
 			} else {
+				releaseLoginAttempt(username, ip)
 				log.Printf("Database error during login: %v", err)
-				RenderTemplate(w, "login.html", map[string]interface{}{"Message": "An error occurred. Please try again later."})
+				renderLogin(w, r, "An error occurred. Please try again later.", true)
 			}
 			return
 		}
 
 		if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)); err != nil {
-			RenderTemplate(w, "login.html", map[string]interface{}{"Message": "Invalid username or password"})
+			recordLoginAttempt(r, username, ip, LoginFailBadPassword)
+			renderLogin(w, r, "Invalid username or password", true)
 			return
 		}
+		releaseLoginAttempt(username, ip)
 
-		// Delete any existing sessions for this user
-		_, err = DB.Exec("DELETE FROM sessions WHERE user_id = ?", user.ID)
+		// Only tell a banned user so once they have proven who they are
+		refusal, err := loginRefusal(user.ID, ip)
 		if err != nil {
-			log.Printf("Error deleting existing sessions: %v", err)
-			RenderTemplate(w, "login.html", map[string]interface{}{"Message": "An error occurred. Please try again later."})
+			log.Printf("Error checking bans: %v", err)
+			renderLogin(w, r, "An error occurred. Please try again later.", true)
+			return
+		}
+		if refusal != "" {
+			w.WriteHeader(http.StatusForbidden)
+			renderLogin(w, r, refusal, true)
 			return
 		}
 
-		sessionToken, err := generateSessionToken()
-		if err != nil {
-			log.Printf("Error generating session token: %v", err)
-			RenderTemplate(w, "login.html", map[string]interface{}{"Message": "An error occurred. Please try again later."})
+		// Users with 2FA enabled must complete a second step before getting a session,
+		// so their failure counter is only cleared once that step succeeds
+		if user.TOTPEnabled {
+			err = createPendingLogin(w, r, user.ID)
+			if err != nil {
+				log.Printf("Error creating pending login: %v", err)
+				renderLogin(w, r, "An error occurred. Please try again later.", true)
+				return
+			}
+			http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
 			return
 		}
 
-		expiryTime := time.Now().Add(24 * time.Hour)
-		err = UpsertSession(&user.ID, sessionToken, expiryTime, false)
+		recordLoginSuccess(username)
+
+		err = startUserSession(w, r, user.ID)
 		if err != nil {
 			log.Printf("Error creating session: %v", err)
-			RenderTemplate(w, "login.html", map[string]interface{}{"Message": "An error occurred. Please try again later."})
+			renderLogin(w, r, "An error occurred. Please try again later.", true)
 			return
 		}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     "session_token",
-			Value:    sessionToken,
-			Expires:  expiryTime,
-			Path:     "/",
-			HttpOnly: true,
-			Secure:   r.TLS != nil, // Set Secure flag if using HTTPS
-		})
+		if staffNeeds2FA(&user) {
+			http.Redirect(w, r, "/settings/2fa?required=1", http.StatusSeeOther)
+			return
+		}
 
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	}
 }
 
+// startUserSession replaces any existing sessions for the user with a new one and sets the cookie
+func startUserSession(w http.ResponseWriter, r *http.Request, userID int) error {
+	// Delete any existing sessions for this user
+	_, err := DB.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+
+	sessionToken, err := generateSessionToken()
+	if err != nil {
+		return err
+	}
+
+	expiryTime := time.Now().Add(24 * time.Hour)
+	err = UpsertSession(&userID, sessionToken, expiryTime, false)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session_token",
+		Value:    sessionToken,
+		Expires:  expiryTime,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil, // Set Secure flag if using HTTPS
+	})
+	return nil
+}
+
+// renderRegister re-renders the registration form with per-field errors and the submitted values
+func renderRegister(w http.ResponseWriter, r *http.Request, form RegistrationForm, errs ValidationErrors, message string) {
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	RenderTemplate(w, "register.html", map[string]interface{}{
+		"Message": message,
+		"Errors":  errs,
+		"Form":    form,
+		"Bot":     newBotCheck(r),
+	})
+}
+
+// renderLogin renders the login page with a message, the configured external
+// login providers and a CAPTCHA when the client has to solve one
+func renderLogin(w http.ResponseWriter, r *http.Request, message string, isError bool) {
+	RenderTemplate(w, "login.html", map[string]interface{}{
+		"Message":   message,
+		"Error":     isError,
+		"Providers": GetOAuthProviders(),
+		"Bot":       newBotCheck(r),
+	})
+}
+
+// renderThrottledLogin tells the client how long to wait before trying again
+func renderThrottledLogin(w http.ResponseWriter, r *http.Request, username, ip string, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	if isLoginLockout(username, ip) {
+		renderLogin(w, r, fmt.Sprintf("Too many failed login attempts. Login is locked for %s.", wait.Round(time.Minute)), true)
+		return
+	}
+	renderLogin(w, r, fmt.Sprintf("Too many failed login attempts. Please wait %d seconds before trying again.", seconds), true)
+}
+
 func generateSessionToken() (string, error) {
 	token := uuid.New().String()
 	return token, nil
@@ -0,0 +1,295 @@
+package RebootForums
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+// Avatar limits
+const (
+	MaxAvatarBytes     = 2 << 20
+	MaxAvatarDimension = 4096
+)
+
+// Avatar sizes in pixels. Every upload is stored at each of these sizes.
+const (
+	AvatarSizeSmall  = 32
+	AvatarSizeMedium = 64
+	AvatarSizeLarge  = 128
+)
+
+var avatarSizes = []int{AvatarSizeSmall, AvatarSizeMedium, AvatarSizeLarge}
+
+// avatarFormats are the image formats accepted for upload, as named by image.DecodeConfig
+var avatarFormats = map[string]bool{"png": true, "jpeg": true, "gif": true}
+
+// AvatarURL returns the image URL for a user's avatar at size pixels. Users
+// without an upload get a generated identicon.
+func AvatarURL(userID int, avatarKey string, size int) string {
+	if avatarKey != "" {
+		return getBlobStore().URL(avatarBlobKey(avatarKey, size))
+	}
+	return fmt.Sprintf("/identicon/%d?s=%d", userID, size)
+}
+
+func avatarBlobKey(avatarKey string, size int) string {
+	return fmt.Sprintf("%s-%d.png", avatarKey, size)
+}
+
+// AvatarHandler uploads a new avatar for the logged in user or removes the current one
+func AvatarHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if !requireWritable(w, r, user) {
+		return
+	}
+
+	// Leave room for the multipart envelope around the file itself
+	r.Body = http.MaxBytesReader(w, r.Body, MaxAvatarBytes+64<<10)
+	if err := r.ParseMultipartForm(MaxAvatarBytes); err != nil {
+		renderSettings(w, r, user, ValidationErrors{"avatar": "Avatar images must be at most 2 MB"}, "")
+		return
+	}
+
+	if r.FormValue("remove") == "1" {
+		if err := replaceAvatar(user.ID, ""); err != nil {
+			log.Printf("Error removing avatar: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+		http.Redirect(w, r, "/settings?saved=avatar", http.StatusSeeOther)
+		return
+	}
+
+	file, _, err := r.FormFile("avatar")
+	if err != nil {
+		renderSettings(w, r, user, ValidationErrors{"avatar": "Choose an image to upload"}, "")
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, MaxAvatarBytes+1))
+	if err != nil {
+		log.Printf("Error reading avatar upload: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	if len(data) > MaxAvatarBytes {
+		renderSettings(w, r, user, ValidationErrors{"avatar": "Avatar images must be at most 2 MB"}, "")
+		return
+	}
+
+	img, msg := decodeAvatar(data)
+	if msg != "" {
+		renderSettings(w, r, user, ValidationErrors{"avatar": msg}, "")
+		return
+	}
+
+	key, err := storeAvatar(user.ID, img)
+	if err != nil {
+		log.Printf("Error storing avatar: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	if err := replaceAvatar(user.ID, key); err != nil {
+		log.Printf("Error saving avatar: %v", err)
+		deleteAvatarBlobs(key)
+		Error500Handler(w, r)
+		return
+	}
+	http.Redirect(w, r, "/settings?saved=avatar", http.StatusSeeOther)
+}
+
+// IdenticonHandler draws the generated avatar for a user without an upload
+func IdenticonHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		Error404Handler(w, r)
+		return
+	}
+	size, err := strconv.Atoi(r.URL.Query().Get("s"))
+	if err != nil || !isAvatarSize(size) {
+		size = AvatarSizeMedium
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, renderIdenticon("user:"+strconv.Itoa(userID), size)); err != nil {
+		log.Printf("Error encoding identicon: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(buf.Bytes())
+}
+
+// decodeAvatar checks that data really is a PNG, JPEG or GIF of a sane size
+// and decodes it. The file name and the browser's content type are ignored.
+func decodeAvatar(data []byte) (image.Image, string) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || !avatarFormats[format] {
+		return nil, "Avatars must be PNG, JPEG or GIF images"
+	}
+	// Checked before decoding so a tiny file cannot expand into a huge bitmap
+	if cfg.Width > MaxAvatarDimension || cfg.Height > MaxAvatarDimension {
+		return nil, "Avatar images must be at most 4096 pixels wide and tall"
+	}
+	if cfg.Width < 1 || cfg.Height < 1 {
+		return nil, "That image is empty"
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "That image could not be read"
+	}
+	return img, ""
+}
+
+// storeAvatar crops img to a centred square, scales it to every avatar size
+// and stores the results as PNGs. Re-encoding drops EXIF and other metadata.
+func storeAvatar(userID int, img image.Image) (string, error) {
+	token, err := generateSessionToken()
+	if err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("avatars/%d/%s", userID, token)
+
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	crop := image.Rect(x0, y0, x0+side, y0+side)
+
+	store := getBlobStore()
+	for _, size := range avatarSizes {
+		dst := image.NewRGBA(image.Rect(0, 0, size, size))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, crop, draw.Src, nil)
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, dst); err != nil {
+			deleteAvatarBlobs(key)
+			return "", err
+		}
+		if err := store.Put(avatarBlobKey(key, size), &buf, "image/png"); err != nil {
+			deleteAvatarBlobs(key)
+			return "", err
+		}
+	}
+	return key, nil
+}
+
+// replaceAvatar points the user at a new avatar (or none) and deletes the old files
+func replaceAvatar(userID int, key string) error {
+	old, err := getAvatarKey(userID)
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	if key != "" {
+		value = key
+	}
+	if _, err := DB.Exec("UPDATE users SET avatar_key = ? WHERE id = ?", value, userID); err != nil {
+		return err
+	}
+	if old != "" && old != key {
+		deleteAvatarBlobs(old)
+	}
+	return nil
+}
+
+func getAvatarKey(userID int) (string, error) {
+	var key sql.NullString
+	err := DB.QueryRow("SELECT avatar_key FROM users WHERE id = ?", userID).Scan(&key)
+	return key.String, err
+}
+
+// deleteAvatarBlobs removes every size of an avatar. Failures are only logged
+// because a leftover file does no harm.
+func deleteAvatarBlobs(key string) {
+	store := getBlobStore()
+	for _, size := range avatarSizes {
+		if err := store.Delete(avatarBlobKey(key, size)); err != nil {
+			log.Printf("Error deleting avatar blob: %v", err)
+		}
+	}
+}
+
+func isAvatarSize(size int) bool {
+	for _, s := range avatarSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// renderIdenticon draws a symmetric 5x5 pattern whose cells and colour are
+// taken from a hash of seed, so the same seed always gives the same picture
+func renderIdenticon(seed string, size int) image.Image {
+	sum := sha256.Sum256([]byte(seed))
+
+	background := color.RGBA{240, 240, 240, 255}
+	foreground := hslToRGB(float64(sum[29])/255*360, 0.55, 0.55)
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{background, foreground})
+
+	const grid = 5
+	cell := size / (grid + 1)
+	margin := (size - cell*grid) / 2
+	for row := 0; row < grid; row++ {
+		for col := 0; col < (grid+1)/2; col++ {
+			// One bit per cell in the left half; the right half mirrors it
+			bit := row*3 + col
+			if sum[bit/8]>>(bit%8)&1 == 0 {
+				continue
+			}
+			for _, c := range []int{col, grid - 1 - col} {
+				r := image.Rect(margin+c*cell, margin+row*cell, margin+(c+1)*cell, margin+(row+1)*cell)
+				draw.Draw(img, r, &image.Uniform{foreground}, image.Point{}, draw.Src)
+			}
+		}
+	}
+	return img
+}
+
+func hslToRGB(h, s, l float64) color.RGBA {
+	c := (1 - math.Abs(2*l-1)) * s
+	hp := h / 60
+	x := c * (1 - math.Abs(math.Mod(hp, 2)-1))
+	var r, g, b float64
+	switch {
+	case hp < 1:
+		r, g = c, x
+	case hp < 2:
+		r, g = x, c
+	case hp < 3:
+		g, b = c, x
+	case hp < 4:
+		g, b = x, c
+	case hp < 5:
+		r, b = x, c
+	default:
+		r, b = c, x
+	}
+	m := l - c/2
+	return color.RGBA{uint8((r + m) * 255), uint8((g + m) * 255), uint8((b + m) * 255), 255}
+}
@@ -0,0 +1,151 @@
+package RebootForums
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrBlobNotFound is returned by BlobStore.Get for unknown keys
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps uploaded files such as avatars and attachments. Keys are slash separated
+// paths generated by the server, e.g. "avatars/12/5f0c...-64.png".
+type BlobStore interface {
+	// Put stores the contents of r under key, replacing any existing blob
+	Put(key string, r io.Reader, contentType string) error
+	// Get opens the blob stored under key
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the blob. Deleting a missing key is not an error.
+	Delete(key string) error
+	// URL returns the address browsers should use to fetch the blob
+	URL(key string) string
+}
+
+var (
+	blobStore   BlobStore = NewLocalBlobStore("data/blobs")
+	blobStoreMu sync.RWMutex
+)
+
+// SetBlobStore replaces the backend used for uploaded files
+func SetBlobStore(store BlobStore) {
+	blobStoreMu.Lock()
+	blobStore = store
+	blobStoreMu.Unlock()
+}
+
+func getBlobStore() BlobStore {
+	blobStoreMu.RLock()
+	defer blobStoreMu.RUnlock()
+	return blobStore
+}
+
+// LocalBlobStore keeps blobs on the local disk and serves them through /media/
+type LocalBlobStore struct {
+	Root string
+}
+
+// NewLocalBlobStore returns a store rooted at dir
+func NewLocalBlobStore(dir string) *LocalBlobStore {
+	return &LocalBlobStore{Root: dir}
+}
+
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", ErrBlobNotFound
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(key)), nil
+}
+
+func (s *LocalBlobStore) Put(key string, r io.Reader, contentType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see a partial blob
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *LocalBlobStore) Get(key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+func (s *LocalBlobStore) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) URL(key string) string {
+	return "/media/" + key
+}
+
+// MediaHandler serves blobs from the configured store. Keys contain a random
+// component that changes whenever the content does, so responses can be cached forever.
+func MediaHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	// Attachments and their thumbnails are served by AttachmentHandler and
+	// AttachmentThumbHandler, which check that the post is not deleted
+	if strings.HasPrefix(key, "attachments/") {
+		Error404Handler(w, r)
+		return
+	}
+	blob, err := getBlobStore().Get(key)
+	if err == ErrBlobNotFound {
+		Error404Handler(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error opening blob %s: %v", key, err)
+		Error500Handler(w, r)
+		return
+	}
+	defer blob.Close()
+
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	if _, err := io.Copy(w, blob); err != nil {
+		log.Printf("Error serving blob %s: %v", key, err)
+	}
+}
@@ -0,0 +1,181 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrBlocked is returned when a user tries to reach someone who blocked them
+var ErrBlocked = errors.New("blocked by this user")
+
+// isBlocked reports whether either user has blocked the other
+func isBlocked(q queryRower, userID, otherID int) (bool, error) {
+	var blocked bool
+	err := q.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM user_blocks
+			WHERE (blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?)
+		)
+	`, userID, otherID, otherID, userID).Scan(&blocked)
+	return blocked, err
+}
+
+// hasBlocked reports whether userID has blocked otherID
+func hasBlocked(q queryRower, userID, otherID int) (bool, error) {
+	var blocked bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM user_blocks WHERE blocker_id = ? AND blocked_id = ?)", userID, otherID).Scan(&blocked)
+	return blocked, err
+}
+
+func blockUser(userID, otherID int) error {
+	_, err := DB.Exec("INSERT OR IGNORE INTO user_blocks (blocker_id, blocked_id, created_at) VALUES (?, ?, ?)", userID, otherID, time.Now())
+	return err
+}
+
+func unblockUser(userID, otherID int) error {
+	_, err := DB.Exec("DELETE FROM user_blocks WHERE blocker_id = ? AND blocked_id = ?", userID, otherID)
+	return err
+}
+
+// hasMuted reports whether userID has muted otherID
+func hasMuted(userID, otherID int) (bool, error) {
+	var muted bool
+	err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM user_mutes WHERE muter_id = ? AND muted_id = ?)", userID, otherID).Scan(&muted)
+	return muted, err
+}
+
+func muteUser(userID, otherID int) error {
+	_, err := DB.Exec("INSERT OR IGNORE INTO user_mutes (muter_id, muted_id, created_at) VALUES (?, ?, ?)", userID, otherID, time.Now())
+	return err
+}
+
+func unmuteUser(userID, otherID int) error {
+	_, err := DB.Exec("DELETE FROM user_mutes WHERE muter_id = ? AND muted_id = ?", userID, otherID)
+	return err
+}
+
+// BlockedUser is an entry in the blocked or muted list on the settings page
+type BlockedUser struct {
+	Username  string
+	CreatedAt time.Time
+}
+
+// getUserList returns the users in a block or mute table for userID, by name.
+// table and the column names come from the callers below, never from input.
+func getUserList(table, ownerColumn, otherColumn string, userID int) ([]BlockedUser, error) {
+	rows, err := DB.Query(`
+		SELECT u.username, t.created_at FROM `+table+` t
+		JOIN users u ON u.id = t.`+otherColumn+`
+		WHERE t.`+ownerColumn+` = ? AND u.deleted_at IS NULL
+		ORDER BY u.username COLLATE NOCASE
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []BlockedUser
+	for rows.Next() {
+		var u BlockedUser
+		if err := rows.Scan(&u.Username, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func getBlockedUsers(userID int) ([]BlockedUser, error) {
+	return getUserList("user_blocks", "blocker_id", "blocked_id", userID)
+}
+
+func getMutedUsers(userID int) ([]BlockedUser, error) {
+	return getUserList("user_mutes", "muter_id", "muted_id", userID)
+}
+
+// BlockUserHandler blocks or unblocks the user named in the path. A blocked
+// user cannot message, mention or reply to the user who blocked them.
+func BlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	updateUserRelation(w, r, map[string]func(int, int) error{
+		"block":   blockUser,
+		"unblock": unblockUser,
+	})
+}
+
+// MuteUserHandler mutes or unmutes the user named in the path. Posts by a
+// muted user are left out of the feeds and their comments are collapsed.
+func MuteUserHandler(w http.ResponseWriter, r *http.Request) {
+	updateUserRelation(w, r, map[string]func(int, int) error{
+		"mute":   muteUser,
+		"unmute": unmuteUser,
+	})
+}
+
+// BlockListHandler adds to or removes from the blocked and muted lists on the
+// settings page, where the username is a form field
+func BlockListHandler(w http.ResponseWriter, r *http.Request) {
+	updateUserRelation(w, r, map[string]func(int, int) error{
+		"block":   blockUser,
+		"unblock": unblockUser,
+		"mute":    muteUser,
+		"unmute":  unmuteUser,
+	})
+}
+
+// updateUserRelation applies the form action to the session user and the
+// user in the path, then returns to the profile or to the settings page
+func updateUserRelation(w http.ResponseWriter, r *http.Request, actions map[string]func(int, int) error) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	username := r.PathValue("username")
+	// The settings form names the user in a field instead of the path
+	fromSettings := username == ""
+	if fromSettings {
+		username = strings.TrimSpace(r.FormValue("username"))
+	}
+	var otherID int
+	err = DB.QueryRow("SELECT id FROM users WHERE username = ? AND deleted_at IS NULL", username).Scan(&otherID)
+	if (err == sql.ErrNoRows || otherID == user.ID) && fromSettings {
+		http.Redirect(w, r, "/settings?error=blockuser#blocked", http.StatusSeeOther)
+		return
+	}
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching user: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	if otherID == user.ID {
+		Error400Handler(w, r)
+		return
+	}
+
+	action, ok := actions[r.FormValue("action")]
+	if !ok {
+		Error400Handler(w, r)
+		return
+	}
+	if err := action(user.ID, otherID); err != nil {
+		log.Printf("Error updating %s: %v", r.FormValue("action"), err)
+		Error500Handler(w, r)
+		return
+	}
+
+	if fromSettings {
+		http.Redirect(w, r, "/settings#blocked", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/user/"+url.PathEscape(username), http.StatusSeeOther)
+}
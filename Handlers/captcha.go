@@ -0,0 +1,452 @@
+package RebootForums
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"math"
+	mrand "math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Bot protection settings
+const (
+	SettingCaptchaMode = "captcha_mode"
+	SettingFormSecret  = "form_token_secret"
+)
+
+// CAPTCHA modes. In CaptchaSuspicious mode the CAPTCHA is only shown to an IP
+// that recently tripped a bot check, or to everyone while many IPs do.
+const (
+	CaptchaOff        = "off"
+	CaptchaSuspicious = "suspicious"
+	CaptchaAlways     = "always"
+)
+
+var captchaModes = []string{CaptchaOff, CaptchaSuspicious, CaptchaAlways}
+
+// Form timing limits. People take a few seconds to fill in a form; scripts
+// post it straight away. Logins get a shorter minimum because password
+// managers fill them in at once.
+const (
+	MinFormFillTime  = 3 * time.Second
+	MinLoginFillTime = time.Second
+	MaxFormAge       = 24 * time.Hour
+)
+
+const (
+	captchaLength        = 5
+	captchaTTL           = 10 * time.Minute
+	maxCaptchaChallenges = 10000
+	captchaWidth         = 200
+	captchaHeight        = 70
+
+	// suspicionWindow is how long a bot check failure makes an IP solve CAPTCHAs
+	suspicionWindow = time.Hour
+	// siteWideSuspicion failures from any IPs within suspicionWindow turn the
+	// CAPTCHA on for everyone
+	siteWideSuspicion = 20
+	// suspiciousLoginFailures failed logins make an IP solve CAPTCHAs
+	suspiciousLoginFailures = 5
+)
+
+var (
+	errFormTooFast = errors.New("form submitted too quickly")
+	errFormExpired = errors.New("form expired")
+	errFormInvalid = errors.New("form token missing or invalid")
+)
+
+// BotCheck is what a protected form needs to render: a signed start time and,
+// when one is required, a CAPTCHA to solve. CaptchaWait says how long to wait
+// when a CAPTCHA is required but none could be handed out.
+type BotCheck struct {
+	FormToken   string
+	CaptchaID   string
+	CaptchaWait string
+}
+
+// newBotCheck prepares the bot checks for a form shown to r's client
+func newBotCheck(r *http.Request) BotCheck {
+	check := BotCheck{FormToken: newFormToken(time.Now())}
+	ip := clientIP(r)
+	if !captchaRequired(ip) {
+		return check
+	}
+	if result := takeRateLimit(CaptchaRateLimit, 0, ip); !result.Allowed {
+		check.CaptchaWait = formatWait(int(math.Ceil(result.RetryAfter.Seconds())))
+	} else if id, ok := newCaptcha(); ok {
+		check.CaptchaID = id
+	} else {
+		check.CaptchaWait = "a minute"
+	}
+	return check
+}
+
+// checkHumanForm looks at the honeypot field and the form token of a
+// submission, which must have been sent at least minFill after the form was
+// shown. A failure is flagged as suspicious unless the form simply expired.
+func checkHumanForm(r *http.Request, minFill time.Duration) error {
+	ip := clientIP(r)
+	// The honeypot is hidden from people, but bots fill in every field they find
+	if r.FormValue("website") != "" {
+		flagSuspicious(ip, "honeypot filled")
+		return errFormInvalid
+	}
+	err := checkFormToken(r.FormValue("form_token"), minFill, time.Now())
+	if err != nil && err != errFormExpired {
+		flagSuspicious(ip, err.Error())
+	}
+	return err
+}
+
+// checkCaptcha verifies the CAPTCHA answer in r when the client has to solve
+// one. Wrong answers are flagged as suspicious.
+func checkCaptcha(r *http.Request) bool {
+	ip := clientIP(r)
+	if !captchaRequired(ip) {
+		return true
+	}
+	if solveCaptcha(r.FormValue("captcha_id"), r.FormValue("captcha_answer")) {
+		return true
+	}
+	flagSuspicious(ip, "wrong CAPTCHA answer")
+	return false
+}
+
+// captchaRequired reports whether a client at ip must solve a CAPTCHA
+func captchaRequired(ip string) bool {
+	switch GetSetting(SettingCaptchaMode, CaptchaSuspicious) {
+	case CaptchaOff:
+		return false
+	case CaptchaAlways:
+		return true
+	}
+	ipFlagged, siteWide := suspicion.state(ip, time.Now())
+	return ipFlagged || siteWide ||
+		getAttemptStore().State(ipThrottleKey(ip)).Failures >= suspiciousLoginFailures
+}
+
+var (
+	formSecret     []byte
+	formSecretOnce sync.Once
+)
+
+// getFormSecret returns the key form tokens are signed with. It is created on
+// first use and kept in the site settings so tokens survive a restart.
+func getFormSecret() []byte {
+	formSecretOnce.Do(func() {
+		if secret, err := hex.DecodeString(GetSetting(SettingFormSecret, "")); err == nil && len(secret) == 32 {
+			formSecret = secret
+			return
+		}
+		formSecret = make([]byte, 32)
+		if _, err := rand.Read(formSecret); err != nil {
+			log.Printf("Error generating form secret: %v", err)
+		}
+		if err := SetSetting(SettingFormSecret, hex.EncodeToString(formSecret)); err != nil {
+			log.Printf("Error saving form secret: %v", err)
+		}
+	})
+	return formSecret
+}
+
+func signFormTime(unix string) string {
+	mac := hmac.New(sha256.New, getFormSecret())
+	mac.Write([]byte(unix))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newFormToken records when a form was shown, signed so it cannot be forged
+func newFormToken(now time.Time) string {
+	unix := strconv.FormatInt(now.Unix(), 10)
+	return unix + "." + signFormTime(unix)
+}
+
+func checkFormToken(token string, minFill time.Duration, now time.Time) error {
+	unix, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(signFormTime(unix))) {
+		return errFormInvalid
+	}
+	seconds, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return errFormInvalid
+	}
+	age := now.Sub(time.Unix(seconds, 0))
+	switch {
+	case age < minFill:
+		return errFormTooFast
+	case age > MaxFormAge:
+		return errFormExpired
+	}
+	return nil
+}
+
+// suspicionTracker remembers recent bot check failures by IP and site-wide
+type suspicionTracker struct {
+	mu     sync.Mutex
+	byIP   map[string]time.Time // last failure per IP
+	events []time.Time          // every failure in the window, oldest first
+}
+
+var suspicion = &suspicionTracker{byIP: make(map[string]time.Time)}
+
+// flagSuspicious records a bot check failure from ip
+func flagSuspicious(ip, reason string) {
+	log.Printf("Suspicious request from %s: %s", ip, reason)
+	suspicion.flag(ip, time.Now())
+}
+
+func (t *suspicionTracker) flag(ip string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune(now)
+	t.byIP[ip] = now
+	t.events = append(t.events, now)
+}
+
+// state reports whether ip failed a bot check recently and whether there
+// have been enough failures to challenge everyone
+func (t *suspicionTracker) state(ip string, now time.Time) (ipFlagged, siteWide bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune(now)
+	_, ipFlagged = t.byIP[ip]
+	return ipFlagged, len(t.events) >= siteWideSuspicion
+}
+
+// counts returns how many IPs and failures are in the window
+func (t *suspicionTracker) counts(now time.Time) (ips, events int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune(now)
+	return len(t.byIP), len(t.events)
+}
+
+func (t *suspicionTracker) prune(now time.Time) {
+	cutoff := now.Add(-suspicionWindow)
+	i := 0
+	for i < len(t.events) && t.events[i].Before(cutoff) {
+		i++
+	}
+	t.events = t.events[i:]
+	// Every IP has an event in the window, so more IPs than events means some are stale
+	if len(t.byIP) > len(t.events) {
+		for ip, last := range t.byIP {
+			if last.Before(cutoff) {
+				delete(t.byIP, ip)
+			}
+		}
+	}
+}
+
+type captchaChallenge struct {
+	answer  string
+	expires time.Time
+	// image and audio are the PNG and WAV, made on the first fetch and served
+	// as they are after that so reloading does not give a bot fresh noise to
+	// average out
+	image, audio []byte
+}
+
+var (
+	captchaMu         sync.Mutex
+	captchaChallenges = make(map[string]captchaChallenge)
+)
+
+// newCaptcha creates a challenge and returns its ID. It fails when the store
+// is full of unexpired challenges; those belong to people filling in forms,
+// so none are dropped to make room.
+func newCaptcha() (string, bool) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Printf("Error generating CAPTCHA ID: %v", err)
+	}
+	challenge := captchaChallenge{answer: randomDigits(captchaLength), expires: time.Now().Add(captchaTTL)}
+
+	captchaMu.Lock()
+	defer captchaMu.Unlock()
+	if len(captchaChallenges) >= maxCaptchaChallenges {
+		now := time.Now()
+		for key, c := range captchaChallenges {
+			if now.After(c.expires) {
+				delete(captchaChallenges, key)
+			}
+		}
+		if len(captchaChallenges) >= maxCaptchaChallenges {
+			log.Printf("CAPTCHA store full with %d challenges", len(captchaChallenges))
+			return "", false
+		}
+	}
+	captchaChallenges[hex.EncodeToString(id)] = challenge
+	return hex.EncodeToString(id), true
+}
+
+// captchaMedia returns the PNG of an unexpired challenge, or its WAV when
+// audio is set, making it the first time it is asked for
+func captchaMedia(id string, audio bool) ([]byte, bool, error) {
+	cached := func(c *captchaChallenge) *[]byte {
+		if audio {
+			return &c.audio
+		}
+		return &c.image
+	}
+
+	captchaMu.Lock()
+	c, ok := captchaChallenges[id]
+	captchaMu.Unlock()
+	if !ok || time.Now().After(c.expires) {
+		return nil, false, nil
+	}
+	if media := *cached(&c); media != nil {
+		return media, true, nil
+	}
+
+	var media []byte
+	if audio {
+		var err error
+		if media, err = renderCaptchaAudio(c.answer); err != nil {
+			return nil, true, err
+		}
+	} else {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, renderCaptchaImage(c.answer)); err != nil {
+			return nil, true, err
+		}
+		media = buf.Bytes()
+	}
+
+	captchaMu.Lock()
+	defer captchaMu.Unlock()
+	c, ok = captchaChallenges[id]
+	if !ok {
+		return nil, false, nil
+	}
+	// A parallel fetch may have made it first; everyone gets the same copy
+	if *cached(&c) == nil {
+		*cached(&c) = media
+		captchaChallenges[id] = c
+	}
+	return *cached(&c), true, nil
+}
+
+// solveCaptcha checks an answer. Each challenge can only be tried once.
+func solveCaptcha(id, answer string) bool {
+	captchaMu.Lock()
+	c, ok := captchaChallenges[id]
+	delete(captchaChallenges, id)
+	captchaMu.Unlock()
+
+	answer = strings.Join(strings.Fields(answer), "")
+	return ok && time.Now().Before(c.expires) &&
+		hmac.Equal([]byte(answer), []byte(c.answer))
+}
+
+// randomDigits returns n random decimal digits
+func randomDigits(n int) string {
+	digits := make([]byte, 0, n)
+	b := make([]byte, 1)
+	for len(digits) < n {
+		if _, err := rand.Read(b); err != nil {
+			log.Printf("Error generating CAPTCHA: %v", err)
+			b[0] = byte(mrand.IntN(250))
+		}
+		// Values from 250 up would make the low digits more likely
+		if b[0] < 250 {
+			digits = append(digits, '0'+b[0]%10)
+		}
+	}
+	return string(digits)
+}
+
+// CaptchaHandler serves a challenge as a PNG image
+func CaptchaHandler(w http.ResponseWriter, r *http.Request) {
+	serveCaptcha(w, r, false, "image/png")
+}
+
+// CaptchaAudioHandler serves a challenge as a WAV recording for people who
+// cannot read the picture. A bot can transcribe it more easily than it can
+// read the picture, but the alternative is locking them out.
+func CaptchaAudioHandler(w http.ResponseWriter, r *http.Request) {
+	serveCaptcha(w, r, true, "audio/wav")
+}
+
+func serveCaptcha(w http.ResponseWriter, r *http.Request, audio bool, contentType string) {
+	media, ok, err := captchaMedia(r.PathValue("id"), audio)
+	if err != nil {
+		log.Printf("Error rendering CAPTCHA: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	if !ok {
+		Error404Handler(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(media)
+}
+
+// renderCaptchaImage draws the digits small, then scales them up through a
+// wave so the strokes bend, and covers the result with dots and lines
+func renderCaptchaImage(answer string) image.Image {
+	face := basicfont.Face7x13
+	small := image.NewGray(image.Rect(0, 0, len(answer)*10+4, 20))
+	draw.Draw(small, small.Bounds(), image.White, image.Point{}, draw.Src)
+	d := font.Drawer{Dst: small, Src: image.Black, Face: face}
+	for i, c := range answer {
+		d.Dot = fixed.P(2+i*10+mrand.IntN(3)-1, 14+mrand.IntN(5)-2)
+		d.DrawString(string(c))
+	}
+
+	bg := color.RGBA{uint8(225 + mrand.IntN(30)), uint8(225 + mrand.IntN(30)), uint8(225 + mrand.IntN(30)), 255}
+	fg := color.RGBA{uint8(mrand.IntN(90)), uint8(mrand.IntN(90)), uint8(mrand.IntN(90)), 255}
+	img := image.NewRGBA(image.Rect(0, 0, captchaWidth, captchaHeight))
+
+	sx := float64(small.Bounds().Dx()) / captchaWidth
+	sy := float64(small.Bounds().Dy()) / captchaHeight
+	ampX, ampY := 3+mrand.Float64()*4, 3+mrand.Float64()*4
+	periodX, periodY := 8+mrand.Float64()*8, 20+mrand.Float64()*20
+	phaseX, phaseY := mrand.Float64()*2*math.Pi, mrand.Float64()*2*math.Pi
+	for y := 0; y < captchaHeight; y++ {
+		for x := 0; x < captchaWidth; x++ {
+			u := (float64(x) + ampX*math.Sin(float64(y)/periodX+phaseX)) * sx
+			v := (float64(y) + ampY*math.Sin(float64(x)/periodY+phaseY)) * sy
+			if small.GrayAt(int(u), int(v)).Y < 128 {
+				img.SetRGBA(x, y, fg)
+			} else {
+				img.SetRGBA(x, y, bg)
+			}
+		}
+	}
+
+	for i := 0; i < captchaWidth*captchaHeight/10; i++ {
+		shade := uint8(mrand.IntN(256))
+		img.SetRGBA(mrand.IntN(captchaWidth), mrand.IntN(captchaHeight), color.RGBA{shade, shade, shade, 255})
+	}
+	for i := 0; i < 3; i++ {
+		base := 10 + mrand.Float64()*(captchaHeight-20)
+		amp, period, phase := 5+mrand.Float64()*10, 15+mrand.Float64()*30, mrand.Float64()*2*math.Pi
+		for x := 0; x < captchaWidth; x++ {
+			y := int(base + amp*math.Sin(float64(x)/period+phase))
+			img.SetRGBA(x, y, fg)
+			img.SetRGBA(x, y+1, fg)
+		}
+	}
+	return img
+}
@@ -0,0 +1,162 @@
+package RebootForums
+
+import (
+	"bytes"
+	"embed"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	mrand "math/rand/v2"
+	"sync"
+)
+
+//go:generate go run ../tools/digitvoice -out captchavoice
+
+// captchaVoice holds a recording of each digit, 0.wav to 9.wav, as 16-bit
+// mono PCM at captchaSampleRate
+//
+//go:embed captchavoice/*.wav
+var captchaVoice embed.FS
+
+const captchaSampleRate = 16000
+
+var (
+	digitSamples     [10][]float64
+	digitSamplesErr  error
+	digitSamplesOnce sync.Once
+)
+
+// loadDigitSamples decodes the bundled digit recordings once
+func loadDigitSamples() ([10][]float64, error) {
+	digitSamplesOnce.Do(func() {
+		for d := range digitSamples {
+			data, err := captchaVoice.ReadFile(fmt.Sprintf("captchavoice/%d.wav", d))
+			if err != nil {
+				digitSamplesErr = err
+				return
+			}
+			if digitSamples[d], err = decodeWAV(data); err != nil {
+				digitSamplesErr = fmt.Errorf("captchavoice/%d.wav: %w", d, err)
+				return
+			}
+		}
+	})
+	return digitSamples, digitSamplesErr
+}
+
+// decodeWAV reads the samples of a 16-bit mono PCM WAV file
+func decodeWAV(data []byte) ([]float64, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, errors.New("not a WAV file")
+	}
+	for pos := 12; pos+8 <= len(data); {
+		id, size := string(data[pos:pos+4]), int(binary.LittleEndian.Uint32(data[pos+4:pos+8]))
+		pos += 8
+		if size > len(data)-pos {
+			break
+		}
+		switch id {
+		case "fmt ":
+			if size < 16 || binary.LittleEndian.Uint16(data[pos:]) != 1 ||
+				binary.LittleEndian.Uint16(data[pos+2:]) != 1 ||
+				binary.LittleEndian.Uint32(data[pos+4:]) != captchaSampleRate ||
+				binary.LittleEndian.Uint16(data[pos+14:]) != 16 {
+				return nil, errors.New("not 16-bit mono PCM at the CAPTCHA sample rate")
+			}
+		case "data":
+			samples := make([]float64, size/2)
+			for i := range samples {
+				samples[i] = float64(int16(binary.LittleEndian.Uint16(data[pos+2*i:]))) / math.MaxInt16
+			}
+			return samples, nil
+		}
+		pos += size + size%2
+	}
+	return nil, errors.New("no sample data")
+}
+
+// renderCaptchaAudio reads the answer out as a WAV file. Every digit is said
+// at a slightly different speed, pitch and loudness with random pauses
+// between, over a murmur of other digits played backwards, so the recording
+// cannot be matched against the bundled samples byte for byte.
+func renderCaptchaAudio(answer string) ([]byte, error) {
+	samples, err := loadDigitSamples()
+	if err != nil {
+		return nil, err
+	}
+	seconds := func(s float64) int { return int(s * captchaSampleRate) }
+
+	var out []float64
+	place := func(at int, sound []float64, gain float64) {
+		if need := at + len(sound); need > len(out) {
+			out = append(out, make([]float64, need-len(out))...)
+		}
+		for i, v := range sound {
+			out[at+i] += v * gain
+		}
+	}
+
+	at := seconds(0.5)
+	for _, c := range answer {
+		digit := stretch(samples[c-'0'], 0.9+mrand.Float64()*0.2)
+		place(at, digit, 0.7+mrand.Float64()*0.3)
+		at += len(digit) + seconds(0.4+mrand.Float64()*0.5)
+	}
+	// The pause after the last digit stays in as a tail
+	out = append(out, make([]float64, at-len(out))...)
+
+	for at := 0; at < len(out); at += seconds(0.15 + mrand.Float64()*0.3) {
+		murmur := stretch(samples[mrand.IntN(10)], 0.8+mrand.Float64()*0.4)
+		for i, j := 0, len(murmur)-1; i < j; i, j = i+1, j-1 {
+			murmur[i], murmur[j] = murmur[j], murmur[i]
+		}
+		if at+len(murmur) <= len(out) {
+			place(at, murmur, 0.1+mrand.Float64()*0.1)
+		}
+	}
+	for i := range out {
+		out[i] += (mrand.Float64()*2 - 1) * 0.02
+	}
+	return encodeWAV(out), nil
+}
+
+// stretch resamples sound by factor, which makes it slower and lower when
+// above 1
+func stretch(sound []float64, factor float64) []float64 {
+	out := make([]float64, int(float64(len(sound)-1)*factor))
+	for i := range out {
+		pos := float64(i) / factor
+		j := int(pos)
+		frac := pos - float64(j)
+		out[i] = sound[j]*(1-frac) + sound[j+1]*frac
+	}
+	return out
+}
+
+// encodeWAV writes samples as a 16-bit mono PCM WAV file, scaled down when
+// they would clip
+func encodeWAV(samples []float64) []byte {
+	peak := 1.0
+	for _, v := range samples {
+		peak = math.Max(peak, math.Abs(v))
+	}
+	size := uint32(len(samples) * 2)
+	var buf bytes.Buffer
+	buf.Grow(44 + len(samples)*2)
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, 36+size)
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, []uint32{16})
+	binary.Write(&buf, binary.LittleEndian, []uint16{1, 1})
+	binary.Write(&buf, binary.LittleEndian, []uint32{captchaSampleRate, captchaSampleRate * 2})
+	binary.Write(&buf, binary.LittleEndian, []uint16{2, 16})
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, size)
+	pcm := make([]int16, len(samples))
+	for i, v := range samples {
+		pcm[i] = int16(v / peak * math.MaxInt16)
+	}
+	binary.Write(&buf, binary.LittleEndian, pcm)
+	return buf.Bytes()
+}
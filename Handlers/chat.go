@@ -0,0 +1,336 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// SettingChatScrollback is the site setting for how many earlier messages a
+// user sees when joining a chat room
+const SettingChatScrollback = "chat_scrollback"
+
+const (
+	DefaultChatScrollback = 50
+	MaxChatScrollback     = 500
+	MaxChatMessageLength  = 500
+)
+
+// WebSocket timings, following the gorilla/websocket chat example
+const (
+	chatWriteWait  = 10 * time.Second
+	chatPongWait   = 60 * time.Second
+	chatPingPeriod = chatPongWait * 9 / 10
+	chatReadLimit  = 4096
+)
+
+// chatUpgrader accepts connections from this site only; the default origin
+// check stops other sites from opening a socket with the user's cookie
+var chatUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// ChatMessage is a message posted in a category's chat room
+type ChatMessage struct {
+	ID        int       `json:"id"`
+	Author    string    `json:"author"`
+	AvatarURL string    `json:"avatar_url"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// chatFrame is what goes over the socket in either direction
+type chatFrame struct {
+	Type     string        `json:"type"`
+	Content  string        `json:"content,omitempty"`
+	ID       int           `json:"id,omitempty"`
+	Message  *ChatMessage  `json:"message,omitempty"`
+	Messages []ChatMessage `json:"messages,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+func chatTopic(categoryID int) string {
+	return "chat:" + strconv.Itoa(categoryID)
+}
+
+// allowChatMessage reports whether userID may send a message now
+func allowChatMessage(userID int) bool {
+	return takeRateLimit(ChatRateLimit, userID, "").Allowed
+}
+
+func getCategory(categoryID int) (Category, error) {
+	var c Category
+	err := DB.QueryRow("SELECT id, name FROM categories WHERE id = ?", categoryID).Scan(&c.ID, &c.Name)
+	return c, err
+}
+
+// getChatHistory returns the latest scrollback messages of a room, oldest first
+func getChatHistory(categoryID int) ([]ChatMessage, error) {
+	rows, err := DB.Query(`
+		SELECT m.id, u.username, u.id, COALESCE(u.avatar_key, ''), m.content, m.created_at
+		FROM chat_messages m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.category_id = ?
+		ORDER BY m.id DESC
+		LIMIT ?
+	`, categoryID, GetIntSetting(SettingChatScrollback, DefaultChatScrollback))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []ChatMessage
+	for rows.Next() {
+		var m ChatMessage
+		var userID int
+		var avatarKey string
+		if err := rows.Scan(&m.ID, &m.Author, &userID, &avatarKey, &m.Content, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		m.AvatarURL = AvatarURL(userID, avatarKey, AvatarSizeSmall)
+		messages = append(messages, m)
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, rows.Err()
+}
+
+func saveChatMessage(categoryID int, user *User, content string) (ChatMessage, error) {
+	m := ChatMessage{Author: user.Username, Content: content, CreatedAt: time.Now()}
+	result, err := DB.Exec("INSERT INTO chat_messages (category_id, user_id, content, created_at) VALUES (?, ?, ?, ?)",
+		categoryID, user.ID, content, m.CreatedAt)
+	if err != nil {
+		return m, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return m, err
+	}
+	m.ID = int(id)
+
+	var avatarKey string
+	if err := DB.QueryRow("SELECT COALESCE(avatar_key, '') FROM users WHERE id = ?", user.ID).Scan(&avatarKey); err != nil {
+		return m, err
+	}
+	m.AvatarURL = AvatarURL(user.ID, avatarKey, AvatarSizeSmall)
+	return m, nil
+}
+
+// deleteChatMessage removes a message from a room and returns it, or
+// sql.ErrNoRows if the room has no such message
+func deleteChatMessage(categoryID, messageID int) (ChatMessage, error) {
+	m := ChatMessage{ID: messageID}
+	err := DB.QueryRow(`
+		SELECT u.username, m.content, m.created_at FROM chat_messages m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.id = ? AND m.category_id = ?
+	`, messageID, categoryID).Scan(&m.Author, &m.Content, &m.CreatedAt)
+	if err != nil {
+		return m, err
+	}
+	_, err = DB.Exec("DELETE FROM chat_messages WHERE id = ?", messageID)
+	return m, err
+}
+
+func publishChatFrame(categoryID int, frame chatFrame) {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		log.Printf("Error encoding chat frame: %v", err)
+		return
+	}
+	getBroker().Publish(chatTopic(categoryID), Event{Type: frame.Type, Data: data})
+}
+
+// ChatRoomHandler shows the chat page of a category
+func ChatRoomHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	categoryID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+	category, err := getCategory(categoryID)
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching category: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	data := map[string]interface{}{
+		"LoggedIn":            true,
+		"Username":            user.Username,
+		"UnreadNotifications": UnreadNotificationCount(user.ID),
+		"UnreadMessages":      UnreadMessageCount(user.ID),
+		"Category":            category,
+		"IsStaff":             actingStaff(user),
+		"MaxLength":           MaxChatMessageLength,
+	}
+	if err := RenderTemplate(w, "chat.html", data); err != nil {
+		log.Printf("Error rendering chat: %v", err)
+		Error500Handler(w, r)
+	}
+}
+
+// ChatSocketHandler upgrades to a WebSocket for a category's chat room. The
+// session cookie sent with the handshake identifies the user.
+func ChatSocketHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Error(w, "You must be logged in to chat", http.StatusUnauthorized)
+		return
+	}
+
+	categoryID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+	if _, err := getCategory(categoryID); err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error fetching category: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	ip := clientIP(r)
+	conn, err := chatUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied with an error
+		return
+	}
+	defer conn.Close()
+
+	events, cancel := getBroker().Subscribe(chatTopic(categoryID))
+	defer cancel()
+
+	history, err := getChatHistory(categoryID)
+	if err != nil {
+		log.Printf("Error fetching chat history: %v", err)
+		return
+	}
+
+	// Only the writer goroutine writes to conn; the reader sends it replies
+	replies := make(chan chatFrame, 4)
+	done := make(chan struct{})
+	go chatWriter(conn, events, replies, done)
+	defer close(done)
+
+	replies <- chatFrame{Type: "history", Messages: history}
+
+	conn.SetReadLimit(chatReadLimit)
+	conn.SetReadDeadline(time.Now().Add(chatPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(chatPongWait))
+	})
+
+	for {
+		var frame chatFrame
+		if err := conn.ReadJSON(&frame); err != nil {
+			return
+		}
+		if reply, ok := handleChatFrame(categoryID, user, ip, frame); ok {
+			select {
+			case replies <- reply:
+			default:
+			}
+		}
+	}
+}
+
+// handleChatFrame acts on a frame from a client and returns an error frame
+// for that client only, if there is one
+func handleChatFrame(categoryID int, user *User, ip string, frame chatFrame) (chatFrame, bool) {
+	switch frame.Type {
+	case "message":
+		content := strings.TrimSpace(frame.Content)
+		if content == "" {
+			return chatFrame{}, false
+		}
+		if utf8.RuneCountInString(content) > MaxChatMessageLength {
+			return chatFrame{Type: "error", Error: "Messages can be at most " + strconv.Itoa(MaxChatMessageLength) + " characters."}, true
+		}
+		if msg := readOnlyMessage(user, ip); msg != "" {
+			return chatFrame{Type: "error", Error: msg}, true
+		}
+		if !allowChatMessage(user.ID) {
+			return chatFrame{Type: "error", Error: "You are sending messages too quickly. Please wait a moment."}, true
+		}
+		m, err := saveChatMessage(categoryID, user, content)
+		if err != nil {
+			log.Printf("Error saving chat message: %v", err)
+			return chatFrame{Type: "error", Error: "Your message could not be sent."}, true
+		}
+		publishChatFrame(categoryID, chatFrame{Type: "message", Message: &m})
+
+	case "delete":
+		if !actingStaff(user) {
+			return chatFrame{Type: "error", Error: "Only moderators can delete messages."}, true
+		}
+		if msg := readOnlyMessage(user, ip); msg != "" {
+			return chatFrame{Type: "error", Error: msg}, true
+		}
+		deleted, err := deleteChatMessage(categoryID, frame.ID)
+		if err == sql.ErrNoRows {
+			return chatFrame{}, false
+		}
+		if err != nil {
+			log.Printf("Error deleting chat message: %v", err)
+			return chatFrame{Type: "error", Error: "The message could not be deleted."}, true
+		}
+		publishChatFrame(categoryID, chatFrame{Type: "delete", ID: frame.ID})
+		recordAudit(user, ip, AuditEvent{Action: AuditChatDelete, TargetType: "chat", TargetID: frame.ID, Target: deleted.Author,
+			Before: map[string]interface{}{"author": deleted.Author, "content": deleted.Content, "room": categoryID}})
+	}
+	return chatFrame{}, false
+}
+
+// chatWriter sends room events, replies and pings to one connection until
+// the reader stops or a write fails
+func chatWriter(conn *websocket.Conn, events <-chan Event, replies <-chan chatFrame, done <-chan struct{}) {
+	ping := time.NewTicker(chatPingPeriod)
+	defer ping.Stop()
+	// A failed write closes the socket so the reader returns as well
+	defer conn.Close()
+
+	for {
+		var err error
+		conn.SetWriteDeadline(time.Now().Add(chatWriteWait))
+		select {
+		case <-done:
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			err = conn.WriteMessage(websocket.TextMessage, event.Data)
+		case reply := <-replies:
+			err = conn.WriteJSON(reply)
+		case <-ping.C:
+			err = conn.WriteMessage(websocket.PingMessage, nil)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
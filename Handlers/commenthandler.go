@@ -1,7 +1,7 @@
 package RebootForums
 
 import (
-	//	"database/sql"
+	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
@@ -10,14 +10,17 @@ import (
 	"time"
 )
 
-func getCommentsByPostID(postID int) ([]Comment, error) {
+// getCommentsByPostID returns the comments on a post, marking those by
+// authors viewerID muted
+func getCommentsByPostID(postID, viewerID int) ([]Comment, error) {
 	rows, err := DB.Query(`
-        SELECT c.id, c.content, u.username, c.created_at
+        SELECT c.id, c.content, u.username, u.id, COALESCE(u.avatar_key, ''), c.created_at,
+            EXISTS(SELECT 1 FROM user_mutes WHERE muter_id = ? AND muted_id = c.user_id)
         FROM comments c
         JOIN users u ON c.user_id = u.id
-        WHERE c.post_id = ?
+        WHERE c.post_id = ? AND c.deleted_at IS NULL
         ORDER BY c.created_at ASC
-    `, postID)
+    `, viewerID, postID)
 	if err != nil {
 		return nil, err
 	}
@@ -26,9 +29,11 @@ func getCommentsByPostID(postID int) ([]Comment, error) {
 	var comments []Comment
 	for rows.Next() {
 		var comment Comment
-		if err := rows.Scan(&comment.ID, &comment.Content, &comment.Author, &comment.CreatedAt); err != nil {
+		var avatarKey string
+		if err := rows.Scan(&comment.ID, &comment.Content, &comment.Author, &comment.AuthorID, &avatarKey, &comment.CreatedAt, &comment.Muted); err != nil {
 			return nil, err
 		}
+		comment.AvatarURL = AvatarURL(comment.AuthorID, avatarKey, AvatarSizeSmall)
 		// Get like counts for each comment
 		comment.Likes, comment.Dislikes, err = GetLikeCounts(comment.ID, false) // false indicates it's a comment
 		if err != nil {
@@ -39,6 +44,23 @@ func getCommentsByPostID(postID int) ([]Comment, error) {
 	return comments, nil
 }
 
+// getComment returns a single comment with its author
+func getComment(commentID int) (Comment, error) {
+	var comment Comment
+	var avatarKey string
+	err := DB.QueryRow(`
+        SELECT c.id, c.post_id, c.content, u.username, u.id, COALESCE(u.avatar_key, ''), c.created_at
+        FROM comments c
+        JOIN users u ON c.user_id = u.id
+        WHERE c.id = ? AND c.deleted_at IS NULL
+    `, commentID).Scan(&comment.ID, &comment.PostID, &comment.Content, &comment.Author, &comment.AuthorID, &avatarKey, &comment.CreatedAt)
+	if err != nil {
+		return comment, err
+	}
+	comment.AvatarURL = AvatarURL(comment.AuthorID, avatarKey, AvatarSizeSmall)
+	return comment, nil
+}
+
 // func AddCommentHandler(w http.ResponseWriter, r *http.Request) {
 
 // 	content := strings.TrimSpace(r.FormValue("content"))
@@ -86,6 +108,9 @@ func AddCommentHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "You must be logged in to comment", http.StatusUnauthorized)
 		return
 	}
+	if !requireWritable(w, r, user) {
+		return
+	}
 
 	postID, err := strconv.Atoi(r.FormValue("post_id"))
 	if err != nil {
@@ -106,22 +131,154 @@ func AddCommentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = addComment(user.ID, postID, content)
+	submission, verdict, reasons, err := screenSubmission(user, "comment", "", content)
+	if err != nil {
+		log.Printf("Error screening comment: %v", err)
+		http.Error(w, "Error adding comment", http.StatusInternalServerError)
+		return
+	}
+	if verdict == VerdictReject {
+		http.Error(w, "Your comment was not published because it "+reasons[0].Reason+".", http.StatusUnprocessableEntity)
+		return
+	}
+
+	var commentID int
+	if verdict == VerdictHold {
+		// Held comments must still be allowed on the post
+		_, err = commentablePost(DB, user.ID, postID)
+		if err == nil {
+			err = holdContent(HeldItem{Kind: "comment", UserID: user.ID, PostID: postID, Content: content,
+				Reasons: reasons, IP: clientIP(r)})
+		}
+	} else {
+		commentID, err = addComment(user.ID, postID, content)
+	}
+	if err == ErrBlocked {
+		http.Error(w, "The author of this post has blocked you", http.StatusForbidden)
+		return
+	}
+	if err == ErrLocked {
+		http.Error(w, "This post is locked and does not accept new comments", http.StatusForbidden)
+		return
+	}
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	}
 	if err != nil {
 		log.Printf("Error adding comment: %v", err)
 		http.Error(w, "Error adding comment", http.StatusInternalServerError)
 		return
 	}
 
+	recordFingerprint(submission)
+	if verdict == VerdictHold {
+		http.Redirect(w, r, "/post/"+strconv.Itoa(postID)+"?held=1", http.StatusSeeOther)
+		return
+	}
+
+	if comment, err := getComment(commentID); err != nil {
+		log.Printf("Error fetching new comment: %v", err)
+	} else {
+		publishComment(comment)
+	}
+
 	http.Redirect(w, r, "/post/"+strconv.Itoa(postID), http.StatusSeeOther)
 }
 
-func addComment(userID, postID int, content string) error {
-	_, err := DB.Exec(`
+// commentablePost returns the author of a post userID may comment on. It
+// returns sql.ErrNoRows if the post is gone, ErrLocked if a moderator locked
+// it and ErrBlocked if the post author blocked userID.
+func commentablePost(q queryRower, userID, postID int) (int, error) {
+	var postAuthorID int
+	var locked bool
+	err := q.QueryRow("SELECT user_id, locked FROM posts WHERE id = ? AND deleted_at IS NULL", postID).Scan(&postAuthorID, &locked)
+	if err != nil {
+		return 0, err
+	}
+	if locked {
+		return 0, ErrLocked
+	}
+	blocked, err := hasBlocked(q, postAuthorID, userID)
+	if err != nil {
+		return 0, err
+	}
+	if blocked {
+		return 0, ErrBlocked
+	}
+	return postAuthorID, nil
+}
+
+// addComment stores a comment and notifies the post author. It fails with
+// the errors of commentablePost.
+func addComment(userID, postID int, content string) (int, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	postAuthorID, err := commentablePost(tx, userID, postID)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec(`
         INSERT INTO comments (user_id, post_id, content, created_at)
         VALUES (?, ?, ?, ?)
     `, userID, postID, content, time.Now())
-	return err
+	if err != nil {
+		return 0, err
+	}
+
+	commentID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := notify(tx, postAuthorID, userID, NotifyComment, postID, 0); err != nil {
+		return 0, err
+	}
+
+	mentioned, err := recordMentions(tx, userID, postID, int(commentID), content)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	go notifyMentions(userID, postID, int(commentID), mentioned)
+	return int(commentID), nil
+}
+
+// purgeComment removes a comment for good with its likes, mentions and
+// notifications, and resolves the reports on it
+func purgeComment(commentID int) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Open reports would otherwise stay in the queue pointing at nothing
+	_, err = tx.Exec("UPDATE reports SET resolved_at = ?, outcome = ? WHERE resolved_at IS NULL AND target_type = ? AND target_id = ?",
+		time.Now(), OutcomeDeleted, ReportComment, commentID)
+	if err != nil {
+		return err
+	}
+
+	for _, query := range []string{
+		"DELETE FROM likes WHERE comment_id = ?",
+		"DELETE FROM mentions WHERE comment_id = ?",
+		"DELETE FROM notifications WHERE comment_id = ?",
+		"DELETE FROM comments WHERE id = ?",
+	} {
+		if _, err := tx.Exec(query, commentID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 // //func getPostIDFromCommentID(commentID int) (int, error) {
@@ -0,0 +1,385 @@
+package RebootForums
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Verdicts a content filter can reach, from least to most severe
+const (
+	VerdictAllow = iota
+	VerdictHold
+	VerdictReject
+)
+
+// Spam filter setting keys and defaults
+const (
+	SettingSpamRejectWords     = "spam_reject_words"
+	SettingSpamHoldWords       = "spam_hold_words"
+	SettingSpamNewAccountDays  = "spam_new_account_days"
+	SettingSpamNewAccountLinks = "spam_new_account_links"
+
+	DefaultSpamNewAccountDays  = 3
+	DefaultSpamNewAccountLinks = 2
+)
+
+// Submission is a post or comment about to be published
+type Submission struct {
+	Kind           string // "post" or "comment"
+	UserID         int
+	AccountCreated time.Time
+	Title          string
+	Content        string
+}
+
+// Text returns everything the filters look at
+func (s Submission) Text() string {
+	if s.Title == "" {
+		return s.Content
+	}
+	return s.Title + "\n" + s.Content
+}
+
+// FilterResult is a filter's decision with a reason for moderators and,
+// on rejection, for the author
+type FilterResult struct {
+	Verdict int    `json:"verdict"`
+	Filter  string `json:"filter"`
+	Reason  string `json:"reason"`
+}
+
+// ContentFilter checks a submission before it is published
+type ContentFilter interface {
+	Name() string
+	Check(s Submission) (FilterResult, error)
+}
+
+var (
+	contentFiltersMu sync.RWMutex
+	contentFilters   = []ContentFilter{blocklistFilter{}, linkLimitFilter{}, duplicateFilter{}, bayesFilter{}}
+)
+
+// AddContentFilter appends a filter to the pipeline run on every new post
+// and comment
+func AddContentFilter(f ContentFilter) {
+	contentFiltersMu.Lock()
+	defer contentFiltersMu.Unlock()
+	contentFilters = append(contentFilters, f)
+}
+
+// filterContent runs the filters and returns the overall verdict with the
+// results that did not allow the submission. The first rejection stops the
+// run. A filter that fails is logged and skipped so a broken filter does not
+// stop people from posting.
+func filterContent(s Submission) (int, []FilterResult) {
+	contentFiltersMu.RLock()
+	filters := contentFilters
+	contentFiltersMu.RUnlock()
+
+	verdict := VerdictAllow
+	var results []FilterResult
+	for _, f := range filters {
+		result, err := f.Check(s)
+		if err != nil {
+			log.Printf("Error running content filter %s: %v", f.Name(), err)
+			continue
+		}
+		if result.Verdict == VerdictAllow {
+			continue
+		}
+		result.Filter = f.Name()
+		if result.Verdict == VerdictReject {
+			return VerdictReject, []FilterResult{result}
+		}
+		verdict = max(verdict, result.Verdict)
+		results = append(results, result)
+	}
+	return verdict, results
+}
+
+// blocklistFilter rejects or holds content matching the admin's word lists.
+// Each line is a word or phrase, or a regular expression between slashes.
+type blocklistFilter struct{}
+
+func (blocklistFilter) Name() string { return "blocklist" }
+
+func (blocklistFilter) Check(s Submission) (FilterResult, error) {
+	text := s.Text()
+	for _, list := range []struct {
+		key     string
+		verdict int
+	}{
+		{SettingSpamRejectWords, VerdictReject},
+		{SettingSpamHoldWords, VerdictHold},
+	} {
+		patterns, err := compileBlocklist(GetSetting(list.key, ""))
+		if err != nil {
+			return FilterResult{}, err
+		}
+		for _, p := range patterns {
+			if match := p.FindString(text); match != "" {
+				return FilterResult{Verdict: list.verdict, Reason: "contains blocked text " + strconv.Quote(match)}, nil
+			}
+		}
+	}
+	return FilterResult{}, nil
+}
+
+var (
+	blocklistCacheMu sync.Mutex
+	blocklistCache   = make(map[string][]*regexp.Regexp)
+)
+
+// compileBlocklist turns a word list into case-insensitive patterns. Plain
+// entries only match whole words, with any spacing between them. Compiled
+// lists are cached by their text.
+func compileBlocklist(list string) ([]*regexp.Regexp, error) {
+	blocklistCacheMu.Lock()
+	defer blocklistCacheMu.Unlock()
+	if patterns, ok := blocklistCache[list]; ok {
+		return patterns, nil
+	}
+	// Only the current lists are worth keeping once an admin edits them
+	if len(blocklistCache) > 4 {
+		clear(blocklistCache)
+	}
+
+	var patterns []*regexp.Regexp
+	for _, line := range strings.Split(list, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		words := strings.Fields(line)
+		for i, word := range words {
+			words[i] = regexp.QuoteMeta(word)
+		}
+		expr := `\b` + strings.Join(words, `\s+`) + `\b`
+		if len(line) > 2 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+			expr = line[1 : len(line)-1]
+		}
+		p, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return nil, fmt.Errorf("blocklist entry %q: %w", line, err)
+		}
+		patterns = append(patterns, p)
+	}
+	blocklistCache[list] = patterns
+	return patterns, nil
+}
+
+// linkPattern finds links whether or not Markdown formats them
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)`)
+
+// linkLimitFilter holds content from new accounts with more links than allowed
+type linkLimitFilter struct{}
+
+func (linkLimitFilter) Name() string { return "links" }
+
+func (linkLimitFilter) Check(s Submission) (FilterResult, error) {
+	days := GetIntSetting(SettingSpamNewAccountDays, DefaultSpamNewAccountDays)
+	if time.Since(s.AccountCreated) >= time.Duration(days)*24*time.Hour {
+		return FilterResult{}, nil
+	}
+	limit := GetIntSetting(SettingSpamNewAccountLinks, DefaultSpamNewAccountLinks)
+	if n := len(linkPattern.FindAllStringIndex(s.Text(), -1)); n > limit {
+		return FilterResult{Verdict: VerdictHold,
+			Reason: fmt.Sprintf("%d links from an account younger than %d days (limit %d)", n, days, limit)}, nil
+	}
+	return FilterResult{}, nil
+}
+
+// Duplicate detection looks back this far and ignores text shorter than
+// minDuplicateLength so short replies like "thanks!" are never caught
+const (
+	duplicateWindow     = 24 * time.Hour
+	minDuplicateLength  = 20
+	duplicateOtherUsers = 2
+)
+
+// contentFingerprint normalizes case, whitespace and punctuation before
+// hashing so trivial edits still count as the same text
+func contentFingerprint(text string) (string, bool) {
+	var b strings.Builder
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() < minDuplicateLength {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:]), true
+}
+
+// recordFingerprint remembers a published or held submission for duplicate
+// detection and forgets the ones that are too old to matter
+func recordFingerprint(s Submission) {
+	hash, ok := contentFingerprint(s.Content)
+	if !ok {
+		return
+	}
+	_, err := DB.Exec("DELETE FROM content_fingerprints WHERE created_at <= ?", time.Now().Add(-duplicateWindow))
+	if err == nil {
+		_, err = DB.Exec("INSERT INTO content_fingerprints (user_id, hash, created_at) VALUES (?, ?, ?)",
+			s.UserID, hash, time.Now())
+	}
+	if err != nil {
+		log.Printf("Error recording content fingerprint: %v", err)
+	}
+}
+
+// duplicateFilter rejects a user repeating themselves and holds text that
+// several other accounts posted recently
+type duplicateFilter struct{}
+
+func (duplicateFilter) Name() string { return "duplicate" }
+
+func (duplicateFilter) Check(s Submission) (FilterResult, error) {
+	hash, ok := contentFingerprint(s.Content)
+	if !ok {
+		return FilterResult{}, nil
+	}
+	var own, others int
+	err := DB.QueryRow(`
+		SELECT COALESCE(SUM(user_id = ?), 0), COUNT(DISTINCT CASE WHEN user_id != ? THEN user_id END)
+		FROM content_fingerprints WHERE hash = ? AND created_at > ?
+	`, s.UserID, s.UserID, hash, time.Now().Add(-duplicateWindow)).Scan(&own, &others)
+	if err != nil {
+		return FilterResult{}, err
+	}
+	if own > 0 {
+		return FilterResult{Verdict: VerdictReject, Reason: "repeats something you posted in the last day"}, nil
+	}
+	if others >= duplicateOtherUsers {
+		return FilterResult{Verdict: VerdictHold, Reason: fmt.Sprintf("same text as %d other accounts in the last day", others)}, nil
+	}
+	return FilterResult{}, nil
+}
+
+// The classifier stays quiet until moderators have decided on enough content
+// of both kinds, and only acts when it is very sure
+const (
+	bayesMinDocuments   = 10
+	bayesHoldAbove      = 0.9
+	bayesRejectAbove    = 0.999
+	bayesMaxTokenLength = 30
+)
+
+// bayesFilter is a naive Bayes classifier trained from moderator decisions
+type bayesFilter struct{}
+
+func (bayesFilter) Name() string { return "classifier" }
+
+func (bayesFilter) Check(s Submission) (FilterResult, error) {
+	p, err := spamProbability(s.Text())
+	if err != nil || p < bayesHoldAbove {
+		return FilterResult{}, err
+	}
+	verdict := VerdictHold
+	if p >= bayesRejectAbove {
+		verdict = VerdictReject
+	}
+	return FilterResult{Verdict: verdict, Reason: fmt.Sprintf("looks like spam (%.1f%%)", p*100)}, nil
+}
+
+// spamTokens splits text into the distinct lower case words the classifier uses
+func spamTokens(text string) []string {
+	seen := make(map[string]bool)
+	var tokens []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '$' && r != '\''
+	}) {
+		if len(word) < 2 || len(word) > bayesMaxTokenLength || seen[word] {
+			continue
+		}
+		seen[word] = true
+		tokens = append(tokens, word)
+	}
+	return tokens
+}
+
+// spamProbability estimates how likely text is spam. It returns 0 until the
+// classifier has enough training.
+func spamProbability(text string) (float64, error) {
+	var spamDocs, hamDocs int
+	err := DB.QueryRow(`
+		SELECT COALESCE(SUM(CASE WHEN label = 'spam' THEN documents END), 0),
+		       COALESCE(SUM(CASE WHEN label = 'ham' THEN documents END), 0)
+		FROM spam_training
+	`).Scan(&spamDocs, &hamDocs)
+	if err != nil || spamDocs < bayesMinDocuments || hamDocs < bayesMinDocuments {
+		return 0, err
+	}
+
+	tokens := spamTokens(text)
+	if len(tokens) == 0 {
+		return 0, nil
+	}
+	args := make([]interface{}, len(tokens))
+	for i, t := range tokens {
+		args[i] = t
+	}
+	rows, err := DB.Query("SELECT spam, ham FROM spam_tokens WHERE token IN (?"+strings.Repeat(", ?", len(tokens)-1)+")", args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	// Log odds with add-one smoothing; unseen words carry no evidence
+	logOdds := math.Log(float64(spamDocs)) - math.Log(float64(hamDocs))
+	for rows.Next() {
+		var spam, ham int
+		if err := rows.Scan(&spam, &ham); err != nil {
+			return 0, err
+		}
+		logOdds += math.Log(float64(spam+1)/float64(spamDocs+2)) - math.Log(float64(ham+1)/float64(hamDocs+2))
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return 1 / (1 + math.Exp(-logOdds)), nil
+}
+
+// trainSpamFilter teaches the classifier that text was spam or not, as a
+// moderator decided
+func trainSpamFilter(text string, spam bool) error {
+	label, column := "ham", "ham"
+	if spam {
+		label, column = "spam", "spam"
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO spam_training (label, documents) VALUES (?, 1)
+		ON CONFLICT(label) DO UPDATE SET documents = documents + 1
+	`, label)
+	if err != nil {
+		return err
+	}
+	// The column name is one of the two above, never user input
+	for _, token := range spamTokens(text) {
+		_, err = tx.Exec(`
+			INSERT INTO spam_tokens (token, `+column+`) VALUES (?, 1)
+			ON CONFLICT(token) DO UPDATE SET `+column+` = `+column+` + 1
+		`, token)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -35,7 +35,20 @@ func CreateTables() error {
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			username TEXT UNIQUE NOT NULL,
 			email TEXT UNIQUE NOT NULL,
-			password TEXT NOT NULL
+			password TEXT NOT NULL,
+			role TEXT NOT NULL DEFAULT 'user',
+			totp_secret TEXT,
+			totp_enabled BOOLEAN NOT NULL DEFAULT 0,
+			totp_last_step INTEGER NOT NULL DEFAULT 0,
+			has_password BOOLEAN NOT NULL DEFAULT 1,
+			username_key TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			bio TEXT NOT NULL DEFAULT '',
+			location TEXT NOT NULL DEFAULT '',
+			website TEXT NOT NULL DEFAULT '',
+			deleted_at DATETIME,
+			avatar_key TEXT,
+			email_verified BOOLEAN NOT NULL DEFAULT 0
 		)`,
 		`CREATE TABLE IF NOT EXISTS posts (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -44,6 +57,11 @@ func CreateTables() error {
 			content TEXT NOT NULL,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			deleted_at DATETIME,
+			deleted_by INTEGER,
+			pinned BOOLEAN NOT NULL DEFAULT 0,
+			locked BOOLEAN NOT NULL DEFAULT 0,
+			announcement BOOLEAN NOT NULL DEFAULT 0,
 			FOREIGN KEY (user_id) REFERENCES users(id)
 		)`,
 		`CREATE TABLE IF NOT EXISTS comments (
@@ -53,6 +71,8 @@ func CreateTables() error {
 			content TEXT NOT NULL,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			deleted_at DATETIME,
+			deleted_by INTEGER,
 			FOREIGN KEY (post_id) REFERENCES posts(id),
 			FOREIGN KEY (user_id) REFERENCES users(id)
 		)`,
@@ -63,6 +83,7 @@ func CreateTables() error {
 		`CREATE TABLE IF NOT EXISTS post_categories (
 			post_id INTEGER,
 			category_id INTEGER,
+			pinned BOOLEAN NOT NULL DEFAULT 0,
 			PRIMARY KEY (post_id, category_id),
 			FOREIGN KEY (post_id) REFERENCES posts(id),
 			FOREIGN KEY (category_id) REFERENCES categories(id)
@@ -87,6 +108,286 @@ func CreateTables() error {
 			is_guest BOOLEAN NOT NULL DEFAULT 0,
 			last_activity DATETIME NOT NULL,
 			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			reauthenticated_at DATETIME,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS site_settings (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS recovery_codes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			code_hash TEXT NOT NULL,
+			used_at DATETIME,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS pending_logins (
+			token TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			expiry DATETIME NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS oauth_states (
+			state TEXT PRIMARY KEY,
+			provider TEXT NOT NULL,
+			verifier TEXT NOT NULL,
+			link_user_id INTEGER,
+			reauth BOOLEAN NOT NULL DEFAULT 0,
+			expiry DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_identities (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			provider TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			email TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(provider, subject),
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS login_attempts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			user_agent TEXT,
+			reason TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_login_attempts_created_at ON login_attempts(created_at)`,
+		`CREATE TABLE IF NOT EXISTS email_verifications (
+			token TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			email TEXT NOT NULL,
+			expiry DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS data_exports (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			status TEXT NOT NULL,
+			file_path TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			completed_at DATETIME,
+			expires_at DATETIME,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS username_history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			username TEXT NOT NULL,
+			changed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS attachments (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			post_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL,
+			blob_key TEXT NOT NULL,
+			thumb_key TEXT,
+			filename TEXT NOT NULL,
+			content_type TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			width INTEGER NOT NULL DEFAULT 0,
+			height INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (post_id) REFERENCES posts(id),
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_attachments_post_id ON attachments(post_id)`,
+		`CREATE TABLE IF NOT EXISTS mentions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			author_id INTEGER NOT NULL,
+			post_id INTEGER NOT NULL,
+			comment_id INTEGER,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id),
+			FOREIGN KEY (author_id) REFERENCES users(id),
+			FOREIGN KEY (post_id) REFERENCES posts(id),
+			FOREIGN KEY (comment_id) REFERENCES comments(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_mentions_user_id ON mentions(user_id)`,
+		`CREATE TABLE IF NOT EXISTS notifications (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			actor_id INTEGER NOT NULL,
+			type TEXT NOT NULL,
+			post_id INTEGER NOT NULL,
+			comment_id INTEGER,
+			read_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id),
+			FOREIGN KEY (actor_id) REFERENCES users(id),
+			FOREIGN KEY (post_id) REFERENCES posts(id),
+			FOREIGN KEY (comment_id) REFERENCES comments(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_notifications_user_id ON notifications(user_id, read_at)`,
+		`CREATE TABLE IF NOT EXISTS chat_messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			category_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL,
+			content TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (category_id) REFERENCES categories(id),
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_chat_messages_category_id ON chat_messages(category_id, id)`,
+		`CREATE TABLE IF NOT EXISTS user_blocks (
+			blocker_id INTEGER NOT NULL,
+			blocked_id INTEGER NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (blocker_id, blocked_id),
+			FOREIGN KEY (blocker_id) REFERENCES users(id),
+			FOREIGN KEY (blocked_id) REFERENCES users(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_mutes (
+			muter_id INTEGER NOT NULL,
+			muted_id INTEGER NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (muter_id, muted_id),
+			FOREIGN KEY (muter_id) REFERENCES users(id),
+			FOREIGN KEY (muted_id) REFERENCES users(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS conversations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS conversation_members (
+			conversation_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL,
+			last_read_message_id INTEGER NOT NULL DEFAULT 0,
+			joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (conversation_id, user_id),
+			FOREIGN KEY (conversation_id) REFERENCES conversations(id),
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_conversation_members_user_id ON conversation_members(user_id)`,
+		`CREATE TABLE IF NOT EXISTS messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			conversation_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL,
+			content TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (conversation_id) REFERENCES conversations(id),
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_conversation_id ON messages(conversation_id, id)`,
+		`CREATE TABLE IF NOT EXISTS message_reports (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			message_id INTEGER NOT NULL,
+			reporter_id INTEGER NOT NULL,
+			reason TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			resolved_at DATETIME,
+			resolved_by INTEGER,
+			outcome TEXT,
+			FOREIGN KEY (message_id) REFERENCES messages(id),
+			FOREIGN KEY (reporter_id) REFERENCES users(id),
+			FOREIGN KEY (resolved_by) REFERENCES users(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS reports (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			target_type TEXT NOT NULL,
+			target_id INTEGER NOT NULL,
+			reporter_id INTEGER NOT NULL,
+			reason TEXT NOT NULL,
+			details TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			resolved_at DATETIME,
+			resolved_by INTEGER,
+			outcome TEXT,
+			FOREIGN KEY (reporter_id) REFERENCES users(id),
+			FOREIGN KEY (resolved_by) REFERENCES users(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_reports_target ON reports(target_type, target_id)`,
+		`CREATE TABLE IF NOT EXISTS user_sanctions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			moderator_id INTEGER NOT NULL,
+			kind TEXT NOT NULL,
+			reason TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			expires_at DATETIME,
+			lifted_at DATETIME,
+			lifted_by INTEGER,
+			FOREIGN KEY (user_id) REFERENCES users(id),
+			FOREIGN KEY (moderator_id) REFERENCES users(id),
+			FOREIGN KEY (lifted_by) REFERENCES users(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_user_sanctions_user_id ON user_sanctions(user_id)`,
+		`CREATE TABLE IF NOT EXISTS ip_bans (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ip_range TEXT NOT NULL,
+			moderator_id INTEGER NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			expires_at DATETIME,
+			lifted_at DATETIME,
+			lifted_by INTEGER,
+			FOREIGN KEY (moderator_id) REFERENCES users(id),
+			FOREIGN KEY (lifted_by) REFERENCES users(id)
+		)`,
+		// The audit log keeps names rather than foreign keys so entries outlive
+		// deleted accounts, and the triggers keep it append-only
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			actor_id INTEGER NOT NULL,
+			actor_name TEXT NOT NULL,
+			action TEXT NOT NULL,
+			target_type TEXT NOT NULL,
+			target_id INTEGER,
+			target_label TEXT NOT NULL DEFAULT '',
+			before TEXT NOT NULL DEFAULT '',
+			after TEXT NOT NULL DEFAULT '',
+			ip TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at)`,
+		`CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+		BEGIN SELECT RAISE(ABORT, 'the audit log is append-only'); END`,
+		`CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+		BEGIN SELECT RAISE(ABORT, 'the audit log is append-only'); END`,
+		// Posts and comments the spam filter held for a moderator. They are
+		// only written to posts or comments once approved.
+		`CREATE TABLE IF NOT EXISTS held_content (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			kind TEXT NOT NULL,
+			user_id INTEGER NOT NULL,
+			post_id INTEGER,
+			title TEXT NOT NULL DEFAULT '',
+			content TEXT NOT NULL,
+			categories TEXT NOT NULL DEFAULT '[]',
+			attachments TEXT NOT NULL DEFAULT '[]',
+			reasons TEXT NOT NULL,
+			ip TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id),
+			FOREIGN KEY (post_id) REFERENCES posts(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS content_fingerprints (
+			user_id INTEGER NOT NULL,
+			hash TEXT NOT NULL,
+			created_at DATETIME NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_content_fingerprints_hash ON content_fingerprints(hash)`,
+		`CREATE INDEX IF NOT EXISTS idx_content_fingerprints_created_at ON content_fingerprints(created_at)`,
+		`CREATE TABLE IF NOT EXISTS spam_training (
+			label TEXT PRIMARY KEY,
+			documents INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE TABLE IF NOT EXISTS spam_tokens (
+			token TEXT PRIMARY KEY,
+			spam INTEGER NOT NULL DEFAULT 0,
+			ham INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE TABLE IF NOT EXISTS notification_preferences (
+			user_id INTEGER NOT NULL,
+			type TEXT NOT NULL,
+			enabled BOOLEAN NOT NULL,
+			PRIMARY KEY (user_id, type),
 			FOREIGN KEY (user_id) REFERENCES users(id)
 		)`,
 	}
@@ -178,6 +479,8 @@ func GetLikeCounts(targetID int, isPost bool) (likes int, dislikes int, err erro
 	return
 }
 
+// UpsertLike adds, changes or takes back a vote. It returns sql.ErrNoRows if
+// the post or comment does not exist or is in the trash.
 func UpsertLike(userID, targetID int, isLike bool, isPost bool) error {
 	tx, err := DB.Begin()
 	if err != nil {
@@ -185,6 +488,21 @@ func UpsertLike(userID, targetID int, isLike bool, isPost bool) error {
 	}
 	defer tx.Rollback()
 
+	var ownerID, postID, commentID int
+	if isPost {
+		postID = targetID
+		err = tx.QueryRow("SELECT user_id FROM posts WHERE id = ? AND deleted_at IS NULL", targetID).Scan(&ownerID)
+	} else {
+		commentID = targetID
+		err = tx.QueryRow(`
+			SELECT c.user_id, c.post_id FROM comments c JOIN posts p ON p.id = c.post_id
+			WHERE c.id = ? AND c.deleted_at IS NULL AND p.deleted_at IS NULL
+		`, targetID).Scan(&ownerID, &postID)
+	}
+	if err != nil {
+		return err
+	}
+
 	var existingLike sql.NullBool
 	var selectQuery, insertQuery, updateQuery, deleteQuery string
 
@@ -223,6 +541,20 @@ func UpsertLike(userID, targetID int, isLike bool, isPost bool) error {
 		return err
 	}
 
+	// Only likes notify the author; taking one back withdraws the notification
+	liked := isLike && !(existingLike.Valid && existingLike.Bool == isLike)
+	wasLiked := existingLike.Valid && existingLike.Bool
+	if liked || wasLiked {
+		if liked {
+			err = notify(tx, ownerID, userID, NotifyLike, postID, commentID)
+		} else {
+			err = unnotify(tx, userID, NotifyLike, postID, commentID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
 	return tx.Commit()
 }
 
@@ -241,36 +573,47 @@ func AddCreatedAtToLikesTable() error {
 	return nil
 }
 
-func GetPostsByCategory(categoryID int) ([]Post, error) {
+// GetPostsByCategory returns the posts in a category, leaving out authors the
+// viewer muted. Posts pinned globally or in this category come first.
+func GetPostsByCategory(categoryID, viewerID int) ([]Post, error) {
 	query := `
-        SELECT DISTINCT p.id, p.title, p.content, u.username, p.created_at
+        SELECT DISTINCT p.id, p.title, p.content, u.username, u.id, COALESCE(u.avatar_key, ''), p.created_at,
+            p.pinned OR pc.pinned, p.locked
         FROM posts p
         JOIN users u ON p.user_id = u.id
         JOIN post_categories pc ON p.id = pc.post_id
-        WHERE pc.category_id = ?
-        ORDER BY p.created_at DESC
+        WHERE pc.category_id = ? AND p.deleted_at IS NULL
+          AND p.user_id NOT IN (SELECT muted_id FROM user_mutes WHERE muter_id = ?)
+        ORDER BY p.pinned OR pc.pinned DESC, p.created_at DESC
     `
-	return fetchPosts(query, categoryID)
+	return fetchPosts(query, categoryID, viewerID)
 }
 
 func GetPostsByUser(userID int) ([]Post, error) {
+	// A negative LIMIT means no limit in SQLite
+	return GetPostsByUserPage(userID, -1, 0)
+}
+
+// GetPostsByUserPage returns one page of the user's posts, newest first
+func GetPostsByUserPage(userID, limit, offset int) ([]Post, error) {
 	query := `
-        SELECT p.id, p.title, p.content, u.username, p.created_at
+        SELECT p.id, p.title, p.content, u.username, u.id, COALESCE(u.avatar_key, ''), p.created_at, p.pinned, p.locked
         FROM posts p
         JOIN users u ON p.user_id = u.id
-        WHERE p.user_id = ?
+        WHERE p.user_id = ? AND p.deleted_at IS NULL
         ORDER BY p.created_at DESC
+        LIMIT ? OFFSET ?
     `
-	return fetchPosts(query, userID)
+	return fetchPosts(query, userID, limit, offset)
 }
 
 func GetLikedPostsByUser(userID int) ([]Post, error) {
 	query := `
-        SELECT p.id, p.title, p.content, u.username, p.created_at
+        SELECT p.id, p.title, p.content, u.username, u.id, COALESCE(u.avatar_key, ''), p.created_at, p.pinned, p.locked
         FROM posts p
         JOIN users u ON p.user_id = u.id
         JOIN likes l ON p.id = l.post_id
-        WHERE l.user_id = ? AND l.is_like = 1
+        WHERE l.user_id = ? AND l.is_like = 1 AND p.deleted_at IS NULL
         ORDER BY p.created_at DESC
     `
 	return fetchPosts(query, userID)
@@ -286,10 +629,12 @@ func fetchPosts(query string, args ...interface{}) ([]Post, error) {
 	var posts []Post
 	for rows.Next() {
 		var p Post
-		err := rows.Scan(&p.ID, &p.Title, &p.Content, &p.Author, &p.CreatedAt)
+		var avatarKey string
+		err := rows.Scan(&p.ID, &p.Title, &p.Content, &p.Author, &p.AuthorID, &avatarKey, &p.CreatedAt, &p.Pinned, &p.Locked)
 		if err != nil {
 			return nil, err
 		}
+		p.AvatarURL = AvatarURL(p.AuthorID, avatarKey, AvatarSizeSmall)
 		posts = append(posts, p)
 	}
 	return posts, nil
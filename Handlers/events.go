@@ -0,0 +1,203 @@
+package RebootForums
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sseHeartbeat is how often an idle event stream gets a comment line, so
+// proxies do not close it and dead connections are noticed
+const sseHeartbeat = 25 * time.Second
+
+// subscriberBuffer is how many events a slow client may fall behind before
+// further events for it are dropped
+const subscriberBuffer = 16
+
+// Event is a message pushed to browsers. Data is JSON so an event can be
+// handed to an external broker unchanged.
+type Event struct {
+	Type string
+	Data []byte
+}
+
+// Broker delivers events published on a topic to everyone subscribed to it.
+// The default broker works inside one process; running several servers needs
+// one backed by an external message bus.
+type Broker interface {
+	// Publish sends event to the current subscribers of topic without blocking
+	Publish(topic string, event Event)
+	// Subscribe returns a channel of events on topic and a function that
+	// ends the subscription and closes the channel
+	Subscribe(topic string) (<-chan Event, func())
+}
+
+var (
+	broker   Broker = NewMemoryBroker()
+	brokerMu sync.RWMutex
+)
+
+// SetBroker replaces the broker used for real-time updates
+func SetBroker(b Broker) {
+	brokerMu.Lock()
+	broker = b
+	brokerMu.Unlock()
+}
+
+func getBroker() Broker {
+	brokerMu.RLock()
+	defer brokerMu.RUnlock()
+	return broker
+}
+
+// MemoryBroker is an in-process Broker
+type MemoryBroker struct {
+	mu     sync.Mutex
+	topics map[string]map[chan Event]struct{}
+}
+
+// NewMemoryBroker returns a broker with no subscribers
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{topics: make(map[string]map[chan Event]struct{})}
+}
+
+func (b *MemoryBroker) Publish(topic string, event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.topics[topic] {
+		select {
+		case ch <- event:
+		default:
+			// The client is not keeping up; it catches up on the next page load
+		}
+	}
+}
+
+func (b *MemoryBroker) Subscribe(topic string) (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+	b.mu.Lock()
+	if b.topics[topic] == nil {
+		b.topics[topic] = make(map[chan Event]struct{})
+	}
+	b.topics[topic][ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.topics[topic], ch)
+			if len(b.topics[topic]) == 0 {
+				delete(b.topics, topic)
+			}
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+	return ch, cancel
+}
+
+func postTopic(postID int) string {
+	return "post:" + strconv.Itoa(postID)
+}
+
+// publishPostEvent tells everyone viewing postID about a change
+func publishPostEvent(postID int, eventType string, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error encoding %s event: %v", eventType, err)
+		return
+	}
+	getBroker().Publish(postTopic(postID), Event{Type: eventType, Data: data})
+}
+
+// CommentEvent is pushed when a comment is added to a post
+type CommentEvent struct {
+	ID        int    `json:"id"`
+	Author    string `json:"author"`
+	AvatarURL string `json:"avatar_url"`
+	HTML      string `json:"html"`
+	CreatedAt string `json:"created_at"`
+}
+
+// VoteEvent is pushed when the likes or dislikes of a post or comment change
+type VoteEvent struct {
+	Target   string `json:"target"`
+	ID       int    `json:"id"`
+	Likes    int    `json:"likes"`
+	Dislikes int    `json:"dislikes"`
+}
+
+func publishComment(c Comment) {
+	publishPostEvent(c.PostID, "comment", CommentEvent{
+		ID:        c.ID,
+		Author:    c.Author,
+		AvatarURL: c.AvatarURL,
+		HTML:      string(c.HTML()),
+		CreatedAt: c.CreatedAt.Format("January 2, 2006 at 3:04 PM"),
+	})
+}
+
+func publishVotes(postID int, target string, id, likes, dislikes int) {
+	publishPostEvent(postID, "votes", VoteEvent{Target: target, ID: id, Likes: likes, Dislikes: dislikes})
+}
+
+// EventsHandler streams updates to a post as Server-Sent Events
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+	postID, err := strconv.Atoi(r.URL.Query().Get("post"))
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+	var exists bool
+	if err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM posts WHERE id = ? AND deleted_at IS NULL)", postID).Scan(&exists); err != nil {
+		log.Printf("Error checking post for events: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	if !exists {
+		Error404Handler(w, r)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	events, cancel := getBroker().Subscribe(postTopic(postID))
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	// Ask the browser to wait a few seconds before reconnecting
+	fmt.Fprint(w, "retry: 5000\n\n")
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, event.Data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
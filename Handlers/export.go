@@ -0,0 +1,932 @@
+package RebootForums
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+// Export statuses stored in data_exports.status
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// Exports with more rows than this are built by the background worker
+// instead of being streamed straight to the browser
+const exportInlineLimit = 500
+
+// ExportDir is where finished export archives are written
+var ExportDir = "data/exports"
+
+// exportTTL is how long a finished export can be downloaded
+const exportTTL = 7 * 24 * time.Hour
+
+// UserExport is everything the forum stores about one user
+type UserExport struct {
+	GeneratedAt             time.Time                      `json:"generated_at"`
+	Profile                 ExportProfile                  `json:"profile"`
+	UsernameHistory         []UsernameChange               `json:"username_history"`
+	LinkedAccounts          []ExportIdentity               `json:"linked_accounts"`
+	Posts                   []ExportPost                   `json:"posts"`
+	Comments                []ExportComment                `json:"comments"`
+	HeldContent             []ExportHeldItem               `json:"held_for_review"`
+	Attachments             []ExportAttachment             `json:"attachments"`
+	Votes                   []ExportVote                   `json:"votes"`
+	Conversations           []ExportConversation           `json:"conversations"`
+	ChatMessages            []ExportChatMessage            `json:"chat_messages"`
+	Mentions                []ExportMention                `json:"mentions"`
+	Notifications           []ExportNotification           `json:"notifications"`
+	NotificationPreferences []ExportNotificationPreference `json:"notification_preferences"`
+	Blocks                  []ExportRelation               `json:"blocked_users"`
+	Mutes                   []ExportRelation               `json:"muted_users"`
+	Reports                 []ExportReport                 `json:"reports"`
+	MessageReports          []ExportMessageReport          `json:"message_reports"`
+	Sanctions               []ExportSanction               `json:"sanctions"`
+	Sessions                []ExportSession                `json:"sessions"`
+	Revisions               []ExportRevision               `json:"revisions"`
+	LoginAttempts           []ExportLoginAttempt           `json:"failed_logins"`
+	PendingEmail            string                         `json:"pending_email,omitempty"`
+}
+
+type ExportProfile struct {
+	ID                 int    `json:"id"`
+	Username           string `json:"username"`
+	Email              string `json:"email"`
+	Role               string `json:"role"`
+	TwoFactorEnabled   bool   `json:"two_factor_enabled"`
+	HasPassword        bool   `json:"has_password"`
+	RecoveryCodesTotal int    `json:"recovery_codes_total"`
+	Bio                string `json:"bio"`
+	Location           string `json:"location"`
+	Website            string `json:"website"`
+	// Avatar is the path of the uploaded picture inside the archive
+	Avatar    string `json:"avatar,omitempty"`
+	avatarKey string
+}
+
+type ExportIdentity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ExportPost struct {
+	ID         int       `json:"id"`
+	Title      string    `json:"title"`
+	Content    string    `json:"content"`
+	Categories []string  `json:"categories"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type ExportComment struct {
+	ID        int       `json:"id"`
+	PostID    int       `json:"post_id"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ExportAttachment is a file uploaded with one of the user's posts. File is
+// its path inside the archive, empty if the stored copy could not be read.
+type ExportAttachment struct {
+	ID          int       `json:"id"`
+	PostID      int       `json:"post_id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+	File        string    `json:"file,omitempty"`
+	blobKey     string
+}
+
+// ExportHeldItem is a post or comment the content filters held for a moderator
+// who has not decided on it yet. The filters' reasons are left out so an
+// export cannot be used to find out what trips them.
+type ExportHeldItem struct {
+	ID          int              `json:"id"`
+	Kind        string           `json:"kind"`
+	PostID      *int             `json:"post_id,omitempty"`
+	Title       string           `json:"title,omitempty"`
+	Content     string           `json:"content"`
+	Categories  []string         `json:"categories,omitempty"`
+	Attachments []ExportHeldFile `json:"attachments,omitempty"`
+	IP          string           `json:"ip"`
+	CreatedAt   time.Time        `json:"created_at"`
+}
+
+// ExportHeldFile is a file uploaded with a held post. File is its path inside
+// the archive, empty if the stored copy could not be read.
+type ExportHeldFile struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	File        string `json:"file,omitempty"`
+	blobKey     string
+}
+
+type ExportVote struct {
+	PostID    *int      `json:"post_id,omitempty"`
+	CommentID *int      `json:"comment_id,omitempty"`
+	IsLike    bool      `json:"is_like"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ExportConversation is a private conversation with every message in it,
+// including the other members' replies
+type ExportConversation struct {
+	ID       int             `json:"id"`
+	Members  []string        `json:"members"`
+	Messages []ExportMessage `json:"messages"`
+}
+
+type ExportMessage struct {
+	From      string    `json:"from"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ExportChatMessage struct {
+	Category  string    `json:"category"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ExportMention is a post or comment that mentioned the user
+type ExportMention struct {
+	By        string    `json:"by"`
+	PostID    int       `json:"post_id"`
+	CommentID *int      `json:"comment_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ExportNotification struct {
+	Type      string     `json:"type"`
+	From      string     `json:"from"`
+	PostID    int        `json:"post_id"`
+	CommentID *int       `json:"comment_id,omitempty"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type ExportNotificationPreference struct {
+	Type    string `json:"type"`
+	Enabled bool   `json:"enabled"`
+}
+
+// ExportRelation is a user the exporting user blocked or muted
+type ExportRelation struct {
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ExportReport is a post, comment or user the exporting user reported
+type ExportReport struct {
+	TargetType string     `json:"target_type"`
+	TargetID   int        `json:"target_id"`
+	Reason     string     `json:"reason"`
+	Details    string     `json:"details,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	Outcome    string     `json:"outcome,omitempty"`
+}
+
+// ExportMessageReport is a private message the exporting user reported
+type ExportMessageReport struct {
+	MessageID  int        `json:"message_id"`
+	Reason     string     `json:"reason"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	Outcome    string     `json:"outcome,omitempty"`
+}
+
+// ExportSanction is a warning, suspension or ban the user was given. Like the
+// emails about it, it leaves out which moderator gave it.
+type ExportSanction struct {
+	Kind      string     `json:"kind"`
+	Reason    string     `json:"reason"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	LiftedAt  *time.Time `json:"lifted_at,omitempty"`
+}
+
+// ExportSession leaves out the token itself, which is a live credential
+type ExportSession struct {
+	CreatedAt    time.Time `json:"created_at"`
+	LastActivity time.Time `json:"last_activity"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+// ExportRevision is an earlier version of one of the user's posts or comments.
+// The forum does not keep edit history yet, so this list is always empty.
+type ExportRevision struct {
+	PostID    *int      `json:"post_id,omitempty"`
+	CommentID *int      `json:"comment_id,omitempty"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ExportLoginAttempt struct {
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// countExportRows estimates the size of a user's export
+func countExportRows(userID int) (int, error) {
+	var count int
+	err := DB.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM posts WHERE user_id = ?)
+			+ (SELECT COUNT(*) FROM comments WHERE user_id = ?)
+			+ (SELECT COUNT(*) FROM likes WHERE user_id = ?)
+			+ (SELECT COUNT(*) FROM attachments WHERE user_id = ?)
+			+ (SELECT COUNT(*) FROM messages WHERE conversation_id IN (SELECT conversation_id FROM conversation_members WHERE user_id = ?))
+			+ (SELECT COUNT(*) FROM chat_messages WHERE user_id = ?)
+			+ (SELECT COUNT(*) FROM notifications WHERE user_id = ?)
+	`, userID, userID, userID, userID, userID, userID, userID).Scan(&count)
+	return count, err
+}
+
+// collectUserExport gathers every row that belongs to the user
+func collectUserExport(userID int) (*UserExport, error) {
+	export := &UserExport{GeneratedAt: time.Now()}
+
+	p := &export.Profile
+	var createdAt sql.NullTime
+	err := DB.QueryRow(`
+		SELECT id, username, email, role, totp_enabled, has_password,
+			(SELECT COUNT(*) FROM recovery_codes WHERE user_id = users.id),
+			bio, location, website, COALESCE(avatar_key, ''), created_at
+		FROM users WHERE id = ?
+	`, userID).Scan(&p.ID, &p.Username, &p.Email, &p.Role, &p.TwoFactorEnabled, &p.HasPassword, &p.RecoveryCodesTotal,
+		&p.Bio, &p.Location, &p.Website, &p.avatarKey, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if export.UsernameHistory, err = GetUsernameHistory(userID); err != nil {
+		return nil, err
+	}
+	if export.PendingEmail, err = GetPendingEmailChange(userID); err != nil {
+		return nil, err
+	}
+
+	err = queryExportRows(`SELECT provider, subject, COALESCE(email, ''), created_at FROM user_identities WHERE user_id = ? ORDER BY created_at`,
+		userID, func(scan func(...interface{}) error) error {
+			var i ExportIdentity
+			if err := scan(&i.Provider, &i.Subject, &i.Email, &i.CreatedAt); err != nil {
+				return err
+			}
+			export.LinkedAccounts = append(export.LinkedAccounts, i)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryExportRows(`
+		SELECT p.id, p.title, p.content, p.created_at, p.updated_at,
+			COALESCE((SELECT GROUP_CONCAT(c.name, '|') FROM post_categories pc JOIN categories c ON c.id = pc.category_id WHERE pc.post_id = p.id), '')
+		FROM posts p WHERE p.user_id = ? ORDER BY p.created_at`,
+		userID, func(scan func(...interface{}) error) error {
+			var post ExportPost
+			var updatedAt sql.NullTime
+			var categories string
+			if err := scan(&post.ID, &post.Title, &post.Content, &post.CreatedAt, &updatedAt, &categories); err != nil {
+				return err
+			}
+			post.UpdatedAt = post.CreatedAt
+			if updatedAt.Valid {
+				post.UpdatedAt = updatedAt.Time
+			}
+			if categories != "" {
+				post.Categories = strings.Split(categories, "|")
+			}
+			export.Posts = append(export.Posts, post)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryExportRows(`SELECT id, post_id, content, created_at FROM comments WHERE user_id = ? ORDER BY created_at`,
+		userID, func(scan func(...interface{}) error) error {
+			var c ExportComment
+			if err := scan(&c.ID, &c.PostID, &c.Content, &c.CreatedAt); err != nil {
+				return err
+			}
+			export.Comments = append(export.Comments, c)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	if export.HeldContent, err = collectHeldExport(userID); err != nil {
+		return nil, err
+	}
+
+	err = queryExportRows(`SELECT id, post_id, blob_key, filename, content_type, size, created_at FROM attachments WHERE user_id = ? ORDER BY id`,
+		userID, func(scan func(...interface{}) error) error {
+			var a ExportAttachment
+			if err := scan(&a.ID, &a.PostID, &a.blobKey, &a.Filename, &a.ContentType, &a.Size, &a.CreatedAt); err != nil {
+				return err
+			}
+			export.Attachments = append(export.Attachments, a)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryExportRows(`SELECT post_id, comment_id, is_like, created_at FROM likes WHERE user_id = ? ORDER BY created_at`,
+		userID, func(scan func(...interface{}) error) error {
+			var v ExportVote
+			if err := scan(&v.PostID, &v.CommentID, &v.IsLike, &v.CreatedAt); err != nil {
+				return err
+			}
+			export.Votes = append(export.Votes, v)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryExportRows(`
+		SELECT c.id, (SELECT GROUP_CONCAT(u.username, '|') FROM conversation_members cm JOIN users u ON u.id = cm.user_id WHERE cm.conversation_id = c.id)
+		FROM conversations c
+		WHERE c.id IN (SELECT conversation_id FROM conversation_members WHERE user_id = ?)
+		ORDER BY c.created_at`,
+		userID, func(scan func(...interface{}) error) error {
+			var c ExportConversation
+			var members string
+			if err := scan(&c.ID, &members); err != nil {
+				return err
+			}
+			c.Members = strings.Split(members, "|")
+			export.Conversations = append(export.Conversations, c)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	for i := range export.Conversations {
+		c := &export.Conversations[i]
+		err = queryExportRows(`SELECT u.username, m.content, m.created_at FROM messages m JOIN users u ON u.id = m.user_id WHERE m.conversation_id = ? ORDER BY m.id`,
+			c.ID, func(scan func(...interface{}) error) error {
+				var m ExportMessage
+				if err := scan(&m.From, &m.Content, &m.CreatedAt); err != nil {
+					return err
+				}
+				c.Messages = append(c.Messages, m)
+				return nil
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = queryExportRows(`SELECT c.name, m.content, m.created_at FROM chat_messages m JOIN categories c ON c.id = m.category_id WHERE m.user_id = ? ORDER BY m.id`,
+		userID, func(scan func(...interface{}) error) error {
+			var m ExportChatMessage
+			if err := scan(&m.Category, &m.Content, &m.CreatedAt); err != nil {
+				return err
+			}
+			export.ChatMessages = append(export.ChatMessages, m)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryExportRows(`SELECT u.username, m.post_id, m.comment_id, m.created_at FROM mentions m JOIN users u ON u.id = m.author_id WHERE m.user_id = ? ORDER BY m.id`,
+		userID, func(scan func(...interface{}) error) error {
+			var m ExportMention
+			if err := scan(&m.By, &m.PostID, &m.CommentID, &m.CreatedAt); err != nil {
+				return err
+			}
+			export.Mentions = append(export.Mentions, m)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryExportRows(`SELECT n.type, u.username, n.post_id, n.comment_id, n.read_at, n.created_at FROM notifications n JOIN users u ON u.id = n.actor_id WHERE n.user_id = ? ORDER BY n.id`,
+		userID, func(scan func(...interface{}) error) error {
+			var n ExportNotification
+			var readAt sql.NullTime
+			if err := scan(&n.Type, &n.From, &n.PostID, &n.CommentID, &readAt, &n.CreatedAt); err != nil {
+				return err
+			}
+			if readAt.Valid {
+				n.ReadAt = &readAt.Time
+			}
+			export.Notifications = append(export.Notifications, n)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryExportRows(`SELECT type, enabled FROM notification_preferences WHERE user_id = ? ORDER BY type`,
+		userID, func(scan func(...interface{}) error) error {
+			var pref ExportNotificationPreference
+			if err := scan(&pref.Type, &pref.Enabled); err != nil {
+				return err
+			}
+			export.NotificationPreferences = append(export.NotificationPreferences, pref)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryExportRows(`SELECT u.username, b.created_at FROM user_blocks b JOIN users u ON u.id = b.blocked_id WHERE b.blocker_id = ? ORDER BY b.created_at`,
+		userID, func(scan func(...interface{}) error) error {
+			var rel ExportRelation
+			if err := scan(&rel.Username, &rel.CreatedAt); err != nil {
+				return err
+			}
+			export.Blocks = append(export.Blocks, rel)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryExportRows(`SELECT u.username, m.created_at FROM user_mutes m JOIN users u ON u.id = m.muted_id WHERE m.muter_id = ? ORDER BY m.created_at`,
+		userID, func(scan func(...interface{}) error) error {
+			var rel ExportRelation
+			if err := scan(&rel.Username, &rel.CreatedAt); err != nil {
+				return err
+			}
+			export.Mutes = append(export.Mutes, rel)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryExportRows(`SELECT target_type, target_id, reason, details, created_at, resolved_at, COALESCE(outcome, '') FROM reports WHERE reporter_id = ? ORDER BY created_at`,
+		userID, func(scan func(...interface{}) error) error {
+			var rep ExportReport
+			var resolvedAt sql.NullTime
+			if err := scan(&rep.TargetType, &rep.TargetID, &rep.Reason, &rep.Details, &rep.CreatedAt, &resolvedAt, &rep.Outcome); err != nil {
+				return err
+			}
+			if resolvedAt.Valid {
+				rep.ResolvedAt = &resolvedAt.Time
+			}
+			export.Reports = append(export.Reports, rep)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryExportRows(`SELECT message_id, reason, created_at, resolved_at, COALESCE(outcome, '') FROM message_reports WHERE reporter_id = ? ORDER BY created_at`,
+		userID, func(scan func(...interface{}) error) error {
+			var rep ExportMessageReport
+			var resolvedAt sql.NullTime
+			if err := scan(&rep.MessageID, &rep.Reason, &rep.CreatedAt, &resolvedAt, &rep.Outcome); err != nil {
+				return err
+			}
+			if resolvedAt.Valid {
+				rep.ResolvedAt = &resolvedAt.Time
+			}
+			export.MessageReports = append(export.MessageReports, rep)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryExportRows(`SELECT kind, reason, created_at, expires_at, lifted_at FROM user_sanctions WHERE user_id = ? ORDER BY created_at`,
+		userID, func(scan func(...interface{}) error) error {
+			var s ExportSanction
+			var expiresAt, liftedAt sql.NullTime
+			if err := scan(&s.Kind, &s.Reason, &s.CreatedAt, &expiresAt, &liftedAt); err != nil {
+				return err
+			}
+			if expiresAt.Valid {
+				s.ExpiresAt = &expiresAt.Time
+			}
+			if liftedAt.Valid {
+				s.LiftedAt = &liftedAt.Time
+			}
+			export.Sanctions = append(export.Sanctions, s)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryExportRows(`SELECT created_at, last_activity, expiry FROM sessions WHERE user_id = ? ORDER BY created_at`,
+		userID, func(scan func(...interface{}) error) error {
+			var s ExportSession
+			if err := scan(&s.CreatedAt, &s.LastActivity, &s.Expiry); err != nil {
+				return err
+			}
+			export.Sessions = append(export.Sessions, s)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	// Failed logins are stored under the name that was typed, which may have
+	// belonged to someone else before or after this user held it
+	for _, held := range usernamePeriods(p.Username, createdAt.Time, export.UsernameHistory) {
+		err = queryExportRows(`SELECT ip, COALESCE(user_agent, ''), reason, created_at FROM login_attempts WHERE username = ? ORDER BY created_at`,
+			held.Username, func(scan func(...interface{}) error) error {
+				var a ExportLoginAttempt
+				if err := scan(&a.IP, &a.UserAgent, &a.Reason, &a.CreatedAt); err != nil {
+					return err
+				}
+				if held.contains(a.CreatedAt) {
+					export.LoginAttempts = append(export.LoginAttempts, a)
+				}
+				return nil
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return export, nil
+}
+
+// collectHeldExport lists the user's posts and comments waiting for review
+func collectHeldExport(userID int) ([]ExportHeldItem, error) {
+	categories, err := GetAllCategories()
+	if err != nil {
+		return nil, err
+	}
+	categoryNames := make(map[int]string, len(categories))
+	for _, c := range categories {
+		categoryNames[c.ID] = c.Name
+	}
+
+	rows, err := DB.Query(heldColumns+" WHERE h.user_id = ? ORDER BY h.created_at", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []ExportHeldItem
+	for rows.Next() {
+		h, err := scanHeldItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		item := ExportHeldItem{ID: h.ID, Kind: h.Kind, Title: h.Title, Content: h.Content, IP: h.IP, CreatedAt: h.CreatedAt}
+		if h.PostID != 0 {
+			item.PostID = &h.PostID
+		}
+		for _, id := range h.Categories {
+			item.Categories = append(item.Categories, categoryNames[id])
+		}
+		for _, a := range h.Attachments {
+			item.Attachments = append(item.Attachments, ExportHeldFile{Filename: a.Filename, ContentType: a.ContentType, Size: a.Size, blobKey: a.BlobKey})
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// usernamePeriod is a stretch of time during which a user went by Username.
+// Until is zero for the name they have now.
+type usernamePeriod struct {
+	Username string
+	From     time.Time
+	Until    time.Time
+}
+
+func (p usernamePeriod) contains(t time.Time) bool {
+	return !t.Before(p.From) && (p.Until.IsZero() || t.Before(p.Until))
+}
+
+// usernamePeriods lists the names a user has held, oldest first. history is
+// newest first and records each old name with the time it was given up.
+func usernamePeriods(current string, createdAt time.Time, history []UsernameChange) []usernamePeriod {
+	periods := make([]usernamePeriod, 0, len(history)+1)
+	from := createdAt
+	for i := len(history) - 1; i >= 0; i-- {
+		periods = append(periods, usernamePeriod{Username: history[i].Username, From: from, Until: history[i].ChangedAt})
+		from = history[i].ChangedAt
+	}
+	return append(periods, usernamePeriod{Username: current, From: from})
+}
+
+// queryExportRows runs query with arg and calls fn once per row
+func queryExportRows(query string, arg interface{}, fn func(scan func(...interface{}) error) error) error {
+	rows, err := DB.Query(query, arg)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows.Scan); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// writeExportZip writes the export as a ZIP archive with one JSON file per
+// section, a combined data.json, a readable index.html and the uploaded files
+func writeExportZip(w io.Writer, export *UserExport) error {
+	zw := zip.NewWriter(w)
+
+	// Files go first so the JSON only points at copies that made it in
+	if export.Profile.avatarKey != "" {
+		name := "files/avatar.png"
+		ok, err := copyBlobToZip(zw, avatarBlobKey(export.Profile.avatarKey, AvatarSizeLarge), name, export.GeneratedAt)
+		if err != nil {
+			return err
+		}
+		if ok {
+			export.Profile.Avatar = name
+		}
+	}
+	for i := range export.Attachments {
+		a := &export.Attachments[i]
+		name := fmt.Sprintf("files/attachments/%d-%s", a.ID, path.Base("/"+a.Filename))
+		ok, err := copyBlobToZip(zw, a.blobKey, name, export.GeneratedAt)
+		if err != nil {
+			return err
+		}
+		if ok {
+			a.File = name
+		}
+	}
+
+	for i := range export.HeldContent {
+		h := &export.HeldContent[i]
+		for j := range h.Attachments {
+			a := &h.Attachments[j]
+			name := fmt.Sprintf("files/held/%d-%d-%s", h.ID, j+1, path.Base("/"+a.Filename))
+			ok, err := copyBlobToZip(zw, a.blobKey, name, export.GeneratedAt)
+			if err != nil {
+				return err
+			}
+			if ok {
+				a.File = name
+			}
+		}
+	}
+
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"data.json", export},
+		{"json/profile.json", export.Profile},
+		{"json/username_history.json", export.UsernameHistory},
+		{"json/linked_accounts.json", export.LinkedAccounts},
+		{"json/posts.json", export.Posts},
+		{"json/comments.json", export.Comments},
+		{"json/held_for_review.json", export.HeldContent},
+		{"json/attachments.json", export.Attachments},
+		{"json/votes.json", export.Votes},
+		{"json/conversations.json", export.Conversations},
+		{"json/chat_messages.json", export.ChatMessages},
+		{"json/mentions.json", export.Mentions},
+		{"json/notifications.json", export.Notifications},
+		{"json/notification_preferences.json", export.NotificationPreferences},
+		{"json/blocked_users.json", export.Blocks},
+		{"json/muted_users.json", export.Mutes},
+		{"json/reports.json", export.Reports},
+		{"json/message_reports.json", export.MessageReports},
+		{"json/sanctions.json", export.Sanctions},
+		{"json/sessions.json", export.Sessions},
+		{"json/revisions.json", export.Revisions},
+		{"json/failed_logins.json", export.LoginAttempts},
+	}
+	for _, f := range files {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: export.GeneratedAt})
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(fw)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(f.data); err != nil {
+			return err
+		}
+	}
+
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: "index.html", Method: zip.Deflate, Modified: export.GeneratedAt})
+	if err != nil {
+		return err
+	}
+	if err := exportHTMLTemplate.Execute(fw, export); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// copyBlobToZip adds a stored file to the archive under name. A blob that is
+// missing or cannot be opened is logged and skipped, so one lost upload does
+// not fail the whole export.
+func copyBlobToZip(zw *zip.Writer, key, name string, modified time.Time) (bool, error) {
+	blob, err := getBlobStore().Get(key)
+	if err != nil {
+		if err != ErrBlobNotFound {
+			log.Printf("Error opening %s for data export: %v", key, err)
+		}
+		return false, nil
+	}
+	defer blob.Close()
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(fw, blob); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// The HTML copy is self-contained so it can be opened straight from the archive
+var exportHTMLTemplate = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<title>Reboot Forums data export for {{.Profile.Username}}</title>
+<style>
+body { font-family: sans-serif; max-width: 960px; margin: 2em auto; color: #2d3748; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 2em; }
+th, td { border: 1px solid #e2e8f0; padding: 6px 8px; text-align: left; vertical-align: top; }
+th { background: #edf2f7; }
+pre { white-space: pre-wrap; margin: 0; font-family: inherit; }
+</style>
+</head>
+<body>
+<h1>Data export for {{.Profile.Username}}</h1>
+<p>Generated {{.GeneratedAt.Format "January 2, 2006 at 3:04 PM MST"}}. The same data is included as JSON in this archive.</p>
+
+<h2>Profile</h2>
+<table>
+<tr><th>User ID</th><td>{{.Profile.ID}}</td></tr>
+<tr><th>Username</th><td>{{.Profile.Username}}</td></tr>
+<tr><th>Email</th><td>{{.Profile.Email}}{{with .PendingEmail}} (change to {{.}} awaiting confirmation){{end}}</td></tr>
+<tr><th>Role</th><td>{{.Profile.Role}}</td></tr>
+<tr><th>Bio</th><td><pre>{{.Profile.Bio}}</pre></td></tr>
+<tr><th>Location</th><td>{{.Profile.Location}}</td></tr>
+<tr><th>Website</th><td>{{.Profile.Website}}</td></tr>
+<tr><th>Avatar</th><td>{{with .Profile.Avatar}}<a href="{{.}}">{{.}}</a>{{else}}None{{end}}</td></tr>
+<tr><th>Password set</th><td>{{.Profile.HasPassword}}</td></tr>
+<tr><th>Two-factor authentication</th><td>{{.Profile.TwoFactorEnabled}}{{if .Profile.RecoveryCodesTotal}} ({{.Profile.RecoveryCodesTotal}} recovery codes){{end}}</td></tr>
+</table>
+
+<h2>Previous usernames</h2>
+<table>
+<tr><th>Username</th><th>Changed</th></tr>
+{{range .UsernameHistory}}<tr><td>{{.Username}}</td><td>{{.ChangedAt.Format "2006-01-02 15:04"}}</td></tr>
+{{else}}<tr><td colspan="2">None</td></tr>
+{{end}}</table>
+
+<h2>Linked accounts</h2>
+<table>
+<tr><th>Provider</th><th>Account ID</th><th>Email</th><th>Linked</th></tr>
+{{range .LinkedAccounts}}<tr><td>{{.Provider}}</td><td>{{.Subject}}</td><td>{{.Email}}</td><td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td></tr>
+{{else}}<tr><td colspan="4">None</td></tr>
+{{end}}</table>
+
+<h2>Posts ({{len .Posts}})</h2>
+<table>
+<tr><th>ID</th><th>Title</th><th>Content</th><th>Categories</th><th>Created</th></tr>
+{{range .Posts}}<tr><td>{{.ID}}</td><td>{{.Title}}</td><td><pre>{{.Content}}</pre></td><td>{{range $i, $c := .Categories}}{{if $i}}, {{end}}{{$c}}{{end}}</td><td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td></tr>
+{{else}}<tr><td colspan="5">None</td></tr>
+{{end}}</table>
+
+<h2>Comments ({{len .Comments}})</h2>
+<table>
+<tr><th>ID</th><th>Post</th><th>Content</th><th>Created</th></tr>
+{{range .Comments}}<tr><td>{{.ID}}</td><td>{{.PostID}}</td><td><pre>{{.Content}}</pre></td><td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td></tr>
+{{else}}<tr><td colspan="4">None</td></tr>
+{{end}}</table>
+
+<h2>Waiting for review ({{len .HeldContent}})</h2>
+<table>
+<tr><th>Type</th><th>Content</th><th>Files</th><th>IP</th><th>Submitted</th></tr>
+{{range .HeldContent}}<tr><td>{{if eq .Kind "comment"}}Comment on post {{.PostID}}{{else}}Post{{with .Categories}} in {{range $i, $c := .}}{{if $i}}, {{end}}{{$c}}{{end}}{{end}}{{end}}</td><td>{{with .Title}}<strong>{{.}}</strong>{{end}}<pre>{{.Content}}</pre></td><td>{{range .Attachments}}{{if .File}}<a href="{{.File}}">{{.Filename}}</a>{{else}}{{.Filename}} (file missing){{end}}<br>{{end}}</td><td>{{.IP}}</td><td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td></tr>
+{{else}}<tr><td colspan="5">None</td></tr>
+{{end}}</table>
+
+<h2>Attachments ({{len .Attachments}})</h2>
+<table>
+<tr><th>Post</th><th>File</th><th>Type</th><th>Size</th><th>Uploaded</th></tr>
+{{range .Attachments}}<tr><td>{{.PostID}}</td><td>{{if .File}}<a href="{{.File}}">{{.Filename}}</a>{{else}}{{.Filename}} (file missing){{end}}</td><td>{{.ContentType}}</td><td>{{.Size}} bytes</td><td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td></tr>
+{{else}}<tr><td colspan="5">None</td></tr>
+{{end}}</table>
+
+<h2>Votes ({{len .Votes}})</h2>
+<table>
+<tr><th>On</th><th>Vote</th><th>Created</th></tr>
+{{range .Votes}}<tr><td>{{if .PostID}}Post {{.PostID}}{{else}}Comment {{.CommentID}}{{end}}</td><td>{{if .IsLike}}Like{{else}}Dislike{{end}}</td><td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td></tr>
+{{else}}<tr><td colspan="3">None</td></tr>
+{{end}}</table>
+
+<h2>Private messages ({{len .Conversations}} conversations)</h2>
+{{range .Conversations}}<h3>With {{range $i, $m := .Members}}{{if $i}}, {{end}}{{$m}}{{end}}</h3>
+<table>
+<tr><th>From</th><th>Message</th><th>Sent</th></tr>
+{{range .Messages}}<tr><td>{{.From}}</td><td><pre>{{.Content}}</pre></td><td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td></tr>
+{{else}}<tr><td colspan="3">None</td></tr>
+{{end}}</table>
+{{else}}<p>None</p>
+{{end}}
+<h2>Chat messages ({{len .ChatMessages}})</h2>
+<table>
+<tr><th>Category</th><th>Message</th><th>Sent</th></tr>
+{{range .ChatMessages}}<tr><td>{{.Category}}</td><td><pre>{{.Content}}</pre></td><td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td></tr>
+{{else}}<tr><td colspan="3">None</td></tr>
+{{end}}</table>
+
+<h2>Mentions of you ({{len .Mentions}})</h2>
+<table>
+<tr><th>By</th><th>In</th><th>Created</th></tr>
+{{range .Mentions}}<tr><td>{{.By}}</td><td>{{if .CommentID}}Comment {{.CommentID}}{{else}}Post {{.PostID}}{{end}}</td><td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td></tr>
+{{else}}<tr><td colspan="3">None</td></tr>
+{{end}}</table>
+
+<h2>Notifications ({{len .Notifications}})</h2>
+<table>
+<tr><th>Type</th><th>From</th><th>On</th><th>Read</th><th>Created</th></tr>
+{{range .Notifications}}<tr><td>{{.Type}}</td><td>{{.From}}</td><td>{{if .CommentID}}Comment {{.CommentID}}{{else}}Post {{.PostID}}{{end}}</td><td>{{with .ReadAt}}{{.Format "2006-01-02 15:04"}}{{else}}No{{end}}</td><td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td></tr>
+{{else}}<tr><td colspan="5">None</td></tr>
+{{end}}</table>
+
+<h2>Notification settings</h2>
+<table>
+<tr><th>Type</th><th>Enabled</th></tr>
+{{range .NotificationPreferences}}<tr><td>{{.Type}}</td><td>{{.Enabled}}</td></tr>
+{{else}}<tr><td colspan="2">Defaults</td></tr>
+{{end}}</table>
+
+<h2>Blocked users</h2>
+<table>
+<tr><th>Username</th><th>Since</th></tr>
+{{range .Blocks}}<tr><td>{{.Username}}</td><td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td></tr>
+{{else}}<tr><td colspan="2">None</td></tr>
+{{end}}</table>
+
+<h2>Muted users</h2>
+<table>
+<tr><th>Username</th><th>Since</th></tr>
+{{range .Mutes}}<tr><td>{{.Username}}</td><td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td></tr>
+{{else}}<tr><td colspan="2">None</td></tr>
+{{end}}</table>
+
+<h2>Reports you filed</h2>
+<table>
+<tr><th>On</th><th>Reason</th><th>Details</th><th>Filed</th><th>Outcome</th></tr>
+{{range .Reports}}<tr><td>{{.TargetType}} {{.TargetID}}</td><td>{{.Reason}}</td><td><pre>{{.Details}}</pre></td><td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td><td>{{with .ResolvedAt}}{{.Format "2006-01-02 15:04"}}{{else}}Open{{end}}{{with .Outcome}}: {{.}}{{end}}</td></tr>
+{{end}}{{range .MessageReports}}<tr><td>message {{.MessageID}}</td><td>{{.Reason}}</td><td></td><td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td><td>{{with .ResolvedAt}}{{.Format "2006-01-02 15:04"}}{{else}}Open{{end}}{{with .Outcome}}: {{.}}{{end}}</td></tr>
+{{end}}{{if not (or .Reports .MessageReports)}}<tr><td colspan="5">None</td></tr>
+{{end}}</table>
+
+<h2>Warnings, suspensions and bans</h2>
+<table>
+<tr><th>Type</th><th>Reason</th><th>Given</th><th>Ends</th><th>Lifted</th></tr>
+{{range .Sanctions}}<tr><td>{{.Kind}}</td><td><pre>{{.Reason}}</pre></td><td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td><td>{{with .ExpiresAt}}{{.Format "2006-01-02 15:04"}}{{else}}{{if eq .Kind "ban"}}Never{{end}}{{end}}</td><td>{{with .LiftedAt}}{{.Format "2006-01-02 15:04"}}{{else}}No{{end}}</td></tr>
+{{else}}<tr><td colspan="5">None</td></tr>
+{{end}}</table>
+
+<h2>Sessions</h2>
+<table>
+<tr><th>Started</th><th>Last activity</th><th>Expires</th></tr>
+{{range .Sessions}}<tr><td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td><td>{{.LastActivity.Format "2006-01-02 15:04"}}</td><td>{{.Expiry.Format "2006-01-02 15:04"}}</td></tr>
+{{else}}<tr><td colspan="3">None</td></tr>
+{{end}}</table>
+
+<h2>Revisions</h2>
+<table>
+<tr><th>On</th><th>Content</th><th>Saved</th></tr>
+{{range .Revisions}}<tr><td>{{if .PostID}}Post {{.PostID}}{{else}}Comment {{.CommentID}}{{end}}</td><td><pre>{{.Content}}</pre></td><td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td></tr>
+{{else}}<tr><td colspan="3">None</td></tr>
+{{end}}</table>
+
+<h2>Failed logins to your account</h2>
+<table>
+<tr><th>IP</th><th>Browser</th><th>Reason</th><th>Time</th></tr>
+{{range .LoginAttempts}}<tr><td>{{.IP}}</td><td>{{.UserAgent}}</td><td>{{.Reason}}</td><td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td></tr>
+{{else}}<tr><td colspan="4">None</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,326 @@
+package RebootForums
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// DataExport is one row of the data_exports job table
+type DataExport struct {
+	ID          int
+	UserID      int
+	Status      string
+	FilePath    string
+	CreatedAt   time.Time
+	CompletedAt sql.NullTime
+	ExpiresAt   sql.NullTime
+}
+
+// IsDownloadable reports whether the archive is finished and not yet expired
+func (e *DataExport) IsDownloadable() bool {
+	return e != nil && e.Status == ExportReady && e.ExpiresAt.Valid && time.Now().Before(e.ExpiresAt.Time)
+}
+
+// exportWake nudges the worker when a job is queued so it does not wait for the next poll
+var exportWake = make(chan struct{}, 1)
+
+// StartExportWorker runs queued data exports in the background and removes
+// expired archives. Jobs left running by a previous process are retried.
+func StartExportWorker() {
+	_, err := DB.Exec("UPDATE data_exports SET status = ? WHERE status = ?", ExportPending, ExportRunning)
+	if err != nil {
+		log.Printf("Error requeueing data exports: %v", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			for runNextExport() {
+			}
+			cleanupExpiredExports()
+			select {
+			case <-exportWake:
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// ExportHandler builds a ZIP of everything stored about the logged in user.
+// Small exports are streamed right away; large ones are queued for the worker.
+func ExportHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	latest, err := getLatestExport(user.ID)
+	if err != nil {
+		log.Printf("Error fetching data export: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	if latest != nil && (latest.Status == ExportPending || latest.Status == ExportRunning) {
+		http.Redirect(w, r, "/settings?export=queued", http.StatusSeeOther)
+		return
+	}
+
+	rowCount, err := countExportRows(user.ID)
+	if err != nil {
+		log.Printf("Error sizing data export: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	if rowCount <= exportInlineLimit {
+		export, err := collectUserExport(user.ID)
+		if err != nil {
+			log.Printf("Error collecting data export: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, exportFileName(time.Now())))
+		if err := writeExportZip(w, export); err != nil {
+			// Headers are already sent, so all we can do is log it
+			log.Printf("Error writing data export: %v", err)
+		}
+		return
+	}
+
+	_, err = DB.Exec("INSERT INTO data_exports (user_id, status, created_at) VALUES (?, ?, ?)", user.ID, ExportPending, time.Now())
+	if err != nil {
+		log.Printf("Error queueing data export: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	select {
+	case exportWake <- struct{}{}:
+	default:
+	}
+	http.Redirect(w, r, "/settings?export=queued", http.StatusSeeOther)
+}
+
+// ExportDownloadHandler serves a finished export archive to its owner
+func ExportDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		Error404Handler(w, r)
+		return
+	}
+	export, err := getExport(id)
+	if err != nil {
+		log.Printf("Error fetching data export: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	if export == nil || export.UserID != user.ID || !export.IsDownloadable() {
+		Error404Handler(w, r)
+		return
+	}
+
+	f, err := os.Open(export.FilePath)
+	if err != nil {
+		log.Printf("Error opening data export: %v", err)
+		Error404Handler(w, r)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, exportFileName(export.CompletedAt.Time)))
+	http.ServeContent(w, r, "", export.CompletedAt.Time, f)
+}
+
+// runNextExport claims one pending job and builds it. It reports whether a job was found.
+func runNextExport() bool {
+	var id, userID int
+	err := DB.QueryRow(`
+		UPDATE data_exports SET status = ?
+		WHERE id = (SELECT id FROM data_exports WHERE status = ? ORDER BY created_at LIMIT 1)
+		RETURNING id, user_id
+	`, ExportRunning, ExportPending).Scan(&id, &userID)
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		log.Printf("Error claiming data export: %v", err)
+		return false
+	}
+
+	path, err := buildExportFile(id, userID)
+	if err != nil {
+		log.Printf("Error building data export %d: %v", id, err)
+		_, err = DB.Exec("UPDATE data_exports SET status = ?, completed_at = ? WHERE id = ?", ExportFailed, time.Now(), id)
+		if err != nil {
+			log.Printf("Error marking data export failed: %v", err)
+		}
+		return true
+	}
+
+	now := time.Now()
+	_, err = DB.Exec("UPDATE data_exports SET status = ?, file_path = ?, completed_at = ?, expires_at = ? WHERE id = ?",
+		ExportReady, path, now, now.Add(exportTTL), id)
+	if err != nil {
+		log.Printf("Error marking data export ready: %v", err)
+		os.Remove(path)
+		return true
+	}
+	notifyExportReady(userID, id)
+	return true
+}
+
+// buildExportFile writes the archive to a temporary file and renames it into
+// place, so a crash never leaves a half-written export behind
+func buildExportFile(id, userID int) (string, error) {
+	export, err := collectUserExport(userID)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(ExportDir, 0o700); err != nil {
+		return "", err
+	}
+
+	token, err := generateSessionToken()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(ExportDir, fmt.Sprintf("%d-%s.zip", id, token))
+	tmp, err := os.CreateTemp(ExportDir, "export-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	buf := bufio.NewWriter(tmp)
+	if err := writeExportZip(buf, export); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := buf.Flush(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp.Name(), path)
+}
+
+func notifyExportReady(userID, exportID int) {
+	user, err := GetUserByID(userID)
+	if err != nil {
+		log.Printf("Error fetching user for export email: %v", err)
+		return
+	}
+	body := "Hi " + user.Username + ",\n\n" +
+		"The copy of your Reboot Forums data that you asked for is ready. Download it here:\n\n" +
+		siteURL() + "/settings/export/" + strconv.Itoa(exportID) + "/download\n\n" +
+		"You need to be logged in to download it. The file is deleted after " + strconv.Itoa(int(exportTTL.Hours()/24)) + " days.\n"
+	if err := sendMail(user.Email, "Your data export is ready", body); err != nil {
+		log.Printf("Error sending export email: %v", err)
+	}
+}
+
+// cleanupExpiredExports deletes archives past their download window
+func cleanupExpiredExports() {
+	rows, err := DB.Query("SELECT id, file_path FROM data_exports WHERE status = ? AND expires_at < ?", ExportReady, time.Now())
+	if err != nil {
+		log.Printf("Error listing expired data exports: %v", err)
+		return
+	}
+	type expired struct {
+		id   int
+		path string
+	}
+	var exports []expired
+	for rows.Next() {
+		var e expired
+		if err := rows.Scan(&e.id, &e.path); err != nil {
+			log.Printf("Error reading expired data export: %v", err)
+			continue
+		}
+		exports = append(exports, e)
+	}
+	rows.Close()
+
+	for _, e := range exports {
+		if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing data export %d: %v", e.id, err)
+			continue
+		}
+		if _, err := DB.Exec("DELETE FROM data_exports WHERE id = ?", e.id); err != nil {
+			log.Printf("Error deleting data export %d: %v", e.id, err)
+		}
+	}
+}
+
+// removeUserExports deletes every archive belonging to the user, used when the account is deleted
+func removeUserExports(userID int) error {
+	rows, err := DB.Query("SELECT file_path FROM data_exports WHERE user_id = ? AND file_path IS NOT NULL", userID)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return err
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func getLatestExport(userID int) (*DataExport, error) {
+	return scanExport(DB.QueryRow(`
+		SELECT id, user_id, status, COALESCE(file_path, ''), created_at, completed_at, expires_at
+		FROM data_exports WHERE user_id = ? ORDER BY id DESC LIMIT 1
+	`, userID))
+}
+
+func getExport(id int) (*DataExport, error) {
+	return scanExport(DB.QueryRow(`
+		SELECT id, user_id, status, COALESCE(file_path, ''), created_at, completed_at, expires_at
+		FROM data_exports WHERE id = ?
+	`, id))
+}
+
+func scanExport(row *sql.Row) (*DataExport, error) {
+	var e DataExport
+	err := row.Scan(&e.ID, &e.UserID, &e.Status, &e.FilePath, &e.CreatedAt, &e.CompletedAt, &e.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func exportFileName(t time.Time) string {
+	return "reboot-forums-export-" + t.Format("2006-01-02") + ".zip"
+}
@@ -0,0 +1,90 @@
+package RebootForums
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/util"
+)
+
+// codeBlockRenderer highlights fenced code blocks on the server. Tokens are
+// wrapped in spans with short chroma class names (styled in NewStyle.css) and
+// every line gets a number that is left out when the code is copied.
+type codeBlockRenderer struct{}
+
+func (r codeBlockRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindFencedCodeBlock, r.renderFencedCodeBlock)
+}
+
+func (r codeBlockRenderer) renderFencedCodeBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*ast.FencedCodeBlock)
+
+	var code bytes.Buffer
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		segment := lines.At(i)
+		code.Write(segment.Value(source))
+	}
+
+	language := strings.ToLower(string(n.Language(source)))
+	lexer := lexers.Get(language)
+	label := ""
+	if lexer != nil {
+		label = lexer.Config().Name
+	} else {
+		lexer = lexers.Fallback
+		language = ""
+	}
+
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, code.String())
+	if err != nil {
+		return ast.WalkStop, err
+	}
+	formatter := chromahtml.New(
+		chromahtml.WithClasses(true),
+		chromahtml.WithLineNumbers(true),
+		chromahtml.TabWidth(4),
+		chromahtml.WithPreWrapper(codePreWrapper{language: language, label: label}),
+	)
+	if err := formatter.Format(w, styles.Fallback, iterator); err != nil {
+		return ast.WalkStop, err
+	}
+	w.WriteString("\n")
+	return ast.WalkSkipChildren, nil
+}
+
+// codePreWrapper writes the <pre><code> around highlighted lines, with the
+// language as a class like plain Markdown output and as a label for the page
+type codePreWrapper struct {
+	language string
+	label    string
+}
+
+func (p codePreWrapper) Start(code bool, styleAttr string) string {
+	var b strings.Builder
+	b.WriteString(`<pre class="chroma"`)
+	if p.label != "" {
+		fmt.Fprintf(&b, ` data-lang="%s"`, html.EscapeString(p.label))
+	}
+	b.WriteString("><code")
+	if p.language != "" {
+		fmt.Fprintf(&b, ` class="language-%s"`, html.EscapeString(p.language))
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+func (p codePreWrapper) End(code bool) string {
+	return "</code></pre>"
+}
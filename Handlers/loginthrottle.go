@@ -0,0 +1,226 @@
+package RebootForums
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// AttemptState is the failure history kept for one throttle key
+type AttemptState struct {
+	Failures    int
+	LastFailure time.Time
+}
+
+// AttemptStore keeps login failure counters. The default store lives in
+// memory; a shared backend (Redis, the database, ...) can be plugged in with
+// SetAttemptStore when running more than one server.
+type AttemptStore interface {
+	// Reserve counts an attempt for key as a failure unless policy blocks it.
+	// The check and the count must happen atomically, so that parallel
+	// attempts cannot all pass before the first is counted. If the key is
+	// blocked it returns when the block ends and false, and counts nothing.
+	Reserve(key string, policy ThrottlePolicy, now time.Time) (time.Time, bool)
+	// Release takes back one reserved attempt that turned out not to fail
+	Release(key string)
+	// State returns the current state for key
+	State(key string) AttemptState
+	// Reset forgets all failures for key
+	Reset(key string)
+}
+
+// ThrottlePolicy controls how quickly failures for one kind of key are slowed down
+type ThrottlePolicy struct {
+	FreeAttempts     int           // failures allowed before any delay
+	BaseDelay        time.Duration // delay after the first throttled failure, doubled each time
+	MaxDelay         time.Duration // cap for the exponential delay
+	LockoutThreshold int           // failures that trigger a lockout
+	LockoutDuration  time.Duration
+	ResetAfter       time.Duration // quiet period after which failures are forgotten
+}
+
+// Throttle policies for usernames and client IPs. IPs get more headroom
+// because several users can share one address.
+var (
+	usernameThrottlePolicy = ThrottlePolicy{
+		FreeAttempts:     3,
+		BaseDelay:        2 * time.Second,
+		MaxDelay:         5 * time.Minute,
+		LockoutThreshold: 10,
+		LockoutDuration:  30 * time.Minute,
+		ResetAfter:       24 * time.Hour,
+	}
+	ipThrottlePolicy = ThrottlePolicy{
+		FreeAttempts:     10,
+		BaseDelay:        time.Second,
+		MaxDelay:         5 * time.Minute,
+		LockoutThreshold: 50,
+		LockoutDuration:  time.Hour,
+		ResetAfter:       24 * time.Hour,
+	}
+)
+
+var (
+	attemptStore   AttemptStore = newMemoryAttemptStore()
+	attemptStoreMu sync.RWMutex
+)
+
+// SetAttemptStore replaces the backend used to track login failures
+func SetAttemptStore(store AttemptStore) {
+	attemptStoreMu.Lock()
+	attemptStore = store
+	attemptStoreMu.Unlock()
+}
+
+func getAttemptStore() AttemptStore {
+	attemptStoreMu.RLock()
+	defer attemptStoreMu.RUnlock()
+	return attemptStore
+}
+
+func usernameThrottleKey(username string) string {
+	return "user:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// blockedUntil returns when the next attempt is allowed under policy
+func (p ThrottlePolicy) blockedUntil(state AttemptState) time.Time {
+	if state.Failures <= p.FreeAttempts {
+		return time.Time{}
+	}
+	if state.Failures >= p.LockoutThreshold {
+		return state.LastFailure.Add(p.LockoutDuration)
+	}
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < state.Failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return state.LastFailure.Add(delay)
+}
+
+// reserveLoginAttempt counts an attempt to log in as username from ip as a
+// failure before the password or code is checked, and returns zero. If
+// either is throttled it counts nothing and returns how long to wait.
+func reserveLoginAttempt(username, ip string, now time.Time) time.Duration {
+	store := getAttemptStore()
+	userKey := usernameThrottleKey(username)
+	until, ok := store.Reserve(userKey, usernameThrottlePolicy, now)
+	if !ok {
+		return until.Sub(now)
+	}
+	until, ok = store.Reserve(ipThrottleKey(ip), ipThrottlePolicy, now)
+	if !ok {
+		store.Release(userKey)
+		return until.Sub(now)
+	}
+	return 0
+}
+
+// releaseLoginAttempt takes back a reserved attempt that did not fail, such
+// as a correct password that still owes a second factor
+func releaseLoginAttempt(username, ip string) {
+	store := getAttemptStore()
+	store.Release(usernameThrottleKey(username))
+	store.Release(ipThrottleKey(ip))
+}
+
+// isLoginLockout reports whether the current block is a lockout rather than a short backoff
+func isLoginLockout(username, ip string) bool {
+	store := getAttemptStore()
+	return store.State(usernameThrottleKey(username)).Failures >= usernameThrottlePolicy.LockoutThreshold ||
+		store.State(ipThrottleKey(ip)).Failures >= ipThrottlePolicy.LockoutThreshold
+}
+
+// recordLoginSuccess clears the username counter. The IP counter is left
+// alone so an attacker cannot reset it by logging into their own account.
+func recordLoginSuccess(username string) {
+	getAttemptStore().Reset(usernameThrottleKey(username))
+}
+
+// memoryAttemptStore is the default in-process AttemptStore
+type memoryAttemptStore struct {
+	mu      sync.Mutex
+	entries map[string]AttemptState
+}
+
+func newMemoryAttemptStore() *memoryAttemptStore {
+	s := &memoryAttemptStore{entries: make(map[string]AttemptState)}
+	go func() {
+		for {
+			time.Sleep(10 * time.Minute)
+			s.prune(time.Now())
+		}
+	}()
+	return s
+}
+
+func (s *memoryAttemptStore) Reserve(key string, policy ThrottlePolicy, now time.Time) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.entries[key]
+	if !state.LastFailure.IsZero() && now.Sub(state.LastFailure) > policy.ResetAfter {
+		state = AttemptState{}
+	}
+	if until := policy.blockedUntil(state); until.After(now) {
+		return until, false
+	}
+	state.Failures++
+	state.LastFailure = now
+	s.entries[key] = state
+	return time.Time{}, true
+}
+
+func (s *memoryAttemptStore) Release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	state.Failures--
+	if state.Failures <= 0 {
+		delete(s.entries, key)
+		return
+	}
+	s.entries[key] = state
+}
+
+func (s *memoryAttemptStore) State(key string) AttemptState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.entries[key]
+	if !state.LastFailure.IsZero() && time.Since(state.LastFailure) > throttleResetAfter(key) {
+		return AttemptState{}
+	}
+	return state
+}
+
+func (s *memoryAttemptStore) Reset(key string) {
+	s.mu.Lock()
+	delete(s.entries, key)
+	s.mu.Unlock()
+}
+
+// prune drops entries whose failures have been forgotten
+func (s *memoryAttemptStore) prune(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, state := range s.entries {
+		if now.Sub(state.LastFailure) > throttleResetAfter(key) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+func throttleResetAfter(key string) time.Duration {
+	if strings.HasPrefix(key, "ip:") {
+		return ipThrottlePolicy.ResetAfter
+	}
+	return usernameThrottlePolicy.ResetAfter
+}
@@ -0,0 +1,80 @@
+package RebootForums
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"strings"
+	"sync"
+)
+
+// Mailer sends plain text emails such as verification links
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+var (
+	mailer   Mailer = logMailer{}
+	mailerMu sync.RWMutex
+)
+
+// SetMailer replaces the backend used to send emails
+func SetMailer(m Mailer) {
+	mailerMu.Lock()
+	mailer = m
+	mailerMu.Unlock()
+}
+
+func getMailer() Mailer {
+	mailerMu.RLock()
+	defer mailerMu.RUnlock()
+	return mailer
+}
+
+// sendMail sends an email with the configured mailer
+func sendMail(to, subject, body string) error {
+	return getMailer().Send(to, subject, body)
+}
+
+// logMailer writes emails to the server log. It is the default so that
+// development setups work without an SMTP server.
+type logMailer struct{}
+
+func (logMailer) Send(to, subject, body string) error {
+	log.Printf("Email to %s\nSubject: %s\n\n%s", to, subject, body)
+	return nil
+}
+
+// SMTPMailer delivers email through an SMTP server
+type SMTPMailer struct {
+	Addr     string // host:port
+	From     string
+	Username string
+	Password string
+}
+
+func (m SMTPMailer) Send(to, subject, body string) error {
+	// Header injection guard: none of these may span lines
+	for _, v := range []string{to, subject, m.From} {
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("invalid email header value %q", v)
+		}
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		host := m.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	msg := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + strings.ReplaceAll(body, "\n", "\r\n")
+	return smtp.SendMail(m.Addr, auth, m.From, []string{to}, []byte(msg))
+}
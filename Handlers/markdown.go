@@ -0,0 +1,181 @@
+package RebootForums
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"html"
+	"html/template"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	goldmarkhtml "github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// markdownCacheSize is how many rendered posts and comments are kept in memory
+const markdownCacheSize = 2000
+
+// markdown renders the subset of CommonMark allowed in posts and comments:
+// paragraphs, emphasis, links, lists, blockquotes, code and @mentions. Headings, rules,
+// images and raw HTML are left out, so "#" or "<b>" stay plain text.
+var markdown = goldmark.New(
+	goldmark.WithParser(parser.NewParser(
+		parser.WithBlockParsers(
+			util.Prioritized(parser.NewListParser(), 300),
+			util.Prioritized(parser.NewListItemParser(), 400),
+			util.Prioritized(parser.NewCodeBlockParser(), 500),
+			util.Prioritized(parser.NewFencedCodeBlockParser(), 700),
+			util.Prioritized(parser.NewBlockquoteParser(), 800),
+			util.Prioritized(parser.NewParagraphParser(), 1000),
+		),
+		parser.WithInlineParsers(
+			util.Prioritized(parser.NewCodeSpanParser(), 100),
+			util.Prioritized(parser.NewLinkParser(), 200),
+			util.Prioritized(parser.NewAutoLinkParser(), 300),
+			util.Prioritized(parser.NewEmphasisParser(), 500),
+			util.Prioritized(mentionParser{}, 600),
+		),
+		parser.WithParagraphTransformers(parser.DefaultParagraphTransformers()...),
+		parser.WithASTTransformers(util.Prioritized(imageToLink{}, 100)),
+	)),
+	goldmark.WithExtensions(extension.Linkify),
+	goldmark.WithRendererOptions(
+		// Content written before Markdown support relies on single line breaks
+		goldmarkhtml.WithHardWraps(),
+		renderer.WithNodeRenderers(
+			util.Prioritized(codeBlockRenderer{}, 100),
+			util.Prioritized(mentionRenderer{}, 100),
+		),
+	),
+)
+
+// markdownPolicy is the allow-list every rendered document is passed through
+var markdownPolicy = func() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+	p.AllowElements("p", "br", "em", "strong", "code", "pre", "blockquote", "ul", "ol", "li")
+	p.AllowAttrs("start").Matching(bluemonday.Integer).OnElements("ol")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+#.-]+$`)).OnElements("code")
+	// Classes and the language label added by the syntax highlighter
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^chroma$`)).OnElements("pre")
+	p.AllowAttrs("data-lang").Matching(regexp.MustCompile(`^[\w+#. -]+$`)).OnElements("pre")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^[a-z0-9]+$`)).OnElements("span")
+	p.AllowElements("span")
+	p.AllowAttrs("href").OnElements("a")
+	p.AllowURLSchemes("http", "https", "mailto")
+	p.AllowRelativeURLs(true)
+	p.RequireParseableURLs(true)
+	p.RequireNoFollowOnLinks(true)
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+	return p
+}()
+
+// plainTextPolicy drops every tag and keeps only the text
+var plainTextPolicy = bluemonday.StrictPolicy()
+
+// imageToLink turns images into plain links so posts cannot embed pictures
+// from other sites, which would leak readers' IP addresses
+type imageToLink struct{}
+
+func (imageToLink) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	var images []*ast.Image
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if img, ok := n.(*ast.Image); ok && entering {
+			images = append(images, img)
+		}
+		return ast.WalkContinue, nil
+	})
+	for _, img := range images {
+		link := ast.NewLink()
+		link.Destination = img.Destination
+		link.Title = img.Title
+		for child := img.FirstChild(); child != nil; {
+			next := child.NextSibling()
+			link.AppendChild(link, child)
+			child = next
+		}
+		img.Parent().ReplaceChild(img.Parent(), img, link)
+	}
+}
+
+// markdownCache remembers rendered HTML by a hash of the source, so each
+// revision of a post is rendered once. Mentions are cached as placeholders
+// and linked on every render, since accounts come and go after a post is
+// written.
+var markdownCache = struct {
+	sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	order   *list.List
+}{
+	entries: make(map[[sha256.Size]byte]*list.Element),
+	order:   list.New(),
+}
+
+type markdownCacheEntry struct {
+	key  [sha256.Size]byte
+	html template.HTML
+}
+
+// RenderMarkdown converts post or comment content to sanitized HTML
+func RenderMarkdown(content string) template.HTML {
+	return linkMentions(renderCached(content))
+}
+
+// renderCached returns the sanitized HTML for content, with mentions still
+// as placeholders
+func renderCached(content string) template.HTML {
+	key := sha256.Sum256([]byte(content))
+
+	markdownCache.Lock()
+	if el, ok := markdownCache.entries[key]; ok {
+		markdownCache.order.MoveToFront(el)
+		markdownCache.Unlock()
+		return el.Value.(*markdownCacheEntry).html
+	}
+	markdownCache.Unlock()
+
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(content), &buf); err != nil {
+		log.Printf("Error rendering markdown: %v", err)
+		return template.HTML("<p>" + template.HTMLEscapeString(content) + "</p>")
+	}
+	rendered := template.HTML(markdownPolicy.SanitizeBytes(buf.Bytes()))
+
+	markdownCache.Lock()
+	defer markdownCache.Unlock()
+	if _, ok := markdownCache.entries[key]; !ok {
+		markdownCache.entries[key] = markdownCache.order.PushFront(&markdownCacheEntry{key: key, html: rendered})
+		if markdownCache.order.Len() > markdownCacheSize {
+			oldest := markdownCache.order.Back()
+			markdownCache.order.Remove(oldest)
+			delete(markdownCache.entries, oldest.Value.(*markdownCacheEntry).key)
+		}
+	}
+	return rendered
+}
+
+// PlainText returns content with the Markdown formatting removed, for places
+// that cannot show HTML such as feeds, emails and search snippets
+func PlainText(content string) string {
+	stripped := plainTextPolicy.Sanitize(string(renderCached(content)))
+	return strings.Join(strings.Fields(html.UnescapeString(stripped)), " ")
+}
+
+// Snippet returns at most n characters of the plain text of content
+func Snippet(content string, n int) string {
+	plain := PlainText(content)
+	if utf8.RuneCountInString(plain) <= n {
+		return plain
+	}
+	return strings.TrimSpace(string([]rune(plain)[:n])) + "..."
+}
@@ -0,0 +1,327 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// MaxMentionsPerPost caps how many users one post or comment can notify
+const MaxMentionsPerPost = 10
+
+// maxUserSuggestions is how many usernames the autocomplete endpoint returns
+const maxUserSuggestions = 8
+
+// mentionNode is an @username found in post or comment text
+type mentionNode struct {
+	ast.BaseInline
+	Username string
+}
+
+var kindMention = ast.NewNodeKind("Mention")
+
+func (n *mentionNode) Kind() ast.NodeKind {
+	return kindMention
+}
+
+func (n *mentionNode) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Username": n.Username}, nil)
+}
+
+// mentionParser recognises @username. The @ must not follow a letter or digit,
+// so email addresses are left alone.
+type mentionParser struct{}
+
+func (mentionParser) Trigger() []byte {
+	return []byte{'@'}
+}
+
+func (mentionParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	if prev := block.PrecendingCharacter(); isUsernameRune(prev) {
+		return nil
+	}
+	line, _ := block.PeekLine()
+	end := 1
+	for end < len(line) {
+		r, size := utf8.DecodeRune(line[end:])
+		if !isUsernameRune(r) {
+			break
+		}
+		end += size
+	}
+	// Punctuation at the end belongs to the sentence, not the name
+	name := strings.TrimRight(string(line[1:end]), "._-")
+	length := utf8.RuneCountInString(name)
+	if length < MinUsernameLength || length > MaxUsernameLength {
+		return nil
+	}
+	if first, _ := utf8.DecodeRuneInString(name); !unicode.IsLetter(first) && !unicode.IsDigit(first) {
+		return nil
+	}
+	block.Advance(1 + len(name))
+	return &mentionNode{Username: name}
+}
+
+func isUsernameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.'
+}
+
+// mentionRenderer marks mentions with a placeholder that linkMentions
+// replaces after the cache lookup
+type mentionRenderer struct{}
+
+func (r mentionRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindMention, r.renderMention)
+}
+
+func (r mentionRenderer) renderMention(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*mentionNode)
+	if insideLink(n) {
+		w.WriteString("@" + html.EscapeString(n.Username))
+		return ast.WalkContinue, nil
+	}
+	w.WriteString(`<span class="mention">@` + html.EscapeString(n.Username) + `</span>`)
+	return ast.WalkContinue, nil
+}
+
+// mentionPlaceholder matches what renderMention writes. Raw HTML is not
+// allowed in posts, so only the renderer can produce it.
+var mentionPlaceholder = regexp.MustCompile(`<span class="mention">@([^<]+)</span>`)
+
+// linkMentions turns mention placeholders into links to the profiles of the
+// accounts that exist now, and the rest into plain text
+func linkMentions(rendered template.HTML) template.HTML {
+	matches := mentionPlaceholder.FindAllStringSubmatch(string(rendered), -1)
+	if len(matches) == 0 {
+		return rendered
+	}
+	names := make([]string, 0, len(matches))
+	for _, m := range matches {
+		names = append(names, html.UnescapeString(m[1]))
+	}
+	usernames, err := lookupUsernames(names)
+	if err != nil {
+		log.Printf("Error looking up mentioned users: %v", err)
+	}
+	return template.HTML(mentionPlaceholder.ReplaceAllStringFunc(string(rendered), func(placeholder string) string {
+		escaped := mentionPlaceholder.FindStringSubmatch(placeholder)[1]
+		username, ok := usernames[strings.ToLower(html.UnescapeString(escaped))]
+		if !ok {
+			return "@" + escaped
+		}
+		return `<a href="/user/` + url.PathEscape(username) + `" rel="nofollow">@` + html.EscapeString(username) + `</a>`
+	}))
+}
+
+func insideLink(n ast.Node) bool {
+	for p := n.Parent(); p != nil; p = p.Parent() {
+		if p.Kind() == ast.KindLink || p.Kind() == ast.KindAutoLink {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupUsernames finds the active accounts called any of names, ignoring
+// case. The result maps each lowercased username to its exact spelling.
+func lookupUsernames(names []string) (map[string]string, error) {
+	usernames := make(map[string]string)
+	seen := make(map[string]bool)
+	var args []interface{}
+	for _, name := range names {
+		key := strings.ToLower(name)
+		if !seen[key] {
+			seen[key] = true
+			args = append(args, name)
+		}
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(args)), ",")
+	rows, err := DB.Query("SELECT username FROM users WHERE username COLLATE NOCASE IN ("+placeholders+") AND deleted_at IS NULL", args...)
+	if err != nil {
+		return usernames, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return usernames, err
+		}
+		usernames[strings.ToLower(username)] = username
+	}
+	return usernames, rows.Err()
+}
+
+// findMentions returns the distinct names mentioned in content. Mentions
+// inside code are not counted because the Markdown parser skips them.
+func findMentions(content string) []string {
+	source := []byte(content)
+	doc := markdown.Parser().Parse(text.NewReader(source))
+
+	seen := make(map[string]bool)
+	var names []string
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if m, ok := n.(*mentionNode); ok && entering {
+			key := strings.ToLower(m.Username)
+			if !seen[key] && len(names) < MaxMentionsPerPost {
+				seen[key] = true
+				names = append(names, m.Username)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	return names
+}
+
+// MentionedUser is a user mentioned in a new post or comment
+type MentionedUser struct {
+	ID       int
+	Username string
+	Email    string
+}
+
+// recordMentions stores who is mentioned in a new post or comment (commentID
+// 0 for the post itself) and returns the ones to email. Authors mentioning
+// themselves and users who switched mention notifications off are not returned.
+// Users who blocked the author are not mentioned at all.
+func recordMentions(tx *sql.Tx, authorID, postID, commentID int, content string) ([]MentionedUser, error) {
+	var users []MentionedUser
+	for _, name := range findMentions(content) {
+		var u MentionedUser
+		err := tx.QueryRow("SELECT id, username, email FROM users WHERE username = ? COLLATE NOCASE AND deleted_at IS NULL", name).
+			Scan(&u.ID, &u.Username, &u.Email)
+		if err == sql.ErrNoRows || u.ID == authorID {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		blocked, err := hasBlocked(tx, u.ID, authorID)
+		if err != nil {
+			return nil, err
+		}
+		if blocked {
+			continue
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO mentions (user_id, author_id, post_id, comment_id, created_at)
+			VALUES (?, ?, ?, ?, ?)
+		`, u.ID, authorID, postID, nullableID(commentID), time.Now())
+		if err != nil {
+			return nil, err
+		}
+		if err := notify(tx, u.ID, authorID, NotifyMention, postID, commentID); err != nil {
+			return nil, err
+		}
+		enabled, err := notificationEnabled(tx, u.ID, NotifyMention)
+		if err != nil {
+			return nil, err
+		}
+		if enabled {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+// notifyMentions emails each mentioned user a link to where they were mentioned
+func notifyMentions(authorID, postID, commentID int, users []MentionedUser) {
+	if len(users) == 0 {
+		return
+	}
+	var author, title string
+	err := DB.QueryRow("SELECT u.username, p.title FROM users u, posts p WHERE u.id = ? AND p.id = ?", authorID, postID).Scan(&author, &title)
+	if err != nil {
+		log.Printf("Error fetching mention details: %v", err)
+		return
+	}
+
+	link := siteURL() + "/post/" + strconv.Itoa(postID)
+	where := "the post"
+	if commentID != 0 {
+		link += "#comment-" + strconv.Itoa(commentID)
+		where = "a comment on"
+	}
+	for _, u := range users {
+		body := "Hi " + u.Username + ",\n\n" +
+			author + " mentioned you in " + where + " \"" + title + "\":\n\n" + link + "\n"
+		if err := sendMail(u.Email, author+" mentioned you on Reboot Forums", body); err != nil {
+			log.Printf("Error sending mention email: %v", err)
+		}
+	}
+}
+
+// UserSuggestion is one entry returned by the autocomplete endpoint
+type UserSuggestion struct {
+	Username  string `json:"username"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+// UserSuggestHandler returns usernames starting with ?prefix= for @mention autocomplete
+func UserSuggestHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Error(w, "You must be logged in", http.StatusUnauthorized)
+		return
+	}
+
+	prefix := strings.TrimPrefix(strings.TrimSpace(r.URL.Query().Get("prefix")), "@")
+	suggestions := []UserSuggestion{}
+	if prefix != "" && utf8.RuneCountInString(prefix) <= MaxUsernameLength {
+		suggestions, err = suggestUsers(prefix)
+		if err != nil {
+			log.Printf("Error suggesting users: %v", err)
+			http.Error(w, "Error suggesting users", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suggestions)
+}
+
+func suggestUsers(prefix string) ([]UserSuggestion, error) {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix)
+	rows, err := DB.Query(`
+		SELECT id, username, COALESCE(avatar_key, '') FROM users
+		WHERE username LIKE ? ESCAPE '\' AND deleted_at IS NULL
+		ORDER BY LENGTH(username), username COLLATE NOCASE
+		LIMIT ?
+	`, escaped+"%", maxUserSuggestions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []UserSuggestion{}
+	for rows.Next() {
+		var id int
+		var s UserSuggestion
+		var avatarKey string
+		if err := rows.Scan(&id, &s.Username, &avatarKey); err != nil {
+			return nil, err
+		}
+		s.AvatarURL = AvatarURL(id, avatarKey, AvatarSizeSmall)
+		suggestions = append(suggestions, s)
+	}
+	return suggestions, nil
+}
@@ -0,0 +1,755 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxConversationMembers is the largest group a conversation can have,
+// including the person who starts it
+const MaxConversationMembers = 8
+
+// messageReportReasons are the reasons a private message can be reported for
+var messageReportReasons = map[string]string{
+	"spam":       "Spam",
+	"harassment": "Harassment or bullying",
+	"other":      "Something else",
+}
+
+// deletedMessageText replaces the content of a message removed by a moderator
+const deletedMessageText = "*This message was removed by a moderator.*"
+
+// ErrNotMember is returned when a user opens a conversation they are not part of
+var ErrNotMember = errors.New("not a member of this conversation")
+
+// Conversation is one entry of a user's inbox
+type Conversation struct {
+	ID          int
+	Members     []string
+	LastMessage string
+	LastAuthor  string
+	UpdatedAt   time.Time
+	Unread      int
+}
+
+// Title names the other people in the conversation
+func (c Conversation) Title() string {
+	if len(c.Members) == 0 {
+		return "Just you"
+	}
+	return strings.Join(c.Members, ", ")
+}
+
+// DirectMessage is a private message in a conversation
+type DirectMessage struct {
+	ID        int
+	AuthorID  int
+	Author    string
+	AvatarURL string
+	Content   string
+	CreatedAt time.Time
+	SeenBy    []string
+}
+
+// HTML returns the message rendered from Markdown
+func (m DirectMessage) HTML() template.HTML {
+	return RenderMarkdown(m.Content)
+}
+
+// parseRecipients splits a list of usernames separated by commas or spaces,
+// dropping duplicates and a leading @
+func parseRecipients(s string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, name := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		name = strings.TrimPrefix(name, "@")
+		if name == "" || seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// validateMessage checks the length of a message the same way comments are checked
+func validateMessage(content string, errs ValidationErrors) {
+	if len(content) == 0 {
+		errs.Add("content", "Message cannot be empty")
+	} else if len(content) > MaxMessageLength {
+		errs.Add("content", fmt.Sprintf("Message is too long. Maximum length is %d characters, your message has %d characters.", MaxMessageLength, len(content)))
+	}
+}
+
+// startConversation sends a first message to recipients and returns the
+// conversation it went to. A message to a single person continues the
+// existing conversation with them, if there is one.
+func startConversation(sender *User, ip string, recipients []string, content string) (int, ValidationErrors, error) {
+	errs := ValidationErrors{}
+	validateMessage(content, errs)
+	if msg := readOnlyMessage(sender, ip); msg != "" {
+		errs.Add("content", msg)
+	}
+	if len(recipients) == 0 {
+		errs.Add("to", "Enter at least one username")
+	} else if len(recipients) > MaxConversationMembers-1 {
+		errs.Add("to", fmt.Sprintf("A conversation can have at most %d people", MaxConversationMembers))
+	}
+
+	var memberIDs []int
+	for _, name := range recipients {
+		var id int
+		var username string
+		err := DB.QueryRow("SELECT id, username FROM users WHERE username = ? COLLATE NOCASE AND deleted_at IS NULL", name).Scan(&id, &username)
+		if err == sql.ErrNoRows {
+			errs.Add("to", fmt.Sprintf("There is no user called %s", name))
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if id == sender.ID {
+			errs.Add("to", "You cannot send a message to yourself")
+			continue
+		}
+		blocked, err := isBlocked(DB, sender.ID, id)
+		if err != nil {
+			return 0, nil, err
+		}
+		if blocked {
+			errs.Add("to", fmt.Sprintf("You cannot send messages to %s", username))
+			continue
+		}
+		memberIDs = append(memberIDs, id)
+	}
+	if len(errs) > 0 {
+		return 0, errs, nil
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	var conversationID int
+	if len(memberIDs) == 1 {
+		err = tx.QueryRow(`
+			SELECT c.id FROM conversations c
+			WHERE (SELECT COUNT(*) FROM conversation_members WHERE conversation_id = c.id) = 2
+				AND EXISTS(SELECT 1 FROM conversation_members WHERE conversation_id = c.id AND user_id = ?)
+				AND EXISTS(SELECT 1 FROM conversation_members WHERE conversation_id = c.id AND user_id = ?)
+			ORDER BY c.id LIMIT 1
+		`, sender.ID, memberIDs[0]).Scan(&conversationID)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, nil, err
+		}
+	}
+
+	if conversationID == 0 {
+		result, err := tx.Exec("INSERT INTO conversations (created_at, updated_at) VALUES (?, ?)", time.Now(), time.Now())
+		if err != nil {
+			return 0, nil, err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return 0, nil, err
+		}
+		conversationID = int(id)
+		for _, userID := range append([]int{sender.ID}, memberIDs...) {
+			_, err := tx.Exec("INSERT INTO conversation_members (conversation_id, user_id, joined_at) VALUES (?, ?, ?)", conversationID, userID, time.Now())
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+	}
+
+	if err := addMessage(tx, conversationID, sender.ID, content); err != nil {
+		return 0, nil, err
+	}
+	return conversationID, nil, tx.Commit()
+}
+
+// sendMessage adds a reply to an existing conversation
+func sendMessage(conversationID, userID int, content string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := addMessage(tx, conversationID, userID, content); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// addMessage stores a message and marks the conversation read for its author
+func addMessage(tx *sql.Tx, conversationID, userID int, content string) error {
+	now := time.Now()
+	result, err := tx.Exec("INSERT INTO messages (conversation_id, user_id, content, created_at) VALUES (?, ?, ?, ?)",
+		conversationID, userID, content, now)
+	if err != nil {
+		return err
+	}
+	messageID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE conversations SET updated_at = ? WHERE id = ?", now, conversationID); err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE conversation_members SET last_read_message_id = ? WHERE conversation_id = ? AND user_id = ?",
+		messageID, conversationID, userID)
+	return err
+}
+
+// conversationMembers returns the IDs and names of everyone in a conversation
+// except userID, or ErrNotMember if userID is not in it
+func conversationMembers(conversationID, userID int) (map[int]string, error) {
+	rows, err := DB.Query(`
+		SELECT u.id, u.username FROM conversation_members cm
+		JOIN users u ON u.id = cm.user_id
+		WHERE cm.conversation_id = ?
+	`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	others := make(map[int]string)
+	isMember := false
+	for rows.Next() {
+		var id int
+		var username string
+		if err := rows.Scan(&id, &username); err != nil {
+			return nil, err
+		}
+		if id == userID {
+			isMember = true
+			continue
+		}
+		others[id] = username
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if !isMember {
+		return nil, ErrNotMember
+	}
+	return others, nil
+}
+
+// memberNames returns the names of conversation members in alphabetical order
+func memberNames(members map[int]string) []string {
+	names := make([]string, 0, len(members))
+	for _, username := range members {
+		names = append(names, username)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// replyBlockedBy returns the name of a member who blocked userID or was
+// blocked by them, in which case userID cannot write to the conversation
+func replyBlockedBy(userID int, others map[int]string) (string, error) {
+	for id, username := range others {
+		blocked, err := isBlocked(DB, userID, id)
+		if err != nil {
+			return "", err
+		}
+		if blocked {
+			return username, nil
+		}
+	}
+	return "", nil
+}
+
+// getInbox returns the user's conversations, most recently active first
+func getInbox(userID int) ([]Conversation, error) {
+	rows, err := DB.Query(`
+		SELECT c.id, c.updated_at,
+			(SELECT COUNT(*) FROM messages m
+				WHERE m.conversation_id = c.id AND m.user_id != ? AND m.id > cm.last_read_message_id)
+		FROM conversations c
+		JOIN conversation_members cm ON cm.conversation_id = c.id AND cm.user_id = ?
+		ORDER BY c.updated_at DESC
+	`, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	var conversations []Conversation
+	for rows.Next() {
+		var c Conversation
+		if err := rows.Scan(&c.ID, &c.UpdatedAt, &c.Unread); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		conversations = append(conversations, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range conversations {
+		c := &conversations[i]
+		others, err := conversationMembers(c.ID, userID)
+		if err != nil {
+			return nil, err
+		}
+		c.Members = memberNames(others)
+		var content string
+		err = DB.QueryRow(`
+			SELECT u.username, m.content FROM messages m
+			JOIN users u ON u.id = m.user_id
+			WHERE m.conversation_id = ?
+			ORDER BY m.id DESC LIMIT 1
+		`, c.ID).Scan(&c.LastAuthor, &content)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		c.LastMessage = Snippet(content, 100)
+	}
+	return conversations, nil
+}
+
+// UnreadMessageCount returns how many conversations have messages the user has not read
+func UnreadMessageCount(userID int) int {
+	var count int
+	err := DB.QueryRow(`
+		SELECT COUNT(*) FROM conversation_members cm
+		WHERE cm.user_id = ? AND EXISTS(
+			SELECT 1 FROM messages m
+			WHERE m.conversation_id = cm.conversation_id AND m.user_id != ? AND m.id > cm.last_read_message_id
+		)
+	`, userID, userID).Scan(&count)
+	if err != nil {
+		log.Printf("Error counting unread messages: %v", err)
+	}
+	return count
+}
+
+// getConversationMessages returns the messages of a conversation, oldest
+// first. The last message each member has read says who has seen it.
+func getConversationMessages(conversationID, userID int) ([]DirectMessage, error) {
+	rows, err := DB.Query(`
+		SELECT m.id, u.id, u.username, COALESCE(u.avatar_key, ''), m.content, m.created_at
+		FROM messages m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.conversation_id = ?
+		ORDER BY m.id ASC
+	`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []DirectMessage
+	index := make(map[int]int)
+	for rows.Next() {
+		var m DirectMessage
+		var avatarKey string
+		if err := rows.Scan(&m.ID, &m.AuthorID, &m.Author, &avatarKey, &m.Content, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		m.AvatarURL = AvatarURL(m.AuthorID, avatarKey, AvatarSizeSmall)
+		index[m.ID] = len(messages)
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	receipts, err := DB.Query(`
+		SELECT u.username, cm.last_read_message_id FROM conversation_members cm
+		JOIN users u ON u.id = cm.user_id
+		WHERE cm.conversation_id = ? AND cm.user_id != ?
+	`, conversationID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer receipts.Close()
+	for receipts.Next() {
+		var username string
+		var lastRead int
+		if err := receipts.Scan(&username, &lastRead); err != nil {
+			return nil, err
+		}
+		if i, ok := index[lastRead]; ok {
+			messages[i].SeenBy = append(messages[i].SeenBy, username)
+		}
+	}
+	return messages, receipts.Err()
+}
+
+func markConversationRead(conversationID, userID int) error {
+	_, err := DB.Exec(`
+		UPDATE conversation_members
+		SET last_read_message_id = COALESCE((SELECT MAX(id) FROM messages WHERE conversation_id = ?), 0)
+		WHERE conversation_id = ? AND user_id = ?
+	`, conversationID, conversationID, userID)
+	return err
+}
+
+// InboxHandler lists the user's conversations and starts new ones
+func InboxHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		to := r.FormValue("to")
+		content := strings.TrimSpace(r.FormValue("content"))
+		conversationID, errs, err := startConversation(user, clientIP(r), parseRecipients(to), content)
+		if err != nil {
+			log.Printf("Error starting conversation: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+		if len(errs) > 0 {
+			renderInbox(w, r, user, to, content, errs)
+			return
+		}
+		http.Redirect(w, r, "/messages/"+strconv.Itoa(conversationID), http.StatusSeeOther)
+		return
+	}
+
+	renderInbox(w, r, user, r.URL.Query().Get("to"), "", nil)
+}
+
+func renderInbox(w http.ResponseWriter, r *http.Request, user *User, to, content string, errs ValidationErrors) {
+	conversations, err := getInbox(user.ID)
+	if err != nil {
+		log.Printf("Error fetching inbox: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	data := map[string]interface{}{
+		"LoggedIn":            true,
+		"Username":            user.Username,
+		"UnreadNotifications": UnreadNotificationCount(user.ID),
+		"UnreadMessages":      UnreadMessageCount(user.ID),
+		"Conversations":       conversations,
+		"To":                  to,
+		"Content":             content,
+		"MaxLength":           MaxMessageLength,
+		"Errors":              errs,
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	if err := RenderTemplate(w, "messages.html", data); err != nil {
+		log.Printf("Error rendering inbox: %v", err)
+		Error500Handler(w, r)
+	}
+}
+
+// ConversationHandler shows a conversation and posts replies to it
+func ConversationHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	conversationID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+	others, err := conversationMembers(conversationID, user.ID)
+	if err == ErrNotMember {
+		Error404Handler(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching conversation: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	blockedBy, err := replyBlockedBy(user.ID, others)
+	if err != nil {
+		log.Printf("Error checking blocks: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	errs := ValidationErrors{}
+	content := ""
+	if r.Method == http.MethodPost {
+		content = strings.TrimSpace(r.FormValue("content"))
+		validateMessage(content, errs)
+		if blockedBy != "" {
+			errs.Add("content", fmt.Sprintf("You cannot send messages to %s", blockedBy))
+		}
+		if msg := readOnlyMessage(user, clientIP(r)); msg != "" {
+			errs.Add("content", msg)
+		}
+		if len(errs) == 0 {
+			if err := sendMessage(conversationID, user.ID, content); err != nil {
+				log.Printf("Error sending message: %v", err)
+				Error500Handler(w, r)
+				return
+			}
+			http.Redirect(w, r, "/messages/"+strconv.Itoa(conversationID), http.StatusSeeOther)
+			return
+		}
+	}
+
+	if err := markConversationRead(conversationID, user.ID); err != nil {
+		log.Printf("Error marking conversation read: %v", err)
+	}
+	messages, err := getConversationMessages(conversationID, user.ID)
+	if err != nil {
+		log.Printf("Error fetching messages: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	conversation := Conversation{ID: conversationID, Members: memberNames(others)}
+	data := map[string]interface{}{
+		"LoggedIn":            true,
+		"Username":            user.Username,
+		"UserID":              user.ID,
+		"UnreadNotifications": UnreadNotificationCount(user.ID),
+		"UnreadMessages":      UnreadMessageCount(user.ID),
+		"Conversation":        conversation,
+		"Messages":            messages,
+		"BlockedBy":           blockedBy,
+		"Content":             content,
+		"MaxLength":           MaxMessageLength,
+		"ReportReasons":       messageReportReasons,
+		"Reported":            r.URL.Query().Get("reported") == "1",
+		"Errors":              errs,
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	if err := RenderTemplate(w, "conversation.html", data); err != nil {
+		log.Printf("Error rendering conversation: %v", err)
+		Error500Handler(w, r)
+	}
+}
+
+// ReportMessageHandler lets a member of a conversation report a message
+// from someone else to the moderators
+func ReportMessageHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	messageID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+	reason := r.FormValue("reason")
+	if _, ok := messageReportReasons[reason]; !ok {
+		Error400Handler(w, r)
+		return
+	}
+
+	var conversationID, authorID int
+	err = DB.QueryRow(`
+		SELECT m.conversation_id, m.user_id FROM messages m
+		JOIN conversation_members cm ON cm.conversation_id = m.conversation_id AND cm.user_id = ?
+		WHERE m.id = ?
+	`, user.ID, messageID).Scan(&conversationID, &authorID)
+	if err == sql.ErrNoRows || authorID == user.ID {
+		Error404Handler(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching reported message: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	_, err = DB.Exec("INSERT INTO message_reports (message_id, reporter_id, reason, created_at) VALUES (?, ?, ?, ?)",
+		messageID, user.ID, reason, time.Now())
+	if err != nil {
+		log.Printf("Error reporting message: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	http.Redirect(w, r, "/messages/"+strconv.Itoa(conversationID)+"?reported=1", http.StatusSeeOther)
+}
+
+// MessageReport is an open report of a private message. Context holds the
+// messages just before the reported one so moderators can judge it; the rest
+// of the conversation stays private.
+type MessageReport struct {
+	ID        int
+	Reporter  string
+	Reason    string
+	CreatedAt time.Time
+	Message   DirectMessage
+	Context   []DirectMessage
+}
+
+// messageReportContext is how many earlier messages moderators see with a report
+const messageReportContext = 5
+
+func getOpenMessageReports() ([]MessageReport, error) {
+	rows, err := DB.Query(`
+		SELECT r.id, u.username, r.reason, r.created_at, m.id, m.conversation_id, a.id, a.username, m.content, m.created_at
+		FROM message_reports r
+		JOIN users u ON u.id = r.reporter_id
+		JOIN messages m ON m.id = r.message_id
+		JOIN users a ON a.id = m.user_id
+		WHERE r.resolved_at IS NULL
+		ORDER BY r.created_at ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	var reports []MessageReport
+	var conversationIDs []int
+	for rows.Next() {
+		var rep MessageReport
+		var conversationID int
+		m := &rep.Message
+		if err := rows.Scan(&rep.ID, &rep.Reporter, &rep.Reason, &rep.CreatedAt, &m.ID, &conversationID, &m.AuthorID, &m.Author, &m.Content, &m.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rep.Reason = messageReportReasons[rep.Reason]
+		reports = append(reports, rep)
+		conversationIDs = append(conversationIDs, conversationID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range reports {
+		context, err := DB.Query(`
+			SELECT m.id, u.username, m.content, m.created_at FROM messages m
+			JOIN users u ON u.id = m.user_id
+			WHERE m.conversation_id = ? AND m.id < ?
+			ORDER BY m.id DESC LIMIT ?
+		`, conversationIDs[i], reports[i].Message.ID, messageReportContext)
+		if err != nil {
+			return nil, err
+		}
+		for context.Next() {
+			var m DirectMessage
+			if err := context.Scan(&m.ID, &m.Author, &m.Content, &m.CreatedAt); err != nil {
+				context.Close()
+				return nil, err
+			}
+			reports[i].Context = append([]DirectMessage{m}, reports[i].Context...)
+		}
+		context.Close()
+	}
+	return reports, nil
+}
+
+// ModMessageReportsHandler lists reported private messages for moderators
+func ModMessageReportsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, false)
+	if !ok {
+		return
+	}
+
+	reports, err := getOpenMessageReports()
+	if err != nil {
+		log.Printf("Error fetching message reports: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	data := map[string]interface{}{
+		"LoggedIn": true,
+		"Username": user.Username,
+		"Reports":  reports,
+	}
+	if err := RenderTemplate(w, "mod-messages.html", data); err != nil {
+		log.Printf("Error rendering message reports: %v", err)
+		Error500Handler(w, r)
+	}
+}
+
+// ModResolveMessageReportHandler closes a message report, deleting the
+// message if the moderator decides it breaks the rules
+func ModResolveMessageReportHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, false)
+	if !ok {
+		return
+	}
+
+	reportID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+	outcome := r.FormValue("outcome")
+	if outcome != "dismissed" && outcome != "deleted" {
+		Error400Handler(w, r)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		log.Printf("Error resolving message report: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	defer tx.Rollback()
+
+	var messageID int
+	var sender, content string
+	err = tx.QueryRow(`
+		SELECT r.message_id, u.username, m.content FROM message_reports r
+		JOIN messages m ON m.id = r.message_id
+		JOIN users u ON u.id = m.user_id
+		WHERE r.id = ? AND r.resolved_at IS NULL
+	`, reportID).Scan(&messageID, &sender, &content)
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error resolving message report: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	// Resolve every open report of the same message at once
+	_, err = tx.Exec("UPDATE message_reports SET resolved_at = ?, resolved_by = ?, outcome = ? WHERE message_id = ? AND resolved_at IS NULL",
+		time.Now(), user.ID, outcome, messageID)
+	if err == nil && outcome == "deleted" {
+		_, err = tx.Exec("UPDATE messages SET content = ? WHERE id = ?", deletedMessageText, messageID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error resolving message report: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	event := AuditEvent{Action: AuditReportDismiss, TargetType: "message", TargetID: messageID, Target: sender}
+	if outcome == "deleted" {
+		event.Action = AuditMessageDelete
+		event.Before = map[string]string{"author": sender, "content": content}
+		event.After = map[string]string{"author": sender, "content": deletedMessageText}
+	}
+	recordAudit(user, clientIP(r), event)
+	http.Redirect(w, r, "/mod/messages", http.StatusSeeOther)
+}
@@ -0,0 +1,100 @@
+package RebootForums
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// columnMigration describes a column that was added to an existing table
+// after the initial schema shipped.
+type columnMigration struct {
+	Table      string
+	Column     string
+	Definition string
+}
+
+// columnMigrations lists every column added after CreateTables was first released.
+// Fresh databases get these columns from CreateTables as well, so each entry
+// must be safe to apply to a table that already has it.
+var columnMigrations = []columnMigration{
+	{"users", "role", "TEXT NOT NULL DEFAULT 'user'"},
+	{"users", "totp_secret", "TEXT"},
+	{"users", "totp_enabled", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "has_password", "BOOLEAN NOT NULL DEFAULT 1"},
+	{"users", "username_key", "TEXT"},
+	// SQLite cannot add a column with a CURRENT_TIMESTAMP default, so inserts
+	// set created_at explicitly and BackfillUserCreatedAt fills older rows
+	{"users", "created_at", "DATETIME"},
+	{"users", "bio", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "location", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "website", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "deleted_at", "DATETIME"},
+	{"users", "avatar_key", "TEXT"},
+	// Set once the user has proven they own their email address
+	{"users", "email_verified", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"sessions", "reauthenticated_at", "DATETIME"},
+	{"oauth_states", "reauth", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"user_sanctions", "lifted_at", "DATETIME"},
+	{"user_sanctions", "lifted_by", "INTEGER"},
+	{"posts", "deleted_at", "DATETIME"},
+	{"posts", "deleted_by", "INTEGER"},
+	{"comments", "deleted_at", "DATETIME"},
+	{"comments", "deleted_by", "INTEGER"},
+	{"posts", "pinned", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"posts", "locked", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"posts", "announcement", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"post_categories", "pinned", "BOOLEAN NOT NULL DEFAULT 0"},
+}
+
+// ApplyMigrations adds any missing columns to tables created by older versions
+func ApplyMigrations() error {
+	for _, m := range columnMigrations {
+		err := addColumnIfMissing(m.Table, m.Column, m.Definition)
+		if err != nil {
+			log.Printf("Error migrating %s.%s: %v", m.Table, m.Column, err)
+			return err
+		}
+	}
+
+	// Older versions indexed username_key without enforcing it, so two signups
+	// racing for lookalike names could both succeed
+	err := clearDuplicateUsernameKeys()
+	if err != nil {
+		log.Printf("Error clearing duplicate username keys: %v", err)
+		return err
+	}
+	_, err = DB.Exec("DROP INDEX IF EXISTS idx_users_username_key")
+	if err != nil {
+		log.Printf("Error dropping username_key index: %v", err)
+		return err
+	}
+	_, err = DB.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username_key_unique ON users(username_key)")
+	if err != nil {
+		log.Printf("Error creating username_key index: %v", err)
+		return err
+	}
+	err = BackfillUsernameKeys()
+	if err != nil {
+		log.Printf("Error backfilling username keys: %v", err)
+		return err
+	}
+	err = BackfillUserCreatedAt()
+	if err != nil {
+		log.Printf("Error backfilling user join dates: %v", err)
+		return err
+	}
+	log.Println("Schema migrations applied")
+	return nil
+}
+
+// addColumnIfMissing runs ALTER TABLE ... ADD COLUMN and ignores the error
+// SQLite returns when the column already exists
+func addColumnIfMissing(table, column, definition string) error {
+	_, err := DB.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+		return err
+	}
+	return nil
+}
@@ -1,11 +1,15 @@
 package RebootForums
 
-import "time"
+import (
+    "html/template"
+    "time"
+)
 
 const (
     MaxTitleLength    = 80
     MaxPostLength     = 3000
     MaxCommentLength  = 600
+    MaxMessageLength  = 2000
 )
 
 // Post represents a forum post
@@ -14,24 +18,50 @@ type Post struct {
     Title     string
     Content   string
     Author    string
+    AuthorID  int
+    AvatarURL string
     CreatedAt time.Time
     Likes     int
     Dislikes  int
+    // Pinned posts sort first in the feed; in a category listing this
+    // includes posts pinned only in that category
+    Pinned    bool
+    Locked    bool
+    Announcement bool
 }
 
 func (p Post) FormattedCreatedAt() string {
     return p.CreatedAt.Format("January 2, 2006 at 3:04 PM")
 }
 
+// HTML returns the post content rendered from Markdown
+func (p Post) HTML() template.HTML {
+    return RenderMarkdown(p.Content)
+}
+
+// Snippet returns the start of the post as plain text for listings
+func (p Post) Snippet() string {
+    return Snippet(p.Content, 200)
+}
+
 // Comment represents a comment on a post
 type Comment struct {
     ID        int
     PostID    int
     Content   string
     Author    string
+    AuthorID  int
+    AvatarURL string
     CreatedAt time.Time
     Likes     int
     Dislikes  int
+    // Muted is set when the viewer muted the author; the comment is collapsed
+    Muted     bool
+}
+
+// HTML returns the comment content rendered from Markdown
+func (c Comment) HTML() template.HTML {
+    return RenderMarkdown(c.Content)
 }
 
 // Category represents a forum category
@@ -40,12 +70,31 @@ type Category struct {
     Name string
 }
 
+// User roles
+const (
+    RoleUser      = "user"
+    RoleModerator = "moderator"
+    RoleAdmin     = "admin"
+)
+
 // User represents a forum user
 type User struct {
-    ID       int
-    Username string
-    Email    string
-    Password string
+    ID          int
+    Username    string
+    Email       string
+    Password    string
+    Role        string
+    TOTPEnabled bool
+}
+
+// IsStaff reports whether the user is a moderator or an admin
+func (u *User) IsStaff() bool {
+    return u != nil && (u.Role == RoleModerator || u.Role == RoleAdmin)
+}
+
+// IsAdmin reports whether the user is an admin
+func (u *User) IsAdmin() bool {
+    return u != nil && u.Role == RoleAdmin
 }
 
 // GetAllCategories fetches all categories from the database
@@ -0,0 +1,349 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Notification types. Each one can be switched off in the notification preferences.
+const (
+	NotifyComment = "comment"
+	NotifyLike    = "like"
+	NotifyMention = "mention"
+)
+
+// notificationTypes lists the types in the order the preferences form shows them
+var notificationTypes = []struct {
+	Type  string
+	Label string
+}{
+	{NotifyComment, "Comments on my posts"},
+	{NotifyLike, "Likes on my posts and comments"},
+	{NotifyMention, "Mentions of my username"},
+}
+
+// notificationPageSize is how many grouped notifications the list page shows
+const notificationPageSize = 50
+
+// Notification is a group of events of one type on the same post or comment,
+// such as every like a post received since it was last read
+type Notification struct {
+	ID        int
+	Type      string
+	PostID    int
+	PostTitle string
+	CommentID int
+	Actor     string
+	Count     int
+	Unread    bool
+	CreatedAt time.Time
+}
+
+// Message describes the group in one sentence, like "5 people liked your post"
+func (n Notification) Message() string {
+	who := n.Actor
+	if n.Count > 1 {
+		who = fmt.Sprintf("%d people", n.Count)
+	}
+	switch n.Type {
+	case NotifyComment:
+		return fmt.Sprintf(`%s commented on your post "%s"`, who, n.PostTitle)
+	case NotifyLike:
+		if n.CommentID != 0 {
+			return fmt.Sprintf(`%s liked your comment on "%s"`, who, n.PostTitle)
+		}
+		return fmt.Sprintf(`%s liked your post "%s"`, who, n.PostTitle)
+	case NotifyMention:
+		if n.CommentID != 0 {
+			return fmt.Sprintf(`%s mentioned you in a comment on "%s"`, who, n.PostTitle)
+		}
+		return fmt.Sprintf(`%s mentioned you in "%s"`, who, n.PostTitle)
+	}
+	return who + ` did something on "` + n.PostTitle + `"`
+}
+
+// Link is where the notification leads
+func (n Notification) Link() string {
+	link := "/post/" + strconv.Itoa(n.PostID)
+	if n.CommentID != 0 {
+		link += "#comment-" + strconv.Itoa(n.CommentID)
+	}
+	return link
+}
+
+// notify records that actorID did something userID may want to know about.
+// commentID is the comment the event is about, or 0 for the post itself.
+// Nothing is stored for users acting on their own content, for types the
+// user switched off or for actors the user blocked.
+func notify(tx *sql.Tx, userID, actorID int, kind string, postID, commentID int) error {
+	if userID == actorID {
+		return nil
+	}
+	enabled, err := notificationEnabled(tx, userID, kind)
+	if err != nil || !enabled {
+		return err
+	}
+	blocked, err := hasBlocked(tx, userID, actorID)
+	if err != nil || blocked {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO notifications (user_id, actor_id, type, post_id, comment_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, userID, actorID, kind, postID, nullableID(commentID), time.Now())
+	return err
+}
+
+// unnotify removes an unread notification whose cause was undone, such as a
+// like that was taken back before the owner saw it
+func unnotify(tx *sql.Tx, actorID int, kind string, postID, commentID int) error {
+	_, err := tx.Exec(`
+		DELETE FROM notifications
+		WHERE actor_id = ? AND type = ? AND post_id = ? AND comment_id IS ? AND read_at IS NULL
+	`, actorID, kind, postID, nullableID(commentID))
+	return err
+}
+
+// notificationVisible hides notifications about posts and comments in the
+// trash. It expects the notifications table to be aliased n.
+const notificationVisible = `NOT EXISTS (SELECT 1 FROM posts WHERE id = n.post_id AND deleted_at IS NOT NULL)
+	AND NOT EXISTS (SELECT 1 FROM comments WHERE id = n.comment_id AND deleted_at IS NOT NULL)`
+
+// nullableID stores 0 as NULL
+func nullableID(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func notificationEnabled(q queryRower, userID int, kind string) (bool, error) {
+	var enabled bool
+	err := q.QueryRow("SELECT enabled FROM notification_preferences WHERE user_id = ? AND type = ?", userID, kind).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	return enabled, err
+}
+
+// UnreadNotificationCount returns how many unread groups the navigation bar should show
+func UnreadNotificationCount(userID int) int {
+	var count int
+	err := DB.QueryRow(`
+		SELECT COUNT(*) FROM (
+			SELECT 1 FROM notifications n
+			WHERE n.user_id = ? AND n.read_at IS NULL AND `+notificationVisible+`
+			GROUP BY n.type, n.post_id, n.comment_id
+		)
+	`, userID).Scan(&count)
+	if err != nil {
+		log.Printf("Error counting notifications: %v", err)
+	}
+	return count
+}
+
+// getNotifications returns the user's notifications grouped by type and
+// target, newest first. Read and unread events are grouped separately.
+func getNotifications(userID int) ([]Notification, error) {
+	rows, err := DB.Query(`
+		SELECT MAX(n.id), n.type, n.post_id, COALESCE(n.comment_id, 0), p.title,
+			COUNT(DISTINCT n.actor_id), n.read_at IS NULL
+		FROM notifications n
+		JOIN posts p ON p.id = n.post_id
+		WHERE n.user_id = ? AND `+notificationVisible+`
+		GROUP BY n.type, n.post_id, n.comment_id, n.read_at IS NULL
+		ORDER BY MAX(n.id) DESC
+		LIMIT ?
+	`, userID, notificationPageSize)
+	if err != nil {
+		return nil, err
+	}
+	var notifications []Notification
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.Type, &n.PostID, &n.CommentID, &n.PostTitle, &n.Count, &n.Unread); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The newest event of each group names who acted last and when
+	for i := range notifications {
+		n := &notifications[i]
+		err := DB.QueryRow(`
+			SELECT u.username, n.created_at FROM notifications n
+			JOIN users u ON u.id = n.actor_id
+			WHERE n.id = ?
+		`, n.ID).Scan(&n.Actor, &n.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return notifications, nil
+}
+
+// markNotificationRead marks every unread event in the group of notification
+// id as read and returns the group, or sql.ErrNoRows if it is not the user's
+func markNotificationRead(userID, id int) (Notification, error) {
+	var n Notification
+	err := DB.QueryRow(`
+		SELECT type, post_id, COALESCE(comment_id, 0) FROM notifications WHERE id = ? AND user_id = ?
+	`, id, userID).Scan(&n.Type, &n.PostID, &n.CommentID)
+	if err != nil {
+		return n, err
+	}
+	_, err = DB.Exec(`
+		UPDATE notifications SET read_at = ?
+		WHERE user_id = ? AND type = ? AND post_id = ? AND comment_id IS ? AND read_at IS NULL
+	`, time.Now(), userID, n.Type, n.PostID, nullableID(n.CommentID))
+	return n, err
+}
+
+func markAllNotificationsRead(userID int) error {
+	_, err := DB.Exec("UPDATE notifications SET read_at = ? WHERE user_id = ? AND read_at IS NULL", time.Now(), userID)
+	return err
+}
+
+// NotificationsHandler lists the user's notifications and their preferences
+func NotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	notifications, err := getNotifications(user.ID)
+	if err != nil {
+		log.Printf("Error fetching notifications: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	type preference struct {
+		Type    string
+		Label   string
+		Enabled bool
+	}
+	var preferences []preference
+	for _, t := range notificationTypes {
+		enabled, err := notificationEnabled(DB, user.ID, t.Type)
+		if err != nil {
+			log.Printf("Error fetching notification preferences: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+		preferences = append(preferences, preference{t.Type, t.Label, enabled})
+	}
+
+	data := map[string]interface{}{
+		"LoggedIn":            true,
+		"Username":            user.Username,
+		"UnreadNotifications": UnreadNotificationCount(user.ID),
+		"UnreadMessages":      UnreadMessageCount(user.ID),
+		"Notifications":       notifications,
+		"Preferences":         preferences,
+	}
+	if r.URL.Query().Get("saved") == "1" {
+		data["Success"] = "Notification preferences saved."
+	}
+	if err := RenderTemplate(w, "notifications.html", data); err != nil {
+		log.Printf("Error rendering notifications: %v", err)
+		Error500Handler(w, r)
+	}
+}
+
+// OpenNotificationHandler marks a notification group as read and goes to the post or comment
+func OpenNotificationHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+
+	n, err := markNotificationRead(user.ID, id)
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error marking notification read: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	http.Redirect(w, r, n.Link(), http.StatusSeeOther)
+}
+
+// MarkNotificationsReadHandler marks all of the user's notifications as read
+func MarkNotificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := markAllNotificationsRead(user.ID); err != nil {
+		log.Printf("Error marking notifications read: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+}
+
+// NotificationPreferencesHandler saves which notification types the user wants
+func NotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		Error400Handler(w, r)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		log.Printf("Error saving notification preferences: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	defer tx.Rollback()
+
+	for _, t := range notificationTypes {
+		_, err = tx.Exec(`
+			INSERT INTO notification_preferences (user_id, type, enabled) VALUES (?, ?, ?)
+			ON CONFLICT(user_id, type) DO UPDATE SET enabled = excluded.enabled
+		`, user.ID, t.Type, r.FormValue(t.Type) == "on")
+		if err != nil {
+			log.Printf("Error saving notification preferences: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error saving notification preferences: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	http.Redirect(w, r, "/notifications?saved=1", http.StatusSeeOther)
+}
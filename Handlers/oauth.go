@@ -0,0 +1,279 @@
+package RebootForums
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OAuthProvider describes an OAuth2 or OpenID Connect identity provider
+type OAuthProvider struct {
+	Name         string
+	DisplayName  string
+	ClientID     string
+	ClientSecret string
+	Issuer       string
+	AuthURL      string
+	TokenURL     string
+	UserInfoURL  string
+	Scopes       []string
+}
+
+// OAuthIdentity is what we learn about a user from a provider
+type OAuthIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+}
+
+// oauthPresets are the providers we know how to talk to. "oidc" is the
+// generic OpenID Connect provider whose endpoints come from discovery.
+var oauthPresets = []OAuthProvider{
+	{
+		Name:        "github",
+		DisplayName: "GitHub",
+		AuthURL:     "https://github.com/login/oauth/authorize",
+		TokenURL:    "https://github.com/login/oauth/access_token",
+		UserInfoURL: "https://api.github.com/user",
+		Scopes:      []string{"read:user", "user:email"},
+	},
+	{
+		Name:        "google",
+		DisplayName: "Google",
+		Issuer:      "https://accounts.google.com",
+		Scopes:      []string{"openid", "email", "profile"},
+	},
+	{
+		Name:        "oidc",
+		DisplayName: "Company SSO",
+		Scopes:      []string{"openid", "email", "profile"},
+	},
+}
+
+// oauthHTTPClient is used for all calls to providers
+var oauthHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+func oauthSettingKey(provider, field string) string {
+	return "oauth_" + provider + "_" + field
+}
+
+// GetOAuthProviders returns the providers that are enabled and configured in site settings
+func GetOAuthProviders() []OAuthProvider {
+	var providers []OAuthProvider
+	for _, preset := range oauthPresets {
+		if p, ok := GetOAuthProvider(preset.Name); ok {
+			providers = append(providers, p)
+		}
+	}
+	return providers
+}
+
+// GetOAuthProvider loads a single provider's configuration from site settings
+func GetOAuthProvider(name string) (OAuthProvider, bool) {
+	for _, preset := range oauthPresets {
+		if preset.Name != name {
+			continue
+		}
+		p := preset
+		if !GetBoolSetting(oauthSettingKey(name, "enabled"), false) {
+			return p, false
+		}
+		p.ClientID = GetSetting(oauthSettingKey(name, "client_id"), "")
+		p.ClientSecret = GetSetting(oauthSettingKey(name, "client_secret"), "")
+		p.Issuer = GetSetting(oauthSettingKey(name, "issuer"), p.Issuer)
+		p.DisplayName = GetSetting(oauthSettingKey(name, "display_name"), p.DisplayName)
+		if p.ClientID == "" || (p.AuthURL == "" && p.Issuer == "") {
+			return p, false
+		}
+		return p, true
+	}
+	return OAuthProvider{}, false
+}
+
+// oauthCallbackURL is the redirect URI registered with providers
+func oauthCallbackURL(provider string) string {
+	return siteURL() + "/auth/" + provider + "/callback"
+}
+
+// discover fills in endpoints from the issuer's OpenID Connect discovery document
+func (p *OAuthProvider) discover() error {
+	if p.Issuer == "" || (p.AuthURL != "" && p.TokenURL != "" && p.UserInfoURL != "") {
+		return nil
+	}
+	resp, err := oauthHTTPClient.Get(strings.TrimRight(p.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("discovery returned status %d", resp.StatusCode)
+	}
+
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&doc); err != nil {
+		return err
+	}
+	if strings.TrimRight(doc.Issuer, "/") != strings.TrimRight(p.Issuer, "/") {
+		return fmt.Errorf("discovery issuer %q does not match %q", doc.Issuer, p.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.UserinfoEndpoint == "" {
+		return errors.New("discovery document is missing endpoints")
+	}
+	p.AuthURL = doc.AuthorizationEndpoint
+	p.TokenURL = doc.TokenEndpoint
+	p.UserInfoURL = doc.UserinfoEndpoint
+	return nil
+}
+
+// newPKCE returns a random code verifier and its S256 challenge
+func newPKCE() (verifier, challenge string, err error) {
+	buf := make([]byte, 32)
+	if _, err = rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	verifier = base64.RawURLEncoding.EncodeToString(buf)
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// authCodeURL builds the URL the user is sent to at the provider
+func (p *OAuthProvider) authCodeURL(state, challenge string) string {
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.ClientID)
+	params.Set("redirect_uri", oauthCallbackURL(p.Name))
+	params.Set("scope", strings.Join(p.Scopes, " "))
+	params.Set("state", state)
+	params.Set("code_challenge", challenge)
+	params.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+	return p.AuthURL + sep + params.Encode()
+}
+
+// exchange trades an authorization code for an access token
+func (p *OAuthProvider) exchange(code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", oauthCallbackURL(p.Name))
+	form.Set("client_id", p.ClientID)
+	form.Set("client_secret", p.ClientSecret)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest(http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := oauthHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.Error != "" {
+		return "", fmt.Errorf("token endpoint error: %s %s", token.Error, token.Description)
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return "", fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+	}
+	return token.AccessToken, nil
+}
+
+// fetchIdentity asks the provider who the access token belongs to
+func (p *OAuthProvider) fetchIdentity(accessToken string) (OAuthIdentity, error) {
+	var claims map[string]interface{}
+	if err := oauthGetJSON(p.UserInfoURL, accessToken, &claims); err != nil {
+		return OAuthIdentity{}, err
+	}
+
+	var id OAuthIdentity
+	if p.Name == "github" {
+		// GitHub is plain OAuth2: its user API uses a numeric id and login
+		if n, ok := claims["id"].(float64); ok {
+			id.Subject = strconv.FormatInt(int64(n), 10)
+		}
+		id.Username, _ = claims["login"].(string)
+		id.Email, id.EmailVerified = githubPrimaryEmail(accessToken)
+	} else {
+		id.Subject, _ = claims["sub"].(string)
+		id.Email, _ = claims["email"].(string)
+		id.EmailVerified, _ = claims["email_verified"].(bool)
+		id.Username, _ = claims["preferred_username"].(string)
+		if id.Username == "" {
+			id.Username, _ = claims["name"].(string)
+		}
+	}
+
+	if id.Subject == "" {
+		return id, errors.New("provider did not return a subject")
+	}
+	return id, nil
+}
+
+// githubPrimaryEmail returns the user's primary verified email, which the
+// user API omits when the address is private
+func githubPrimaryEmail(accessToken string) (string, bool) {
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := oauthGetJSON("https://api.github.com/user/emails", accessToken, &emails); err != nil {
+		return "", false
+	}
+	for _, e := range emails {
+		if e.Primary {
+			return e.Email, e.Verified
+		}
+	}
+	return "", false
+}
+
+func oauthGetJSON(endpoint, accessToken string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := oauthHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", endpoint, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
@@ -0,0 +1,569 @@
+package RebootForums
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	oauthStateCookie = "oauth_state"
+	oauthStateTTL    = 10 * time.Minute
+)
+
+// LinkedIdentity is an external account attached to a local user
+type LinkedIdentity struct {
+	ID          int
+	Provider    string
+	DisplayName string
+	Email       string
+	CreatedAt   time.Time
+}
+
+var usernameUnsafeChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// OAuthLoginHandler redirects the browser to the provider's consent page.
+// Logged in users can pass ?link=1 to attach the identity to their account,
+// or ?reauth=1 to prove it is them before a sensitive settings change.
+func OAuthLoginHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := GetOAuthProvider(r.PathValue("provider"))
+	if !ok {
+		Error404Handler(w, r)
+		return
+	}
+	if err := provider.discover(); err != nil {
+		log.Printf("Error discovering %s endpoints: %v", provider.Name, err)
+		renderLogin(w, r, provider.DisplayName+" sign-in is currently unavailable.", true)
+		return
+	}
+
+	var linkUserID *int
+	reauth := r.URL.Query().Get("reauth") == "1"
+	if r.URL.Query().Get("link") == "1" || reauth {
+		user, err := GetUserFromSession(r)
+		if err != nil || user == nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		linkUserID = &user.ID
+	}
+
+	state, err := generateSessionToken()
+	if err != nil {
+		log.Printf("Error generating OAuth state: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	verifier, challenge, err := newPKCE()
+	if err != nil {
+		log.Printf("Error generating PKCE verifier: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	expiry := time.Now().Add(oauthStateTTL)
+	_, err = DB.Exec("INSERT INTO oauth_states (state, provider, verifier, link_user_id, reauth, expiry) VALUES (?, ?, ?, ?, ?, ?)",
+		state, provider.Name, verifier, linkUserID, reauth, expiry)
+	if err != nil {
+		log.Printf("Error storing OAuth state: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	// Bind the state to this browser so a callback started elsewhere is rejected
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Expires:  expiry,
+		Path:     "/auth/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, provider.authCodeURL(state, challenge), http.StatusSeeOther)
+}
+
+// OAuthCallbackHandler completes the authorization code flow and logs the user in
+func OAuthCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := GetOAuthProvider(r.PathValue("provider"))
+	if !ok {
+		Error404Handler(w, r)
+		return
+	}
+
+	if errCode := r.URL.Query().Get("error"); errCode != "" {
+		renderLogin(w, r, provider.DisplayName+" sign-in was cancelled.", true)
+		return
+	}
+
+	state := r.URL.Query().Get("state")
+	c, err := r.Cookie(oauthStateCookie)
+	if err != nil || state == "" || c.Value != state {
+		Error400Handler(w, r)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Value: "", Path: "/auth/", MaxAge: -1})
+
+	verifier, linkUserID, reauth, err := consumeOAuthState(state, provider.Name)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error loading OAuth state: %v", err)
+		}
+		renderLogin(w, r, "Your sign-in attempt expired. Please try again.", true)
+		return
+	}
+
+	if err := provider.discover(); err != nil {
+		log.Printf("Error discovering %s endpoints: %v", provider.Name, err)
+		renderLogin(w, r, provider.DisplayName+" sign-in is currently unavailable.", true)
+		return
+	}
+	accessToken, err := provider.exchange(r.URL.Query().Get("code"), verifier)
+	if err != nil {
+		log.Printf("Error exchanging %s code: %v", provider.Name, err)
+		renderLogin(w, r, "Could not complete sign-in with "+provider.DisplayName+".", true)
+		return
+	}
+	identity, err := provider.fetchIdentity(accessToken)
+	if err != nil {
+		log.Printf("Error fetching %s identity: %v", provider.Name, err)
+		renderLogin(w, r, "Could not complete sign-in with "+provider.DisplayName+".", true)
+		return
+	}
+
+	if reauth {
+		completeReauth(w, r, int(linkUserID.Int64), provider.Name, identity)
+		return
+	}
+
+	if linkUserID.Valid {
+		err = linkIdentity(int(linkUserID.Int64), provider.Name, identity)
+		if err != nil {
+			log.Printf("Error linking %s identity: %v", provider.Name, err)
+			http.Redirect(w, r, "/settings/accounts?error=linked_elsewhere", http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/settings/accounts?linked=1", http.StatusSeeOther)
+		return
+	}
+
+	userID, msg, err := resolveOAuthUser(provider.Name, identity)
+	if err != nil {
+		log.Printf("Error resolving %s user: %v", provider.Name, err)
+		renderLogin(w, r, "An error occurred. Please try again later.", true)
+		return
+	}
+	if msg != "" {
+		renderLogin(w, r, msg, true)
+		return
+	}
+
+	user, err := GetUserByID(userID)
+	if err != nil {
+		log.Printf("Error loading user after OAuth login: %v", err)
+		renderLogin(w, r, "An error occurred. Please try again later.", true)
+		return
+	}
+
+	refusal, err := loginRefusal(user.ID, clientIP(r))
+	if err != nil {
+		log.Printf("Error checking bans: %v", err)
+		renderLogin(w, r, "An error occurred. Please try again later.", true)
+		return
+	}
+	if refusal != "" {
+		w.WriteHeader(http.StatusForbidden)
+		renderLogin(w, r, refusal, true)
+		return
+	}
+
+	// An external login replaces the password, not the second factor
+	if user.TOTPEnabled {
+		if err := createPendingLogin(w, r, user.ID); err != nil {
+			log.Printf("Error creating pending login: %v", err)
+			renderLogin(w, r, "An error occurred. Please try again later.", true)
+			return
+		}
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return
+	}
+
+	if err := startUserSession(w, r, user.ID); err != nil {
+		log.Printf("Error creating session: %v", err)
+		renderLogin(w, r, "An error occurred. Please try again later.", true)
+		return
+	}
+
+	if staffNeeds2FA(user) {
+		http.Redirect(w, r, "/settings/2fa?required=1", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// LinkedAccountsHandler lists the external identities attached to the user's account
+func LinkedAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	identities, err := getLinkedIdentities(user.ID)
+	if err != nil {
+		log.Printf("Error fetching linked identities: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	data := map[string]interface{}{
+		"LoggedIn":   true,
+		"Username":   user.Username,
+		"Identities": identities,
+		"Providers":  GetOAuthProviders(),
+	}
+	switch {
+	case r.URL.Query().Get("linked") == "1":
+		data["Success"] = "Account linked."
+	case r.URL.Query().Get("unlinked") == "1":
+		data["Success"] = "Account unlinked."
+	case r.URL.Query().Get("error") == "linked_elsewhere":
+		data["Message"] = "That account is already linked to another user."
+	case r.URL.Query().Get("error") == "last_login":
+		data["Message"] = "You need a password or another linked account before you can unlink this one."
+	}
+
+	err = RenderTemplate(w, "linked-accounts.html", data)
+	if err != nil {
+		Error500Handler(w, r)
+	}
+}
+
+// UnlinkAccountHandler detaches an external identity, as long as the user can still log in
+func UnlinkAccountHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	identityID, err := strconv.Atoi(r.FormValue("identity_id"))
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+
+	var hasPassword bool
+	var identityCount int
+	err = DB.QueryRow(`
+		SELECT u.has_password, (SELECT COUNT(*) FROM user_identities WHERE user_id = u.id)
+		FROM users u WHERE u.id = ?
+	`, user.ID).Scan(&hasPassword, &identityCount)
+	if err != nil {
+		log.Printf("Error checking login methods: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	if !hasPassword && identityCount <= 1 {
+		http.Redirect(w, r, "/settings/accounts?error=last_login", http.StatusSeeOther)
+		return
+	}
+
+	_, err = DB.Exec("DELETE FROM user_identities WHERE id = ? AND user_id = ?", identityID, user.ID)
+	if err != nil {
+		log.Printf("Error unlinking identity: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	http.Redirect(w, r, "/settings/accounts?unlinked=1", http.StatusSeeOther)
+}
+
+// AdminOAuthSettingsHandler saves the OAuth provider configuration
+func AdminOAuthSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, true)
+	if !ok {
+		return
+	}
+
+	keys := []string{SettingSiteURL}
+	for _, preset := range oauthPresets {
+		for _, field := range []string{"enabled", "client_id", "client_secret", "issuer", "display_name"} {
+			keys = append(keys, oauthSettingKey(preset.Name, field))
+		}
+	}
+	before := settingsSnapshot(keys...)
+
+	if siteURL := strings.TrimSpace(r.FormValue("site_url")); siteURL != "" {
+		if err := SetSetting(SettingSiteURL, siteURL); err != nil {
+			log.Printf("Error saving settings: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+	}
+
+	for _, preset := range oauthPresets {
+		values := map[string]string{
+			"enabled":      strconv.FormatBool(r.FormValue(oauthSettingKey(preset.Name, "enabled")) == "on"),
+			"client_id":    strings.TrimSpace(r.FormValue(oauthSettingKey(preset.Name, "client_id"))),
+			"issuer":       strings.TrimSpace(r.FormValue(oauthSettingKey(preset.Name, "issuer"))),
+			"display_name": strings.TrimSpace(r.FormValue(oauthSettingKey(preset.Name, "display_name"))),
+		}
+		// Leaving the secret blank keeps the stored one
+		if secret := strings.TrimSpace(r.FormValue(oauthSettingKey(preset.Name, "client_secret"))); secret != "" {
+			values["client_secret"] = secret
+		}
+		for field, value := range values {
+			if value == "" && field != "client_id" {
+				continue
+			}
+			if err := SetSetting(oauthSettingKey(preset.Name, field), value); err != nil {
+				log.Printf("Error saving settings: %v", err)
+				Error500Handler(w, r)
+				return
+			}
+		}
+	}
+	recordSettingsChange(user, clientIP(r), before, settingsSnapshot(keys...))
+
+	http.Redirect(w, r, "/admin?saved=1", http.StatusSeeOther)
+}
+
+// OAuthProviderSettings is the admin form view of one provider
+type OAuthProviderSettings struct {
+	Name            string
+	DisplayName     string
+	Enabled         bool
+	ClientID        string
+	HasClientSecret bool
+	Issuer          string
+	NeedsIssuer     bool
+}
+
+func getOAuthProviderSettings() []OAuthProviderSettings {
+	var settings []OAuthProviderSettings
+	for _, preset := range oauthPresets {
+		settings = append(settings, OAuthProviderSettings{
+			Name:            preset.Name,
+			DisplayName:     GetSetting(oauthSettingKey(preset.Name, "display_name"), preset.DisplayName),
+			Enabled:         GetBoolSetting(oauthSettingKey(preset.Name, "enabled"), false),
+			ClientID:        GetSetting(oauthSettingKey(preset.Name, "client_id"), ""),
+			HasClientSecret: GetSetting(oauthSettingKey(preset.Name, "client_secret"), "") != "",
+			Issuer:          GetSetting(oauthSettingKey(preset.Name, "issuer"), preset.Issuer),
+			NeedsIssuer:     preset.AuthURL == "",
+		})
+	}
+	return settings
+}
+
+// consumeOAuthState loads and deletes a pending authorization request
+func consumeOAuthState(state, provider string) (verifier string, linkUserID sql.NullInt64, reauth bool, err error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return "", linkUserID, false, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("SELECT verifier, link_user_id, reauth FROM oauth_states WHERE state = ? AND provider = ? AND expiry > ?",
+		state, provider, time.Now()).Scan(&verifier, &linkUserID, &reauth)
+	if err != nil {
+		return "", linkUserID, false, err
+	}
+	_, err = tx.Exec("DELETE FROM oauth_states WHERE state = ? OR expiry < ?", state, time.Now())
+	if err != nil {
+		return "", linkUserID, false, err
+	}
+	return verifier, linkUserID, reauth, tx.Commit()
+}
+
+// completeReauth marks the browser's session as freshly authenticated when
+// the identity the provider returned is already linked to userID
+func completeReauth(w http.ResponseWriter, r *http.Request, userID int, provider string, identity OAuthIdentity) {
+	var owner int
+	err := DB.QueryRow("SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?", provider, identity.Subject).Scan(&owner)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error checking %s identity: %v", provider, err)
+		Error500Handler(w, r)
+		return
+	}
+	c, cookieErr := r.Cookie("session_token")
+	if err == sql.ErrNoRows || owner != userID || cookieErr != nil {
+		http.Redirect(w, r, "/settings?error=reauth", http.StatusSeeOther)
+		return
+	}
+	result, err := DB.Exec("UPDATE sessions SET reauthenticated_at = ? WHERE token = ? AND user_id = ?", time.Now(), c.Value, userID)
+	if err != nil {
+		log.Printf("Error recording reauthentication: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/settings?saved=reauth", http.StatusSeeOther)
+}
+
+// resolveOAuthUser finds the local user for an identity, linking it to an
+// existing account when both sides verified the same email, or creating a new
+// account.
+// A non-empty message means the login must be refused with that text.
+func resolveOAuthUser(provider string, identity OAuthIdentity) (int, string, error) {
+	var userID int
+	err := DB.QueryRow("SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?", provider, identity.Subject).Scan(&userID)
+	if err == nil {
+		return userID, "", nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, "", err
+	}
+
+	if identity.Email == "" {
+		return 0, "Your account did not share an email address, which we need to create your forum account.", nil
+	}
+
+	var localVerified bool
+	err = DB.QueryRow("SELECT id, email_verified FROM users WHERE LOWER(email) = LOWER(?)", identity.Email).Scan(&userID, &localVerified)
+	if err == nil {
+		// Both sides must have proven they own the address. Registration does not
+		// check emails, so anyone could have signed up with someone else's.
+		if !identity.EmailVerified || !localVerified {
+			return 0, "An account with this email already exists. Log in with your password and link this account from your settings.", nil
+		}
+		return userID, "", linkIdentity(userID, provider, identity)
+	}
+	if err != sql.ErrNoRows {
+		return 0, "", err
+	}
+
+	userID, err = createOAuthUser(provider, identity)
+	return userID, "", err
+}
+
+// createOAuthUser creates a local account without a usable password for a first-time external login
+func createOAuthUser(provider string, identity OAuthIdentity) (int, error) {
+	// Another signup can take the chosen name before the insert, so pick again
+	for attempt := 1; ; attempt++ {
+		username, err := uniqueUsername(identity.Username, provider)
+		if err != nil {
+			return 0, err
+		}
+		userID, err := insertOAuthUser(provider, identity, username)
+		if isUsernameConflict(err) && attempt < 3 {
+			continue
+		}
+		return userID, err
+	}
+}
+
+// insertOAuthUser adds the account and its linked identity
+func insertOAuthUser(provider string, identity OAuthIdentity, username string) (int, error) {
+	// Store a hash of random bytes so the password column stays valid but can never match
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return 0, err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(hex.EncodeToString(random)), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO users (username, username_key, email, email_verified, password, has_password, created_at) VALUES (?, ?, ?, ?, ?, 0, ?)",
+		username, UsernameKey(username), identity.Email, identity.EmailVerified, string(hashedPassword), time.Now())
+	if err != nil {
+		return 0, err
+	}
+	userID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("INSERT INTO user_identities (user_id, provider, subject, email, created_at) VALUES (?, ?, ?, ?, ?)",
+		userID, provider, identity.Subject, identity.Email, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return int(userID), tx.Commit()
+}
+
+// uniqueUsername derives an unused, valid username from the provider's suggestion
+func uniqueUsername(suggested, provider string) (string, error) {
+	// Only ASCII is left, so bytes and characters are the same length
+	base := strings.Trim(usernameUnsafeChars.ReplaceAllString(suggested, "_"), "_")
+	if len(base) > MaxUsernameLength {
+		base = base[:MaxUsernameLength]
+	}
+	if len(base) < MinUsernameLength {
+		base = provider + "_user"
+	}
+
+	candidate := base
+	for i := 2; ; i++ {
+		taken, err := usernameTaken(candidate, 0)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return candidate, nil
+		}
+		suffix := strconv.Itoa(i)
+		candidate = base[:min(len(base), MaxUsernameLength-len(suffix))] + suffix
+	}
+}
+
+// linkIdentity attaches an identity to a user. It fails if the identity already belongs to someone else.
+func linkIdentity(userID int, provider string, identity OAuthIdentity) error {
+	var owner int
+	err := DB.QueryRow("SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?", provider, identity.Subject).Scan(&owner)
+	if err == nil {
+		if owner != userID {
+			return fmt.Errorf("%s identity %s is linked to user %d", provider, identity.Subject, owner)
+		}
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	_, err = DB.Exec("INSERT INTO user_identities (user_id, provider, subject, email, created_at) VALUES (?, ?, ?, ?, ?)",
+		userID, provider, identity.Subject, identity.Email, time.Now())
+	return err
+}
+
+func getLinkedIdentities(userID int) ([]LinkedIdentity, error) {
+	rows, err := DB.Query("SELECT id, provider, COALESCE(email, ''), created_at FROM user_identities WHERE user_id = ? ORDER BY created_at", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []LinkedIdentity
+	for rows.Next() {
+		var li LinkedIdentity
+		if err := rows.Scan(&li.ID, &li.Provider, &li.Email, &li.CreatedAt); err != nil {
+			return nil, err
+		}
+		li.DisplayName = li.Provider
+		for _, preset := range oauthPresets {
+			if preset.Name == li.Provider {
+				li.DisplayName = GetSetting(oauthSettingKey(preset.Name, "display_name"), preset.DisplayName)
+			}
+		}
+		identities = append(identities, li)
+	}
+	return identities, nil
+}
@@ -3,7 +3,9 @@ package RebootForums
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"strconv"
 	"strings"
@@ -28,6 +30,12 @@ func displayCreatePostForm(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	renderCreatePostForm(w, r, user, nil)
+}
+
+// renderCreatePostForm shows the new post form. When errs is set the form is
+// shown again with what the user already entered.
+func renderCreatePostForm(w http.ResponseWriter, r *http.Request, user *User, errs ValidationErrors) {
 	categories, err := GetAllCategories()
 	if err != nil {
 		log.Printf("Error fetching categories: %v", err)
@@ -35,16 +43,45 @@ func displayCreatePostForm(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	maxFile, maxPost := attachmentLimits()
+	selected := make(map[int]bool)
+	for _, id := range r.Form["categories"] {
+		if catID, err := strconv.Atoi(id); err == nil {
+			selected[catID] = true
+		}
+	}
+
 	data := struct {
-		Username   string
-		Categories []Category
-		LoggedIn   bool
+		Username            string
+		Categories          []Category
+		LoggedIn            bool
+		Title               string
+		Content             string
+		Selected            map[int]bool
+		MaxAttachments      int
+		MaxAttachmentSize   string
+		MaxPostUploadSize   string
+		Errors              ValidationErrors
+		UnreadNotifications int
+		UnreadMessages      int
 	}{
-		Username:   user.Username,
-		Categories: categories,
-		LoggedIn:   true,
+		Username:            user.Username,
+		Categories:          categories,
+		LoggedIn:            true,
+		Title:               r.FormValue("title"),
+		Content:             r.FormValue("content"),
+		Selected:            selected,
+		MaxAttachments:      MaxAttachmentsPerPost,
+		MaxAttachmentSize:   formatBytes(maxFile),
+		MaxPostUploadSize:   formatBytes(maxPost),
+		Errors:              errs,
+		UnreadNotifications: UnreadNotificationCount(user.ID),
+		UnreadMessages:      UnreadMessageCount(user.ID),
+	}
+
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
 	}
-
 	err = RenderTemplate(w, "create-post.html", data)
 	if err != nil {
 		log.Printf("Error rendering create-post template: %v", err)
@@ -59,6 +96,26 @@ func handleCreatePost(w http.ResponseWriter, r *http.Request) {
 		Error400Handler(w, r)
 		return
 	}
+	if !requireWritable(w, r, user) {
+		return
+	}
+
+	// Leave room for the text fields and the multipart envelope around the files
+	_, maxPost := attachmentLimits()
+	r.Body = http.MaxBytesReader(w, r.Body, maxPost+1<<20)
+	err = r.ParseMultipartForm(8 << 20)
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		renderCreatePostForm(w, r, user, ValidationErrors{"attachments": "Attachments can be at most " + formatBytes(maxPost) + " per post"})
+		return
+	}
+	if err != nil && err != http.ErrNotMultipart {
+		Error400Handler(w, r)
+		return
+	}
 
 	title := strings.TrimSpace(r.FormValue("title"))
 	content := strings.TrimSpace(r.FormValue("content"))
@@ -89,17 +146,61 @@ func handleCreatePost(w http.ResponseWriter, r *http.Request) {
 		categories = append(categories, catID)
 	}
 
-	postID, err := createPost(user.ID, title, content, categories)
+	var files []*multipart.FileHeader
+	if r.MultipartForm != nil {
+		files = r.MultipartForm.File["attachments"]
+	}
+	uploads, errs := readAttachments(files)
+	if len(errs) > 0 {
+		renderCreatePostForm(w, r, user, errs)
+		return
+	}
+
+	submission, verdict, reasons, err := screenSubmission(user, "post", title, content)
+	if err != nil {
+		log.Printf("Error screening post: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	if verdict == VerdictReject {
+		renderCreatePostForm(w, r, user, ValidationErrors{"content": "Your post was not published because it " + reasons[0].Reason + "."})
+		return
+	}
+
+	attachments, err := storeAttachments(user.ID, uploads)
+	if err != nil {
+		log.Printf("Error storing attachments: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	if verdict == VerdictHold {
+		err = holdContent(HeldItem{Kind: "post", UserID: user.ID, Title: title, Content: content,
+			Categories: categories, Attachments: attachments, Reasons: reasons, IP: clientIP(r)})
+		if err != nil {
+			log.Printf("Error holding post: %v", err)
+			deleteAttachmentBlobs(attachments)
+			Error500Handler(w, r)
+			return
+		}
+		recordFingerprint(submission)
+		http.Redirect(w, r, "/?held=1", http.StatusSeeOther)
+		return
+	}
+
+	postID, err := createPost(user.ID, title, content, categories, attachments)
 	if err != nil {
 		log.Printf("Error creating post: %v", err)
+		deleteAttachmentBlobs(attachments)
 		Error500Handler(w, r)
 		return
 	}
+	recordFingerprint(submission)
 
 	http.Redirect(w, r, "/post/"+strconv.Itoa(postID), http.StatusSeeOther)
 }
 
-func createPost(userID int, title, content string, categories []int) (int, error) {
+func createPost(userID int, title, content string, categories []int, attachments []Attachment) (int, error) {
 	tx, err := DB.Begin()
 	if err != nil {
 		return 0, err
@@ -126,7 +227,30 @@ func createPost(userID int, title, content string, categories []int) (int, error
 		}
 	}
 
-	return int(postID), tx.Commit()
+	for _, a := range attachments {
+		var thumbKey interface{}
+		if a.ThumbKey != "" {
+			thumbKey = a.ThumbKey
+		}
+		_, err = tx.Exec(`
+			INSERT INTO attachments (post_id, user_id, blob_key, thumb_key, filename, content_type, size, width, height, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, postID, userID, a.BlobKey, thumbKey, a.Filename, a.ContentType, a.Size, a.Width, a.Height, time.Now())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	mentioned, err := recordMentions(tx, userID, int(postID), 0, content)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	go notifyMentions(userID, int(postID), 0, mentioned)
+	return int(postID), nil
 }
 
 func ViewPostHandler(w http.ResponseWriter, r *http.Request) {
@@ -153,36 +277,93 @@ func ViewPostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	comments, err := getCommentsByPostID(postID)
+	attachments, err := getPostAttachments(postID)
 	if err != nil {
-		log.Printf("Error fetching comments: %v", err)
-		comments = []Comment{}
+		log.Printf("Error fetching attachments: %v", err)
+		Error500Handler(w, r)
+		return
 	}
 
 	user, err := GetUserFromSession(r)
 	loggedIn := err == nil && user != nil
 	var username string
-	var isAuthor bool
+	var isAuthor, blockedByAuthor, isStaff bool
+	var categoryPins []CategoryPin
+	var unread, unreadMessages int
+	var viewerID int
+	mutedAuthors := []string{}
 
 	if loggedIn {
+		viewerID = user.ID
 		username = user.Username
 		isAuthor = user.Username == post.Author
+		isStaff = actingStaff(user)
+		unread = UnreadNotificationCount(user.ID)
+		unreadMessages = UnreadMessageCount(user.ID)
+		blockedByAuthor, err = hasBlocked(DB, post.AuthorID, user.ID)
+		if err != nil {
+			log.Printf("Error checking block: %v", err)
+		}
+		muted, err := getMutedUsers(user.ID)
+		if err != nil {
+			log.Printf("Error fetching muted users: %v", err)
+		}
+		for _, m := range muted {
+			mutedAuthors = append(mutedAuthors, m.Username)
+		}
+		if isStaff {
+			categoryPins, err = getCategoryPins(postID)
+			if err != nil {
+				log.Printf("Error fetching category pins: %v", err)
+			}
+		}
+	}
+
+	comments, err := getCommentsByPostID(postID, viewerID)
+	if err != nil {
+		log.Printf("Error fetching comments: %v", err)
+		comments = []Comment{}
+	}
+
+	mutedJSON, err := json.Marshal(mutedAuthors)
+	if err != nil {
+		log.Printf("Error encoding muted users: %v", err)
 	}
 
 	data := struct {
-		Post       Post
-		Categories []string
-		Comments   []Comment
-		IsAuthor   bool
-		LoggedIn   bool
-		Username   string
+		Post                Post
+		Categories          []string
+		Comments            []Comment
+		Attachments         []Attachment
+		IsAuthor            bool
+		IsStaff             bool
+		CategoryPins        []CategoryPin
+		BlockedByAuthor     bool
+		MutedAuthors        string
+		ReportReasons       map[string]string
+		Reported            bool
+		Held                bool
+		LoggedIn            bool
+		Username            string
+		UnreadNotifications int
+		UnreadMessages      int
 	}{
-		Post:       post,
-		Categories: categories,
-		Comments:   comments,
-		IsAuthor:   isAuthor,
-		LoggedIn:   loggedIn,
-		Username:   username,
+		Post:                post,
+		Categories:          categories,
+		Comments:            comments,
+		Attachments:         attachments,
+		IsAuthor:            isAuthor,
+		IsStaff:             isStaff,
+		CategoryPins:        categoryPins,
+		BlockedByAuthor:     blockedByAuthor,
+		MutedAuthors:        string(mutedJSON),
+		ReportReasons:       reportReasons,
+		Reported:            r.URL.Query().Get("reported") == "1",
+		Held:                r.URL.Query().Get("held") == "1",
+		LoggedIn:            loggedIn,
+		Username:            username,
+		UnreadNotifications: unread,
+		UnreadMessages:      unreadMessages,
 	}
 
 	err = RenderTemplate(w, "view-post.html", data)
@@ -195,11 +376,13 @@ func ViewPostHandler(w http.ResponseWriter, r *http.Request) {
 
 func getPost(postID int) (Post, error) {
 	var post Post
+	var avatarKey string
 	var likes, dislikes sql.NullInt64
 
 	err := DB.QueryRow(`
-        SELECT p.id, p.title, p.content, u.username, p.created_at,
-               COALESCE(l.likes, 0) as likes, COALESCE(l.dislikes, 0) as dislikes
+        SELECT p.id, p.title, p.content, u.username, u.id, COALESCE(u.avatar_key, ''), p.created_at,
+               COALESCE(l.likes, 0) as likes, COALESCE(l.dislikes, 0) as dislikes,
+               p.pinned, p.locked, p.announcement
         FROM posts p
         JOIN users u ON p.user_id = u.id
         LEFT JOIN (
@@ -210,16 +393,17 @@ func getPost(postID int) (Post, error) {
             WHERE post_id = ?
             GROUP BY post_id
         ) l ON p.id = l.post_id
-        WHERE p.id = ?
+        WHERE p.id = ? AND p.deleted_at IS NULL
     `, postID, postID).Scan(
-		&post.ID, &post.Title, &post.Content, &post.Author, &post.CreatedAt,
-		&likes, &dislikes,
+		&post.ID, &post.Title, &post.Content, &post.Author, &post.AuthorID, &avatarKey, &post.CreatedAt,
+		&likes, &dislikes, &post.Pinned, &post.Locked, &post.Announcement,
 	)
 
 	if err != nil {
 		return post, err
 	}
 
+	post.AvatarURL = AvatarURL(post.AuthorID, avatarKey, AvatarSizeMedium)
 	post.Likes = int(likes.Int64)
 	post.Dislikes = int(dislikes.Int64)
 
@@ -260,6 +444,9 @@ func LikePostHandler(w http.ResponseWriter, r *http.Request) {
 		Error400Handler(w, r)
 		return
 	}
+	if !requireWritable(w, r, user) {
+		return
+	}
 
 	postID, err := strconv.Atoi(r.FormValue("post_id"))
 	if err != nil {
@@ -274,6 +461,10 @@ func LikePostHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	err = UpsertLike(user.ID, postID, isLike, true)
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	}
 	if err != nil {
 		log.Printf("Error upserting like: %v", err)
 		Error500Handler(w, r)
@@ -286,6 +477,7 @@ func LikePostHandler(w http.ResponseWriter, r *http.Request) {
 		Error500Handler(w, r)
 		return
 	}
+	publishVotes(postID, "post", postID, likes, dislikes)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]int{
@@ -305,6 +497,9 @@ func LikeCommentHandler(w http.ResponseWriter, r *http.Request) {
 		Error400Handler(w, r)
 		return
 	}
+	if !requireWritable(w, r, user) {
+		return
+	}
 
 	commentID, err := strconv.Atoi(r.FormValue("comment_id"))
 	if err != nil {
@@ -319,6 +514,10 @@ func LikeCommentHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	err = UpsertLike(user.ID, commentID, isLike, false)
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	}
 	if err != nil {
 		log.Printf("Error upserting comment like: %v", err)
 		Error500Handler(w, r)
@@ -332,6 +531,13 @@ func LikeCommentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var postID int
+	if err := DB.QueryRow("SELECT post_id FROM comments WHERE id = ?", commentID).Scan(&postID); err != nil {
+		log.Printf("Error fetching comment post: %v", err)
+	} else {
+		publishVotes(postID, "comment", commentID, likes, dislikes)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]int{
 		"likes":    likes,
@@ -386,7 +592,11 @@ func DeletePostHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var authorID int
-	err = DB.QueryRow("SELECT user_id FROM posts WHERE id = ?", postID).Scan(&authorID)
+	err = DB.QueryRow("SELECT user_id FROM posts WHERE id = ? AND deleted_at IS NULL", postID).Scan(&authorID)
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	}
 	if err != nil {
 		log.Printf("Error fetching post author: %v", err)
 		Error500Handler(w, r)
@@ -398,29 +608,61 @@ func DeletePostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = deletePost(postID)
+	err = softDeletePost(postID, user.ID)
 	if err != nil {
 		log.Printf("Error deleting post: %v", err)
 		Error500Handler(w, r)
 		return
 	}
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	http.Redirect(w, r, "/trash?deleted=post", http.StatusSeeOther)
 }
 
-func deletePost(postID int) error {
+// purgePost removes a post for good with its comments, held comments, likes,
+// mentions, notifications and attachments, and resolves the reports on them
+func purgePost(postID int) error {
+	attachments, err := getPostAttachments(postID)
+	if err != nil {
+		return err
+	}
+
 	tx, err := DB.Begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
+	// Open reports would otherwise stay in the queue pointing at nothing
+	_, err = tx.Exec(`
+		UPDATE reports SET resolved_at = ?, outcome = ?
+		WHERE resolved_at IS NULL AND ((target_type = ? AND target_id = ?)
+			OR (target_type = ? AND target_id IN (SELECT id FROM comments WHERE post_id = ?)))
+	`, time.Now(), OutcomeDeleted, ReportPost, postID, ReportComment, postID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM attachments WHERE post_id = ?", postID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM mentions WHERE post_id = ?", postID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM notifications WHERE post_id = ?", postID)
+	if err != nil {
+		return err
+	}
+
 	_, err = tx.Exec("DELETE FROM post_categories WHERE post_id = ?", postID)
 	if err != nil {
 		return err
 	}
 
-	_, err = tx.Exec("DELETE FROM likes WHERE post_id = ?", postID)
+	_, err = tx.Exec("DELETE FROM likes WHERE post_id = ? OR comment_id IN (SELECT id FROM comments WHERE post_id = ?)", postID, postID)
 	if err != nil {
 		return err
 	}
@@ -430,10 +672,20 @@ func deletePost(postID int) error {
 		return err
 	}
 
+	_, err = tx.Exec("DELETE FROM held_content WHERE post_id = ?", postID)
+	if err != nil {
+		return err
+	}
+
 	_, err = tx.Exec("DELETE FROM posts WHERE id = ?", postID)
 	if err != nil {
 		return err
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	// Only remove the files once the rows pointing at them are gone
+	deleteAttachmentBlobs(attachments)
+	return nil
 }
@@ -0,0 +1,187 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// ErrLocked is returned when commenting on a post a moderator locked
+var ErrLocked = errors.New("post is locked")
+
+// Announcement is a post shown in the site-wide banner
+type Announcement struct {
+	PostID int
+	Title  string
+}
+
+// CategoryPin is one of a post's categories and whether the post is pinned in it
+type CategoryPin struct {
+	ID     int
+	Name   string
+	Pinned bool
+}
+
+// postState is a post's moderation state as recorded in the audit log
+type postState struct {
+	Pinned       bool     `json:"pinned"`
+	PinnedIn     []string `json:"pinned_in"`
+	Locked       bool     `json:"locked"`
+	Announcement bool     `json:"announcement"`
+}
+
+// getAnnouncements returns the posts in the site-wide banner, newest first.
+// Pages call it from their templates, so an error only hides the banner.
+func getAnnouncements() []Announcement {
+	rows, err := DB.Query(`
+		SELECT id, title FROM posts
+		WHERE announcement = 1 AND deleted_at IS NULL
+		ORDER BY created_at DESC
+	`)
+	if err != nil {
+		log.Printf("Error fetching announcements: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var announcements []Announcement
+	for rows.Next() {
+		var a Announcement
+		if err := rows.Scan(&a.PostID, &a.Title); err != nil {
+			log.Printf("Error fetching announcements: %v", err)
+			return nil
+		}
+		announcements = append(announcements, a)
+	}
+	return announcements
+}
+
+// getCategoryPins returns the post's categories with their pin flags
+func getCategoryPins(postID int) ([]CategoryPin, error) {
+	rows, err := DB.Query(`
+		SELECT c.id, c.name, pc.pinned
+		FROM post_categories pc
+		JOIN categories c ON c.id = pc.category_id
+		WHERE pc.post_id = ?
+		ORDER BY c.name
+	`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pins []CategoryPin
+	for rows.Next() {
+		var p CategoryPin
+		if err := rows.Scan(&p.ID, &p.Name, &p.Pinned); err != nil {
+			return nil, err
+		}
+		pins = append(pins, p)
+	}
+	return pins, rows.Err()
+}
+
+func getPostState(postID int) (postState, error) {
+	var s postState
+	err := DB.QueryRow("SELECT pinned, locked, announcement FROM posts WHERE id = ? AND deleted_at IS NULL", postID).
+		Scan(&s.Pinned, &s.Locked, &s.Announcement)
+	if err != nil {
+		return s, err
+	}
+	pins, err := getCategoryPins(postID)
+	for _, p := range pins {
+		if p.Pinned {
+			s.PinnedIn = append(s.PinnedIn, p.Name)
+		}
+	}
+	return s, err
+}
+
+// ModPostStateHandler pins, locks or announces a post. Category pins can only
+// be set on the categories the post is in.
+func ModPostStateHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, false)
+	if !ok {
+		return
+	}
+
+	postID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+	before, err := getPostState(postID)
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching post state: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		Error400Handler(w, r)
+		return
+	}
+	var pinnedIn []int
+	for _, value := range r.Form["pin_category"] {
+		categoryID, err := strconv.Atoi(value)
+		if err != nil {
+			Error400Handler(w, r)
+			return
+		}
+		pinnedIn = append(pinnedIn, categoryID)
+	}
+
+	pins, err := getCategoryPins(postID)
+	if err != nil {
+		log.Printf("Error fetching post categories: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		log.Printf("Error updating post state: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE posts SET pinned = ?, locked = ?, announcement = ? WHERE id = ?",
+		r.FormValue("pinned") == "on", r.FormValue("locked") == "on", r.FormValue("announcement") == "on", postID)
+	for _, p := range pins {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec("UPDATE post_categories SET pinned = ? WHERE post_id = ? AND category_id = ?",
+			slices.Contains(pinnedIn, p.ID), postID, p.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error updating post state: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	after, err := getPostState(postID)
+	if err != nil {
+		log.Printf("Error fetching post state: %v", err)
+	} else if !slices.Equal(before.PinnedIn, after.PinnedIn) || before.Pinned != after.Pinned ||
+		before.Locked != after.Locked || before.Announcement != after.Announcement {
+		var title string
+		if err := DB.QueryRow("SELECT title FROM posts WHERE id = ?", postID).Scan(&title); err != nil {
+			log.Printf("Error fetching post title: %v", err)
+		}
+		recordAudit(user, clientIP(r), AuditEvent{Action: AuditPostState, TargetType: "post", TargetID: postID,
+			Target: title, Before: before, After: after})
+	}
+	http.Redirect(w, r, "/post/"+strconv.Itoa(postID), http.StatusSeeOther)
+}
@@ -0,0 +1,280 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Profile field limits
+const (
+	MaxBioLength      = 500
+	MaxLocationLength = 100
+	MaxWebsiteLength  = 200
+)
+
+// profilePostsPerPage is how many posts a profile page lists
+const profilePostsPerPage = 10
+
+// profileRecentComments is how many of the user's latest comments a profile shows
+const profileRecentComments = 5
+
+// UserProfile is the public information shown on /user/{username}
+type UserProfile struct {
+	ID            int
+	Username      string
+	Role          string
+	Bio           string
+	Location      string
+	Website       string
+	AvatarURL     string
+	JoinedAt      time.Time
+	Deleted       bool
+	PostCount     int
+	CommentCount  int
+	LikesReceived int
+}
+
+// ProfileComment is a comment listed on a profile, with the title of its post
+type ProfileComment struct {
+	Comment
+	PostTitle string
+}
+
+// ProfileFields holds the editable profile values
+type ProfileFields struct {
+	Bio      string
+	Location string
+	Website  string
+}
+
+// ProfileHandler shows a user's public profile
+func ProfileHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+
+	profile, err := getUserProfile(username)
+	if err != nil {
+		log.Printf("Error fetching profile: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	if profile == nil {
+		// Follow renamed users to their current name
+		current, err := currentUsernameFor(username)
+		if err != nil {
+			log.Printf("Error looking up username history: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+		if current == "" {
+			Error404Handler(w, r)
+			return
+		}
+		http.Redirect(w, r, "/user/"+url.PathEscape(current), http.StatusMovedPermanently)
+		return
+	}
+
+	viewer, _ := GetUserFromSession(r)
+	data := map[string]interface{}{
+		"LoggedIn": viewer != nil,
+		"Profile":  profile,
+		"IsOwner":  viewer != nil && viewer.ID == profile.ID,
+	}
+	if viewer != nil {
+		data["Username"] = viewer.Username
+		data["UnreadNotifications"] = UnreadNotificationCount(viewer.ID)
+		data["UnreadMessages"] = UnreadMessageCount(viewer.ID)
+		if viewer.ID != profile.ID {
+			blocked, err := hasBlocked(DB, viewer.ID, profile.ID)
+			if err != nil {
+				log.Printf("Error checking block: %v", err)
+			}
+			data["HasBlocked"] = blocked
+			muted, err := hasMuted(viewer.ID, profile.ID)
+			if err != nil {
+				log.Printf("Error checking mute: %v", err)
+			}
+			data["HasMuted"] = muted
+			data["ReportReasons"] = reportReasons
+			data["CanModerate"] = actingStaff(viewer)
+			data["Reported"] = r.URL.Query().Get("reported") == "1"
+		}
+	}
+
+	if profile.Deleted {
+		w.WriteHeader(http.StatusGone)
+		if err := RenderTemplate(w, "profile.html", data); err != nil {
+			log.Printf("Error rendering profile: %v", err)
+		}
+		return
+	}
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	totalPages := (profile.PostCount + profilePostsPerPage - 1) / profilePostsPerPage
+	if totalPages == 0 {
+		totalPages = 1
+	}
+	if page > totalPages {
+		Error404Handler(w, r)
+		return
+	}
+
+	posts, err := GetPostsByUserPage(profile.ID, profilePostsPerPage, (page-1)*profilePostsPerPage)
+	if err != nil {
+		log.Printf("Error fetching profile posts: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	comments, err := getRecentCommentsByUser(profile.ID, profileRecentComments)
+	if err != nil {
+		log.Printf("Error fetching profile comments: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	data["Posts"] = posts
+	data["Comments"] = comments
+	data["Page"] = page
+	data["TotalPages"] = totalPages
+	if page > 1 {
+		data["PrevPage"] = page - 1
+	}
+	if page < totalPages {
+		data["NextPage"] = page + 1
+	}
+
+	if err := RenderTemplate(w, "profile.html", data); err != nil {
+		Error500Handler(w, r)
+	}
+}
+
+// getUserProfile returns the profile for username, or nil if nobody has that name
+func getUserProfile(username string) (*UserProfile, error) {
+	var p UserProfile
+	var joinedAt, deletedAt sql.NullTime
+	var avatarKey string
+	err := DB.QueryRow(`
+		SELECT u.id, u.username, u.role, u.bio, u.location, u.website, COALESCE(u.avatar_key, ''), u.created_at, u.deleted_at,
+			(SELECT COUNT(*) FROM posts WHERE user_id = u.id AND deleted_at IS NULL),
+			(SELECT COUNT(*) FROM comments WHERE user_id = u.id AND deleted_at IS NULL),
+			(SELECT COUNT(*) FROM likes l WHERE l.is_like = 1 AND (
+				l.post_id IN (SELECT id FROM posts WHERE user_id = u.id AND deleted_at IS NULL) OR
+				l.comment_id IN (SELECT id FROM comments WHERE user_id = u.id AND deleted_at IS NULL)))
+		FROM users u WHERE u.username = ?
+	`, username).Scan(&p.ID, &p.Username, &p.Role, &p.Bio, &p.Location, &p.Website, &avatarKey, &joinedAt, &deletedAt,
+		&p.PostCount, &p.CommentCount, &p.LikesReceived)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.AvatarURL = AvatarURL(p.ID, avatarKey, AvatarSizeLarge)
+	p.JoinedAt = joinedAt.Time
+	p.Deleted = deletedAt.Valid
+	return &p, nil
+}
+
+// currentUsernameFor returns the current name of the user who most recently
+// gave up oldUsername, or "" if there is none or the account is gone
+func currentUsernameFor(oldUsername string) (string, error) {
+	var current string
+	err := DB.QueryRow(`
+		SELECT u.username FROM username_history h
+		JOIN users u ON u.id = h.user_id
+		WHERE h.username = ? AND u.deleted_at IS NULL
+		ORDER BY h.changed_at DESC LIMIT 1
+	`, oldUsername).Scan(&current)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return current, err
+}
+
+func getRecentCommentsByUser(userID, limit int) ([]ProfileComment, error) {
+	rows, err := DB.Query(`
+		SELECT c.id, c.post_id, c.content, c.created_at, p.title
+		FROM comments c
+		JOIN posts p ON p.id = c.post_id
+		WHERE c.user_id = ? AND c.deleted_at IS NULL AND p.deleted_at IS NULL
+		ORDER BY c.created_at DESC
+		LIMIT ?
+	`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var comments []ProfileComment
+	for rows.Next() {
+		var c ProfileComment
+		if err := rows.Scan(&c.ID, &c.PostID, &c.Content, &c.CreatedAt, &c.PostTitle); err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, nil
+}
+
+// getProfileFields returns the user's editable profile values
+func getProfileFields(userID int) (ProfileFields, error) {
+	var f ProfileFields
+	err := DB.QueryRow("SELECT bio, location, website FROM users WHERE id = ?", userID).Scan(&f.Bio, &f.Location, &f.Website)
+	return f, err
+}
+
+// updateProfile validates and stores the bio, location and website
+func updateProfile(user *User, bio, location, website string) ValidationErrors {
+	errs := ValidationErrors{}
+	bio = strings.TrimSpace(bio)
+	location = strings.TrimSpace(location)
+	website = strings.TrimSpace(website)
+
+	if utf8.RuneCountInString(bio) > MaxBioLength {
+		errs.Add("bio", "Bio must be at most 500 characters")
+	}
+	if utf8.RuneCountInString(location) > MaxLocationLength {
+		errs.Add("location", "Location must be at most 100 characters")
+	}
+	if website != "" {
+		if len(website) > MaxWebsiteLength {
+			errs.Add("website", "Website must be at most 200 characters")
+		} else if u, err := url.Parse(website); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.Add("website", "Website must be a full http:// or https:// address")
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	_, err := DB.Exec("UPDATE users SET bio = ?, location = ?, website = ? WHERE id = ?", bio, location, website, user.ID)
+	if err != nil {
+		log.Printf("Error updating profile: %v", err)
+		errs.Add("bio", "An error occurred. Please try again later.")
+	}
+	return errs
+}
+
+// BackfillUserCreatedAt estimates a join date for users created before the
+// column existed, using their earliest post or session
+func BackfillUserCreatedAt() error {
+	_, err := DB.Exec(`
+		UPDATE users SET created_at = COALESCE(
+			(SELECT MIN(created_at) FROM (
+				SELECT created_at FROM posts WHERE user_id = users.id
+				UNION ALL
+				SELECT created_at FROM sessions WHERE user_id = users.id
+			)),
+			CURRENT_TIMESTAMP)
+		WHERE created_at IS NULL
+	`)
+	return err
+}
@@ -0,0 +1,232 @@
+package RebootForums
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitPolicy allows Limit requests per user and IPLimit per client IP
+// in each Window. Buckets refill steadily, so a full bucket allows a burst of
+// Limit requests and then one every Window/Limit. A zero limit skips that key.
+type RateLimitPolicy struct {
+	Name    string
+	Action  string // what is limited, for error messages ("create posts")
+	Limit   int
+	IPLimit int
+	Window  time.Duration
+}
+
+// Rate limits for writes. IPs get more headroom because several users can
+// share one address.
+var (
+	PostRateLimit = RateLimitPolicy{Name: "posts", Action: "create posts",
+		Limit: 10, IPLimit: 30, Window: time.Hour}
+	CommentRateLimit = RateLimitPolicy{Name: "comments", Action: "comment",
+		Limit: 60, IPLimit: 180, Window: time.Hour}
+	VoteRateLimit = RateLimitPolicy{Name: "votes", Action: "vote",
+		Limit: 30, IPLimit: 120, Window: time.Minute}
+	RegisterRateLimit = RateLimitPolicy{Name: "register", Action: "create accounts",
+		IPLimit: 5, Window: time.Hour}
+	// A user may send 5 chat messages in a row, then one every 2 seconds
+	ChatRateLimit = RateLimitPolicy{Name: "chat", Action: "send messages",
+		Limit: 5, Window: 10 * time.Second}
+	// An IP address may load 20 CAPTCHAs in a row, then one every 30 seconds,
+	// so a flood of page views cannot push everyone else's challenges out
+	CaptchaRateLimit = RateLimitPolicy{Name: "captcha", Action: "load CAPTCHAs",
+		IPLimit: 20, Window: 10 * time.Minute}
+)
+
+// RateLimitResult is the state of a bucket after taking a token from it
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration // until the next token when not allowed
+	Reset      time.Duration // until the bucket is full again
+}
+
+// RateLimitStore keeps token buckets. The default store lives in memory; a
+// shared backend can be plugged in with SetRateLimitStore when running more
+// than one server.
+type RateLimitStore interface {
+	// Take removes a token from the bucket for key, which holds up to limit
+	// tokens and refills completely over window
+	Take(key string, limit int, window time.Duration, now time.Time) RateLimitResult
+}
+
+var (
+	rateLimitStore   RateLimitStore = newMemoryRateLimitStore()
+	rateLimitStoreMu sync.RWMutex
+)
+
+// SetRateLimitStore replaces the backend used for rate limiting
+func SetRateLimitStore(store RateLimitStore) {
+	rateLimitStoreMu.Lock()
+	rateLimitStore = store
+	rateLimitStoreMu.Unlock()
+}
+
+func getRateLimitStore() RateLimitStore {
+	rateLimitStoreMu.RLock()
+	defer rateLimitStoreMu.RUnlock()
+	return rateLimitStore
+}
+
+// takeRateLimit charges one request to userID and ip under policy. The result
+// is the bucket closest to running out.
+func takeRateLimit(policy RateLimitPolicy, userID int, ip string) RateLimitResult {
+	store := getRateLimitStore()
+	now := time.Now()
+	var keys []string
+	var limits []int
+	if userID != 0 && policy.Limit > 0 {
+		keys = append(keys, policy.Name+":user:"+strconv.Itoa(userID))
+		limits = append(limits, policy.Limit)
+	}
+	if ip != "" && policy.IPLimit > 0 {
+		keys = append(keys, policy.Name+":ip:"+ip)
+		limits = append(limits, policy.IPLimit)
+	}
+
+	result := RateLimitResult{Allowed: true, Remaining: math.MaxInt}
+	for i, key := range keys {
+		r := store.Take(key, limits[i], policy.Window, now)
+		if (!r.Allowed && result.Allowed) || (r.Allowed == result.Allowed && r.Remaining < result.Remaining) {
+			result = r
+		}
+	}
+	return result
+}
+
+// RateLimit wraps a handler so writes through it are limited by policy.
+// Reads pass through, and moderators and admins are exempt.
+func RateLimit(policy RateLimitPolicy, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+		user, _ := GetUserFromSession(r)
+		if actingStaff(user) {
+			next(w, r)
+			return
+		}
+		var userID int
+		if user != nil {
+			userID = user.ID
+		}
+
+		result := takeRateLimit(policy, userID, clientIP(r))
+		if result.Limit > 0 {
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(result.Reset).Unix(), 10))
+		}
+		if !result.Allowed {
+			renderRateLimited(w, r, policy, result.RetryAfter)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// renderRateLimited answers 429 as JSON to scripts and as a page otherwise
+func renderRateLimited(w http.ResponseWriter, r *http.Request, policy RateLimitPolicy, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	message := fmt.Sprintf("You are trying to %s too often. Please wait %s and try again.", policy.Action, formatWait(seconds))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": message, "retry_after": seconds})
+		return
+	}
+	w.WriteHeader(http.StatusTooManyRequests)
+	if err := RenderTemplate(w, "error_429.html", map[string]string{"Message": message}); err != nil {
+		log.Printf("Error rendering 429 template: %v", err)
+		http.Error(w, message, http.StatusTooManyRequests)
+	}
+}
+
+// formatWait describes a wait in seconds the way a person would say it
+func formatWait(seconds int) string {
+	switch {
+	case seconds <= 1:
+		return "a second"
+	case seconds < 60:
+		return strconv.Itoa(seconds) + " seconds"
+	case seconds < 120:
+		return "a minute"
+	default:
+		return strconv.Itoa((seconds+59)/60) + " minutes"
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	window time.Duration
+}
+
+// memoryRateLimitStore is the default in-process RateLimitStore
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	s := &memoryRateLimitStore{buckets: make(map[string]*tokenBucket)}
+	go func() {
+		for {
+			time.Sleep(10 * time.Minute)
+			s.prune(time.Now())
+		}
+	}()
+	return s
+}
+
+func (s *memoryRateLimitStore) Take(key string, limit int, window time.Duration, now time.Time) RateLimitResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	capacity := float64(limit)
+	perToken := window / time.Duration(limit)
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, last: now}
+		s.buckets[key] = b
+	}
+	b.window = window
+	b.tokens = math.Min(capacity, b.tokens+float64(now.Sub(b.last))/float64(perToken))
+	b.last = now
+
+	result := RateLimitResult{Limit: limit}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = time.Duration((capacity - b.tokens) * float64(perToken))
+	return result
+}
+
+// prune drops buckets that have had time to fill up again
+func (s *memoryRateLimitStore) prune(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, b := range s.buckets {
+		if now.Sub(b.last) > b.window {
+			delete(s.buckets, key)
+		}
+	}
+}
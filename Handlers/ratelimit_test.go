@@ -0,0 +1,58 @@
+package RebootForums
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimitStoreTake(t *testing.T) {
+	// 5 tokens refilling over 10 seconds: one every 2 seconds
+	const limit, window = 5, 10 * time.Second
+	start := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name          string
+		at            time.Duration
+		key           string
+		wantAllowed   bool
+		wantRemaining int
+		wantRetry     time.Duration
+		wantReset     time.Duration
+	}{
+		{"first request", 0, "a", true, 4, 0, 2 * time.Second},
+		{"burst 2", 0, "a", true, 3, 0, 4 * time.Second},
+		{"burst 3", 0, "a", true, 2, 0, 6 * time.Second},
+		{"burst 4", 0, "a", true, 1, 0, 8 * time.Second},
+		{"burst 5", 0, "a", true, 0, 0, 10 * time.Second},
+		{"bucket empty", 0, "a", false, 0, 2 * time.Second, 10 * time.Second},
+		{"other keys have their own bucket", 0, "b", true, 4, 0, 2 * time.Second},
+		{"half a token back", time.Second, "a", false, 0, time.Second, 9 * time.Second},
+		{"one token back", 2 * time.Second, "a", true, 0, 0, 10 * time.Second},
+		{"refill stops at the limit", time.Minute, "a", true, 4, 0, 2 * time.Second},
+	}
+
+	s := &memoryRateLimitStore{buckets: make(map[string]*tokenBucket)}
+	for _, tt := range tests {
+		got := s.Take(tt.key, limit, window, start.Add(tt.at))
+		if got.Allowed != tt.wantAllowed || got.Remaining != tt.wantRemaining ||
+			got.RetryAfter != tt.wantRetry || got.Reset != tt.wantReset || got.Limit != limit {
+			t.Errorf("%s: got %+v, want allowed %v, remaining %d, retry after %v, reset %v",
+				tt.name, got, tt.wantAllowed, tt.wantRemaining, tt.wantRetry, tt.wantReset)
+		}
+	}
+}
+
+func TestMemoryRateLimitStorePrune(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	s := &memoryRateLimitStore{buckets: make(map[string]*tokenBucket)}
+	s.Take("short", 5, time.Second, start)
+	s.Take("long", 5, time.Hour, start)
+
+	s.prune(start.Add(time.Minute))
+	if _, ok := s.buckets["short"]; ok {
+		t.Error("a bucket that has refilled was kept")
+	}
+	if _, ok := s.buckets["long"]; !ok {
+		t.Error("a bucket that is still refilling was dropped")
+	}
+}
@@ -0,0 +1,436 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Things that can be reported
+const (
+	ReportPost    = "post"
+	ReportComment = "comment"
+	ReportUser    = "user"
+)
+
+// reportReasons are the categories a report can be filed under
+var reportReasons = map[string]string{
+	"spam":          "Spam",
+	"harassment":    "Harassment or bullying",
+	"inappropriate": "Inappropriate content",
+	"other":         "Something else",
+}
+
+// MaxReportDetailsLength limits the free text a reporter can add
+const MaxReportDetailsLength = 500
+
+// Report outcomes recorded when a moderator resolves the reports on a target
+const (
+	OutcomeDismissed = "dismissed"
+	OutcomeDeleted   = "deleted"
+	OutcomeWarned    = "warned"
+	OutcomeSuspended = "suspended"
+)
+
+// suspensionDays are the suspension lengths moderators can pick from the queue
+var suspensionDays = []int{1, 7, 30}
+
+// ReportEntry is one user's report in a queue item
+type ReportEntry struct {
+	Reporter  string
+	Reason    string
+	Details   string
+	CreatedAt time.Time
+}
+
+// QueueItem is everything open against one post, comment or user
+type QueueItem struct {
+	TargetType  string
+	TargetID    int
+	Title       string
+	Content     string
+	Link        string
+	AuthorID    int
+	Author      string
+	AuthorRole  string
+	CanSanction bool // whether the viewing moderator may act against the author
+	Warnings    int
+	Suspensions int
+	Reports     []ReportEntry
+}
+
+// HTML returns the reported content rendered from Markdown
+func (q QueueItem) HTML() template.HTML {
+	return RenderMarkdown(q.Content)
+}
+
+// fileReport stores a report unless the reporter already has an open one on
+// the same target
+func fileReport(reporterID int, targetType string, targetID int, reason, details string) error {
+	_, err := DB.Exec(`
+		INSERT INTO reports (target_type, target_id, reporter_id, reason, details, created_at)
+		SELECT ?, ?, ?, ?, ?, ?
+		WHERE NOT EXISTS (
+			SELECT 1 FROM reports
+			WHERE target_type = ? AND target_id = ? AND reporter_id = ? AND resolved_at IS NULL
+		)
+	`, targetType, targetID, reporterID, reason, details, time.Now(), targetType, targetID, reporterID)
+	return err
+}
+
+// ReportHandler files a report on a post, comment or user and sends the
+// reporter back to where they came from
+func ReportHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if !requireWritable(w, r, user) {
+		return
+	}
+
+	targetType := r.FormValue("target_type")
+	targetID, err := strconv.Atoi(r.FormValue("target_id"))
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+	reason := r.FormValue("reason")
+	if _, ok := reportReasons[reason]; !ok {
+		Error400Handler(w, r)
+		return
+	}
+	details := strings.TrimSpace(r.FormValue("details"))
+	if utf8.RuneCountInString(details) > MaxReportDetailsLength {
+		http.Error(w, "Report details can be at most "+strconv.Itoa(MaxReportDetailsLength)+" characters", http.StatusBadRequest)
+		return
+	}
+
+	target := QueueItem{TargetType: targetType, TargetID: targetID}
+	err = loadReportTarget(&target)
+	if err == sql.ErrNoRows || target.AuthorID == user.ID {
+		Error404Handler(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching report target: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	if err := fileReport(user.ID, targetType, targetID, reason, details); err != nil {
+		log.Printf("Error filing report: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	// Put the flag before any #comment fragment
+	path, fragment, _ := strings.Cut(target.Link, "#")
+	link := path + "?reported=1"
+	if fragment != "" {
+		link += "#" + fragment
+	}
+	http.Redirect(w, r, link, http.StatusSeeOther)
+}
+
+// getModQueue returns the targets with open reports, oldest report first.
+// Reports on content that has since been deleted are left out.
+func getModQueue() ([]QueueItem, error) {
+	rows, err := DB.Query(`
+		SELECT r.target_type, r.target_id, u.username, r.reason, r.details, r.created_at
+		FROM reports r
+		JOIN users u ON u.id = r.reporter_id
+		WHERE r.resolved_at IS NULL
+		ORDER BY r.created_at ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	type key struct {
+		targetType string
+		targetID   int
+	}
+	var items []QueueItem
+	index := make(map[key]int)
+	for rows.Next() {
+		var k key
+		var e ReportEntry
+		if err := rows.Scan(&k.targetType, &k.targetID, &e.Reporter, &e.Reason, &e.Details, &e.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		e.Reason = reportReasons[e.Reason]
+		i, ok := index[k]
+		if !ok {
+			i = len(items)
+			index[k] = i
+			items = append(items, QueueItem{TargetType: k.targetType, TargetID: k.targetID})
+		}
+		items[i].Reports = append(items[i].Reports, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	queue := items[:0]
+	for _, item := range items {
+		err := loadReportTarget(&item)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = DB.QueryRow(`
+			SELECT COALESCE(SUM(kind = ?), 0), COALESCE(SUM(kind = ?), 0)
+			FROM user_sanctions WHERE user_id = ?
+		`, SanctionWarning, SanctionSuspension, item.AuthorID).Scan(&item.Warnings, &item.Suspensions)
+		if err != nil {
+			return nil, err
+		}
+		queue = append(queue, item)
+	}
+	return queue, nil
+}
+
+// loadReportTarget fills in the reported content, its author and a link to
+// it. It returns sql.ErrNoRows if the target no longer exists.
+func loadReportTarget(item *QueueItem) error {
+	var err error
+	switch item.TargetType {
+	case ReportPost:
+		err = DB.QueryRow(`
+			SELECT p.title, p.content, u.id, u.username, u.role FROM posts p JOIN users u ON u.id = p.user_id WHERE p.id = ? AND p.deleted_at IS NULL
+		`, item.TargetID).Scan(&item.Title, &item.Content, &item.AuthorID, &item.Author, &item.AuthorRole)
+		item.Link = "/post/" + strconv.Itoa(item.TargetID)
+	case ReportComment:
+		var postID int
+		err = DB.QueryRow(`
+			SELECT p.id, p.title, c.content, u.id, u.username, u.role FROM comments c
+			JOIN posts p ON p.id = c.post_id
+			JOIN users u ON u.id = c.user_id
+			WHERE c.id = ? AND c.deleted_at IS NULL AND p.deleted_at IS NULL
+		`, item.TargetID).Scan(&postID, &item.Title, &item.Content, &item.AuthorID, &item.Author, &item.AuthorRole)
+		item.Title = "Comment on \"" + item.Title + "\""
+		item.Link = "/post/" + strconv.Itoa(postID) + "#comment-" + strconv.Itoa(item.TargetID)
+	case ReportUser:
+		var bio string
+		err = DB.QueryRow("SELECT id, username, role, COALESCE(bio, '') FROM users WHERE id = ? AND deleted_at IS NULL", item.TargetID).
+			Scan(&item.AuthorID, &item.Author, &item.AuthorRole, &bio)
+		item.Title = "User " + item.Author
+		item.Content = bio
+		item.Link = "/user/" + url.PathEscape(item.Author)
+	default:
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+// ModQueueHandler lists open reports grouped by what they are about
+func ModQueueHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, false)
+	if !ok {
+		return
+	}
+
+	queue, err := getModQueue()
+	if err != nil {
+		log.Printf("Error fetching moderation queue: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	var openMessageReports int
+	if err := DB.QueryRow("SELECT COUNT(*) FROM message_reports WHERE resolved_at IS NULL").Scan(&openMessageReports); err != nil {
+		log.Printf("Error counting message reports: %v", err)
+	}
+	heldContent := HeldContentCount()
+	for i := range queue {
+		queue[i].CanSanction = canSanction(user, &User{ID: queue[i].AuthorID, Role: queue[i].AuthorRole})
+	}
+
+	data := map[string]interface{}{
+		"LoggedIn":        true,
+		"Username":        user.Username,
+		"Queue":           queue,
+		"MessageReports":  openMessageReports,
+		"HeldContent":     heldContent,
+		"SuspensionDays":  suspensionDays,
+		"MaxReasonLength": MaxSanctionReasonLength,
+		"Resolved":        r.URL.Query().Get("resolved"),
+	}
+	if err := RenderTemplate(w, "mod-queue.html", data); err != nil {
+		log.Printf("Error rendering moderation queue: %v", err)
+		Error500Handler(w, r)
+	}
+}
+
+// ModResolveReportHandler closes every open report on a target with the
+// moderator's decision: dismiss them, delete the content, or warn or
+// suspend its author
+func ModResolveReportHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, false)
+	if !ok {
+		return
+	}
+
+	targetType := r.PathValue("type")
+	targetID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+	var open bool
+	err = DB.QueryRow("SELECT EXISTS(SELECT 1 FROM reports WHERE target_type = ? AND target_id = ? AND resolved_at IS NULL)",
+		targetType, targetID).Scan(&open)
+	if err != nil {
+		log.Printf("Error checking reports: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	item := QueueItem{TargetType: targetType, TargetID: targetID}
+	if open {
+		err = loadReportTarget(&item)
+	}
+	// Moderators cannot decide reports about themselves
+	if !open || err == sql.ErrNoRows || item.AuthorID == user.ID {
+		Error404Handler(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error fetching report target: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	outcome := r.FormValue("outcome")
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if utf8.RuneCountInString(reason) > MaxSanctionReasonLength {
+		Error400Handler(w, r)
+		return
+	}
+
+	// Acting on a report is a sanction against its author, so the rules of
+	// /mod/sanctions apply: only admins can act against other staff
+	if outcome != OutcomeDismissed {
+		author, err := GetUserByID(item.AuthorID)
+		if err != nil {
+			log.Printf("Error fetching report target author: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+		if !canSanction(user, author) {
+			http.Error(w, "Only an admin can act against another moderator", http.StatusForbidden)
+			return
+		}
+	}
+
+	// What goes in the audit log
+	event := AuditEvent{Action: AuditReportDismiss, TargetType: targetType, TargetID: targetID, Target: item.Title}
+	snapshot := map[string]interface{}{"author": item.Author, "content": item.Content, "link": item.Link}
+
+	switch outcome {
+	case OutcomeDismissed:
+	case OutcomeDeleted:
+		event.Before = snapshot
+		switch targetType {
+		case ReportPost:
+			event.Action = AuditPostDelete
+			snapshot["categories"], err = getPostCategories(targetID)
+			if err == nil {
+				err = softDeletePost(targetID, user.ID)
+			}
+		case ReportComment:
+			event.Action = AuditCommentDelete
+			err = softDeleteComment(targetID, user.ID)
+		default:
+			// A user is not content; suspend them instead
+			Error400Handler(w, r)
+			return
+		}
+	case OutcomeWarned:
+		if reason == "" {
+			Error400Handler(w, r)
+			return
+		}
+		err = warnUser(item.AuthorID, user.ID, reason)
+		event = AuditEvent{Action: AuditUserWarn, TargetType: ReportUser, TargetID: item.AuthorID, Target: item.Author,
+			After: map[string]string{"reason": reason, "report": item.Link}}
+	case OutcomeSuspended:
+		days, convErr := strconv.Atoi(r.FormValue("days"))
+		if convErr != nil || !slices.Contains(suspensionDays, days) || reason == "" {
+			Error400Handler(w, r)
+			return
+		}
+		until := time.Now().AddDate(0, 0, days)
+		err = suspendUser(item.AuthorID, user.ID, reason, until)
+		suspension := Sanction{Kind: SanctionSuspension, Reason: reason, ExpiresAt: sql.NullTime{Time: until, Valid: true}}
+		event = AuditEvent{Action: AuditUserSuspend, TargetType: ReportUser, TargetID: item.AuthorID, Target: item.Author,
+			After: suspension.snapshot()}
+	default:
+		Error400Handler(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error applying moderation outcome %s: %v", outcome, err)
+		Error500Handler(w, r)
+		return
+	}
+	recordAudit(user, clientIP(r), event)
+	trainFromReports(item, outcome)
+
+	if err := resolveReports(targetType, targetID, user.ID, outcome); err != nil {
+		log.Printf("Error resolving reports: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	http.Redirect(w, r, "/mod/queue?resolved="+outcome, http.StatusSeeOther)
+}
+
+// trainFromReports teaches the spam filter from a decision on reported
+// content: deleting something reported as spam marks it as spam, dismissing
+// the reports marks it as fine. Other outcomes say nothing about spam.
+func trainFromReports(item QueueItem, outcome string) {
+	if item.TargetType != ReportPost && item.TargetType != ReportComment {
+		return
+	}
+	var spam bool
+	switch outcome {
+	case OutcomeDismissed:
+	case OutcomeDeleted:
+		err := DB.QueryRow(`
+			SELECT EXISTS(SELECT 1 FROM reports WHERE target_type = ? AND target_id = ? AND reason = 'spam' AND resolved_at IS NULL)
+		`, item.TargetType, item.TargetID).Scan(&spam)
+		if err != nil {
+			log.Printf("Error checking spam reports: %v", err)
+			return
+		}
+		if !spam {
+			return
+		}
+	default:
+		return
+	}
+	s := Submission{Content: item.Content}
+	if item.TargetType == ReportPost {
+		s.Title = item.Title
+	}
+	if err := trainSpamFilter(s.Text(), spam); err != nil {
+		log.Printf("Error training spam filter: %v", err)
+	}
+}
+
+func resolveReports(targetType string, targetID, moderatorID int, outcome string) error {
+	_, err := DB.Exec(`
+		UPDATE reports SET resolved_at = ?, resolved_by = ?, outcome = ?
+		WHERE target_type = ? AND target_id = ? AND resolved_at IS NULL
+	`, time.Now(), moderatorID, outcome, targetType, targetID)
+	return err
+}
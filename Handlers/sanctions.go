@@ -0,0 +1,658 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of sanction a moderator can give a user. A suspended user can read
+// but not write; a banned user cannot log in at all.
+const (
+	SanctionWarning    = "warning"
+	SanctionSuspension = "suspension"
+	SanctionBan        = "ban"
+)
+
+// MaxSanctionReasonLength limits the reason a moderator gives the user
+const MaxSanctionReasonLength = 500
+
+// ErrInvalidIPRange is returned for an IP ban that is neither an address nor a CIDR range
+var ErrInvalidIPRange = errors.New("invalid IP address or range")
+
+// Sanction is a warning, suspension or ban given to a user by a moderator.
+// ExpiresAt is not valid for warnings and permanent bans.
+type Sanction struct {
+	ID        int
+	UserID    int
+	Kind      string
+	Username  string
+	UserRole  string
+	Moderator string
+	Reason    string
+	CreatedAt time.Time
+	ExpiresAt sql.NullTime
+	// CanLift is set for the sanctions the viewing moderator may lift
+	CanLift bool
+}
+
+// Until describes when the sanction ends
+func (s Sanction) Until() string {
+	if !s.ExpiresAt.Valid {
+		return "permanently"
+	}
+	return "until " + s.ExpiresAt.Time.Format("January 2, 2006 at 3:04 PM")
+}
+
+// IPBan blocks logins, sign-ups and posting from an address range
+type IPBan struct {
+	ID        int
+	Range     string
+	Moderator string
+	Reason    string
+	CreatedAt time.Time
+	ExpiresAt sql.NullTime
+}
+
+// Until describes when the ban ends
+func (b IPBan) Until() string {
+	return Sanction{ExpiresAt: b.ExpiresAt}.Until()
+}
+
+// canSanction reports whether moderator may sanction target. Nobody can
+// sanction themselves and only admins can sanction other staff.
+func canSanction(moderator, target *User) bool {
+	if moderator.ID == target.ID {
+		return false
+	}
+	return !target.IsStaff() || moderator.IsAdmin()
+}
+
+func insertSanction(tx *sql.Tx, userID, moderatorID int, kind, reason string, expiresAt interface{}) error {
+	_, err := tx.Exec(`
+		INSERT INTO user_sanctions (user_id, moderator_id, kind, reason, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, userID, moderatorID, kind, reason, time.Now(), expiresAt)
+	return err
+}
+
+func addSanction(userID, moderatorID int, kind, reason string, expiresAt interface{}) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := insertSanction(tx, userID, moderatorID, kind, reason, expiresAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// warnUser records a warning and emails it to the user
+func warnUser(userID, moderatorID int, reason string) error {
+	if err := addSanction(userID, moderatorID, SanctionWarning, reason, nil); err != nil {
+		return err
+	}
+	emailSanction(userID, "You have received a warning",
+		"A moderator has warned you about your activity on Reboot Forums:\n\n"+reason+"\n\n"+
+			"Further breaks of the rules may lead to your account being suspended.\n")
+	return nil
+}
+
+// suspendUser makes the user read-only until the given time and emails them
+func suspendUser(userID, moderatorID int, reason string, until time.Time) error {
+	if err := addSanction(userID, moderatorID, SanctionSuspension, reason, until); err != nil {
+		return err
+	}
+	emailSanction(userID, "Your account has been suspended",
+		"A moderator has suspended your Reboot Forums account until "+until.Format("January 2, 2006 at 3:04 PM")+":\n\n"+reason+"\n\n"+
+			"You can still read the forum, but you cannot post, comment or send messages until then.\n")
+	return nil
+}
+
+// banUser bans the user until the given time, or for good if until is nil,
+// and signs them out everywhere straight away
+func banUser(userID, moderatorID int, reason string, until *time.Time) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	s := Sanction{}
+	var expiresAt interface{}
+	if until != nil {
+		expiresAt = *until
+		s.ExpiresAt = sql.NullTime{Time: *until, Valid: true}
+	}
+	if err := insertSanction(tx, userID, moderatorID, SanctionBan, reason, expiresAt); err != nil {
+		return err
+	}
+	for _, query := range []string{
+		"DELETE FROM sessions WHERE user_id = ?",
+		"DELETE FROM pending_logins WHERE user_id = ?",
+	} {
+		if _, err := tx.Exec(query, userID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	emailSanction(userID, "Your account has been banned",
+		"A moderator has banned your Reboot Forums account "+s.Until()+":\n\n"+reason+"\n")
+	return nil
+}
+
+// liftSanction ends a suspension or ban early
+func liftSanction(id, moderatorID int) (bool, error) {
+	result, err := DB.Exec(`
+		UPDATE user_sanctions SET lifted_at = ?, lifted_by = ?
+		WHERE id = ? AND kind != ? AND lifted_at IS NULL
+	`, time.Now(), moderatorID, id, SanctionWarning)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// getSanction returns a sanction with the name of the user it is on
+func getSanction(id int) (Sanction, error) {
+	var s Sanction
+	err := DB.QueryRow(`
+		SELECT s.id, s.user_id, s.kind, u.username, s.reason, s.created_at, s.expires_at
+		FROM user_sanctions s JOIN users u ON u.id = s.user_id
+		WHERE s.id = ?
+	`, id).Scan(&s.ID, &s.UserID, &s.Kind, &s.Username, &s.Reason, &s.CreatedAt, &s.ExpiresAt)
+	return s, err
+}
+
+// snapshot describes the sanction for the audit log
+func (s Sanction) snapshot() map[string]string {
+	return map[string]string{"kind": s.Kind, "reason": s.Reason, "ends": s.Until()}
+}
+
+func emailSanction(userID int, subject, text string) {
+	user, err := GetUserByID(userID)
+	if err != nil {
+		log.Printf("Error fetching user to email sanction: %v", err)
+		return
+	}
+	if err := sendMail(user.Email, subject, "Hi "+user.Username+",\n\n"+text); err != nil {
+		log.Printf("Error sending sanction email: %v", err)
+	}
+}
+
+// activeSanction returns the running sanction of the given kind that ends
+// last, or nil if there is none
+func activeSanction(userID int, kind string) (*Sanction, error) {
+	var s Sanction
+	err := DB.QueryRow(`
+		SELECT id, kind, reason, created_at, expires_at FROM user_sanctions
+		WHERE user_id = ? AND kind = ? AND lifted_at IS NULL AND (expires_at IS NULL OR expires_at > ?)
+		ORDER BY expires_at IS NULL DESC, expires_at DESC LIMIT 1
+	`, userID, kind, time.Now()).Scan(&s.ID, &s.Kind, &s.Reason, &s.CreatedAt, &s.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// getActiveSanctions lists the suspensions and bans still in force, newest first
+func getActiveSanctions() ([]Sanction, error) {
+	rows, err := DB.Query(`
+		SELECT s.id, s.user_id, s.kind, u.username, u.role, m.username, s.reason, s.created_at, s.expires_at
+		FROM user_sanctions s
+		JOIN users u ON u.id = s.user_id
+		JOIN users m ON m.id = s.moderator_id
+		WHERE s.kind != ? AND s.lifted_at IS NULL AND (s.expires_at IS NULL OR s.expires_at > ?)
+		ORDER BY s.created_at DESC
+	`, SanctionWarning, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sanctions []Sanction
+	for rows.Next() {
+		var s Sanction
+		if err := rows.Scan(&s.ID, &s.UserID, &s.Kind, &s.Username, &s.UserRole, &s.Moderator, &s.Reason, &s.CreatedAt, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sanctions = append(sanctions, s)
+	}
+	return sanctions, rows.Err()
+}
+
+// banMessage explains why the user cannot log in, or returns "" if they can
+func banMessage(userID int) (string, error) {
+	s, err := activeSanction(userID, SanctionBan)
+	if err != nil || s == nil {
+		return "", err
+	}
+	return "This account has been banned " + s.Until() + ". Reason: " + s.Reason, nil
+}
+
+// loginRefusal explains why the user may not log in from ip, or returns ""
+// if they may
+func loginRefusal(userID int, ip string) (string, error) {
+	if ipBanned(ip) {
+		return ipBanMessage, nil
+	}
+	return banMessage(userID)
+}
+
+// suspendedMessage explains why the user cannot write, or returns "" if they
+// can. A failed lookup is logged and does not stop the user.
+func suspendedMessage(userID int) string {
+	s, err := activeSanction(userID, SanctionSuspension)
+	if err != nil {
+		log.Printf("Error checking suspension: %v", err)
+		return ""
+	}
+	if s == nil {
+		return ""
+	}
+	return "Your account is suspended " + s.Until() + ". You can read the forum but cannot post."
+}
+
+// readOnlyMessage explains why a user at ip may not change anything, or
+// returns "" if they may. Suspended users and banned networks are read-only,
+// and so are banned users whose connection outlived their session, like an
+// open chat socket.
+func readOnlyMessage(user *User, ip string) string {
+	if user != nil {
+		if msg := suspendedMessage(user.ID); msg != "" {
+			return msg
+		}
+		msg, err := banMessage(user.ID)
+		if err != nil {
+			log.Printf("Error checking ban: %v", err)
+		}
+		if msg != "" {
+			return msg
+		}
+	}
+	if ipBanned(ip) {
+		return ipBanMessage
+	}
+	return ""
+}
+
+// requireWritable replies with 403 Forbidden and returns false if the
+// request is read-only
+func requireWritable(w http.ResponseWriter, r *http.Request, user *User) bool {
+	if msg := readOnlyMessage(user, clientIP(r)); msg != "" {
+		http.Error(w, msg, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// ipBanMessage is shown to anyone on a banned network
+const ipBanMessage = "Your network has been blocked from this forum."
+
+// parseIPRange accepts a CIDR range or a single address
+func parseIPRange(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, ErrInvalidIPRange
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, ErrInvalidIPRange
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+// ipBanned reports whether ip falls in an active IP ban. A failed lookup is
+// logged and lets the request through.
+func ipBanned(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	rows, err := DB.Query("SELECT ip_range FROM ip_bans WHERE lifted_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", time.Now())
+	if err != nil {
+		log.Printf("Error checking IP bans: %v", err)
+		return false
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			log.Printf("Error checking IP bans: %v", err)
+			return false
+		}
+		if prefix, err := netip.ParsePrefix(s); err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func addIPBan(prefix netip.Prefix, moderatorID int, reason string, expiresAt interface{}) (int, error) {
+	result, err := DB.Exec(`
+		INSERT INTO ip_bans (ip_range, moderator_id, reason, created_at, expires_at) VALUES (?, ?, ?, ?, ?)
+	`, prefix.String(), moderatorID, reason, time.Now(), expiresAt)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func liftIPBan(id, moderatorID int) (bool, error) {
+	result, err := DB.Exec("UPDATE ip_bans SET lifted_at = ?, lifted_by = ? WHERE id = ? AND lifted_at IS NULL", time.Now(), moderatorID, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func getIPBan(id int) (IPBan, error) {
+	var b IPBan
+	err := DB.QueryRow("SELECT id, ip_range, reason, created_at, expires_at FROM ip_bans WHERE id = ?", id).
+		Scan(&b.ID, &b.Range, &b.Reason, &b.CreatedAt, &b.ExpiresAt)
+	return b, err
+}
+
+func getActiveIPBans() ([]IPBan, error) {
+	rows, err := DB.Query(`
+		SELECT b.id, b.ip_range, m.username, b.reason, b.created_at, b.expires_at
+		FROM ip_bans b
+		JOIN users m ON m.id = b.moderator_id
+		WHERE b.lifted_at IS NULL AND (b.expires_at IS NULL OR b.expires_at > ?)
+		ORDER BY b.created_at DESC
+	`, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bans []IPBan
+	for rows.Next() {
+		var b IPBan
+		if err := rows.Scan(&b.ID, &b.Range, &b.Moderator, &b.Reason, &b.CreatedAt, &b.ExpiresAt); err != nil {
+			return nil, err
+		}
+		bans = append(bans, b)
+	}
+	return bans, rows.Err()
+}
+
+// parseUntil reads an end date from a form. An empty value means no end.
+func parseUntil(value string) (*time.Time, bool) {
+	if value == "" {
+		return nil, true
+	}
+	until, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil || !until.After(time.Now()) {
+		return nil, false
+	}
+	return &until, true
+}
+
+// ModSanctionsHandler lists running suspensions and bans and has the forms
+// to issue new ones. Admins also manage IP bans here.
+func ModSanctionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, false)
+	if !ok {
+		return
+	}
+	renderSanctions(w, r, user, nil)
+}
+
+func renderSanctions(w http.ResponseWriter, r *http.Request, user *User, errs ValidationErrors) {
+	sanctions, err := getActiveSanctions()
+	if err != nil {
+		log.Printf("Error fetching sanctions: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	for i := range sanctions {
+		sanctions[i].CanLift = canSanction(user, &User{ID: sanctions[i].UserID, Role: sanctions[i].UserRole})
+	}
+	data := map[string]interface{}{
+		"LoggedIn":  true,
+		"Username":  user.Username,
+		"IsAdmin":   user.IsAdmin(),
+		"Sanctions": sanctions,
+		"Errors":    errs,
+		"Target":    r.FormValue("user"),
+		"Kind":      r.FormValue("kind"),
+		"Until":     r.FormValue("until"),
+		"Reason":    r.FormValue("reason"),
+		"IPRange":   r.FormValue("ip_range"),
+		"Saved":     r.URL.Query().Get("saved") == "1",
+		"MaxReason": MaxSanctionReasonLength,
+	}
+	if user.IsAdmin() {
+		bans, err := getActiveIPBans()
+		if err != nil {
+			log.Printf("Error fetching IP bans: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+		data["IPBans"] = bans
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	if err := RenderTemplate(w, "mod-sanctions.html", data); err != nil {
+		log.Printf("Error rendering sanctions: %v", err)
+		Error500Handler(w, r)
+	}
+}
+
+// ModSanctionHandler suspends or bans a user
+func ModSanctionHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, false)
+	if !ok {
+		return
+	}
+
+	errs := ValidationErrors{}
+	kind := r.FormValue("kind")
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	until, validUntil := parseUntil(r.FormValue("until"))
+
+	var target *User
+	var targetID int
+	err := DB.QueryRow("SELECT id FROM users WHERE username = ? COLLATE NOCASE AND deleted_at IS NULL",
+		strings.TrimSpace(r.FormValue("user"))).Scan(&targetID)
+	if err == nil {
+		target, err = GetUserByID(targetID)
+	}
+	if err == sql.ErrNoRows {
+		errs.Add("user", "There is no user with that username")
+	} else if err != nil {
+		log.Printf("Error fetching user to sanction: %v", err)
+		Error500Handler(w, r)
+		return
+	} else if !canSanction(user, target) {
+		errs.Add("user", "You cannot suspend or ban this user")
+	}
+	if kind != SanctionSuspension && kind != SanctionBan {
+		errs.Add("kind", "Choose a suspension or a ban")
+	}
+	if !validUntil {
+		errs.Add("until", "Pick a date in the future")
+	} else if until == nil && kind == SanctionSuspension {
+		errs.Add("until", "A suspension needs an end date")
+	}
+	if reason == "" {
+		errs.Add("reason", "Tell the user why")
+	} else if len(reason) > MaxSanctionReasonLength {
+		errs.Add("reason", "The reason can be at most "+strconv.Itoa(MaxSanctionReasonLength)+" characters")
+	}
+	if len(errs) > 0 {
+		renderSanctions(w, r, user, errs)
+		return
+	}
+
+	if kind == SanctionBan {
+		err = banUser(target.ID, user.ID, reason, until)
+	} else {
+		err = suspendUser(target.ID, user.ID, reason, *until)
+	}
+	if err != nil {
+		log.Printf("Error sanctioning user: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	action := AuditUserSuspend
+	if kind == SanctionBan {
+		action = AuditUserBan
+	}
+	s := Sanction{Kind: kind, Reason: reason}
+	if until != nil {
+		s.ExpiresAt = sql.NullTime{Time: *until, Valid: true}
+	}
+	recordAudit(user, clientIP(r), AuditEvent{Action: action, TargetType: "user", TargetID: target.ID,
+		Target: target.Username, After: s.snapshot()})
+	http.Redirect(w, r, "/mod/sanctions?saved=1", http.StatusSeeOther)
+}
+
+// ModLiftSanctionHandler ends a suspension or ban early
+func ModLiftSanctionHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, false)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+	sanction, err := getSanction(id)
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	}
+	var target *User
+	if err == nil {
+		target, err = GetUserByID(sanction.UserID)
+	}
+	if err != nil {
+		log.Printf("Error fetching sanction: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	// Lifting follows the same rules as placing: moderators cannot free
+	// themselves or undo what an admin did to other staff
+	if !canSanction(user, target) {
+		http.Error(w, "Only an admin can lift a sanction on a moderator", http.StatusForbidden)
+		return
+	}
+	lifted, err := liftSanction(id, user.ID)
+	if err != nil {
+		log.Printf("Error lifting sanction: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	if !lifted {
+		Error404Handler(w, r)
+		return
+	}
+	recordAudit(user, clientIP(r), AuditEvent{Action: AuditSanctionLift, TargetType: "sanction", TargetID: id,
+		Target: sanction.Username, Before: sanction.snapshot()})
+	http.Redirect(w, r, "/mod/sanctions?saved=1", http.StatusSeeOther)
+}
+
+// ModIPBanHandler bans an address or CIDR range. Only admins can, since a
+// range can shut out many people.
+func ModIPBanHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, true)
+	if !ok {
+		return
+	}
+
+	errs := ValidationErrors{}
+	prefix, err := parseIPRange(r.FormValue("ip_range"))
+	if err != nil {
+		errs.Add("ip_range", "Enter an address like 203.0.113.7 or a range like 203.0.113.0/24")
+	} else if addr, err := netip.ParseAddr(clientIP(r)); err == nil && prefix.Contains(addr.Unmap()) {
+		errs.Add("ip_range", "This range includes your own address")
+	}
+	until, validUntil := parseUntil(r.FormValue("ip_until"))
+	if !validUntil {
+		errs.Add("ip_until", "Pick a date in the future")
+	}
+	reason := strings.TrimSpace(r.FormValue("ip_reason"))
+	if len(reason) > MaxSanctionReasonLength {
+		errs.Add("ip_reason", "The reason can be at most "+strconv.Itoa(MaxSanctionReasonLength)+" characters")
+	}
+	if len(errs) > 0 {
+		renderSanctions(w, r, user, errs)
+		return
+	}
+
+	var expiresAt interface{}
+	if until != nil {
+		expiresAt = *until
+	}
+	id, err := addIPBan(prefix, user.ID, reason, expiresAt)
+	if err != nil {
+		log.Printf("Error adding IP ban: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	ends := Sanction{}
+	if until != nil {
+		ends.ExpiresAt = sql.NullTime{Time: *until, Valid: true}
+	}
+	recordAudit(user, clientIP(r), AuditEvent{Action: AuditIPBan, TargetType: "ip_ban", TargetID: id,
+		Target: prefix.String(), After: map[string]string{"reason": reason, "ends": ends.Until()}})
+	http.Redirect(w, r, "/mod/sanctions?saved=1", http.StatusSeeOther)
+}
+
+// ModLiftIPBanHandler ends an IP ban early
+func ModLiftIPBanHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, true)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+	ban, err := getIPBan(id)
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	}
+	lifted := false
+	if err == nil {
+		lifted, err = liftIPBan(id, user.ID)
+	}
+	if err != nil {
+		log.Printf("Error lifting IP ban: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	if !lifted {
+		Error404Handler(w, r)
+		return
+	}
+	recordAudit(user, clientIP(r), AuditEvent{Action: AuditIPBanLift, TargetType: "ip_ban", TargetID: id,
+		Target: ban.Range, Before: map[string]string{"reason": ban.Reason, "ends": ban.Until()}})
+	http.Redirect(w, r, "/mod/sanctions?saved=1", http.StatusSeeOther)
+}
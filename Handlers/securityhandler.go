@@ -0,0 +1,218 @@
+package RebootForums
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Reasons recorded in the login_attempts audit table
+const (
+	LoginFailUnknownUser = "unknown_user"
+	LoginFailBadPassword = "bad_password"
+	LoginFailBad2FA      = "bad_2fa_code"
+	LoginFailThrottled   = "throttled"
+)
+
+// suspiciousWindow is how far back the admin security view looks
+const suspiciousWindow = 24 * time.Hour
+
+// LoginAttemptRetention is how long failed logins are kept before the purge
+// job deletes them
+const LoginAttemptRetention = 30 * 24 * time.Hour
+
+// LoginAttempt is one row of the failed login audit log
+type LoginAttempt struct {
+	Username  string
+	IP        string
+	UserAgent string
+	Reason    string
+	CreatedAt time.Time
+}
+
+// FailureSummary aggregates failed attempts for one username or IP
+type FailureSummary struct {
+	Key          string
+	ThrottleKey  string
+	Failures     int
+	Distinct     int
+	LastAttempt  time.Time
+	BlockedUntil time.Time
+}
+
+// IsBlocked reports whether the key is currently throttled or locked out
+func (f FailureSummary) IsBlocked() bool {
+	return f.BlockedUntil.After(time.Now())
+}
+
+// recordLoginAttempt appends a failed attempt to the audit table
+func recordLoginAttempt(r *http.Request, username, ip, reason string) {
+	userAgent := r.UserAgent()
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	_, err := DB.Exec("INSERT INTO login_attempts (username, ip, user_agent, reason, created_at) VALUES (?, ?, ?, ?, ?)",
+		username, ip, userAgent, reason, time.Now())
+	if err != nil {
+		log.Printf("Error recording login attempt: %v", err)
+	}
+}
+
+// purgeLoginAttempts deletes failed logins older than LoginAttemptRetention
+func purgeLoginAttempts() error {
+	_, err := DB.Exec("DELETE FROM login_attempts WHERE created_at <= ?", time.Now().Add(-LoginAttemptRetention))
+	return err
+}
+
+// StartLoginAttemptPurger purges old failed logins now and then every hour
+func StartLoginAttemptPurger() {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			if err := purgeLoginAttempts(); err != nil {
+				log.Printf("Error purging login attempts: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// AdminSecurityHandler shows failed logins grouped by IP and username
+func AdminSecurityHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, true)
+	if !ok {
+		return
+	}
+
+	since := time.Now().Add(-suspiciousWindow)
+	byIP, err := getFailureSummaries("ip", "username", since)
+	if err != nil {
+		log.Printf("Error fetching failures by IP: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	byUsername, err := getFailureSummaries("username", "ip", since)
+	if err != nil {
+		log.Printf("Error fetching failures by username: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	recent, err := getRecentLoginAttempts(50)
+	if err != nil {
+		log.Printf("Error fetching recent login attempts: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	store := getAttemptStore()
+	for i := range byIP {
+		byIP[i].ThrottleKey = ipThrottleKey(byIP[i].Key)
+		byIP[i].BlockedUntil = ipThrottlePolicy.blockedUntil(store.State(byIP[i].ThrottleKey))
+	}
+	for i := range byUsername {
+		byUsername[i].ThrottleKey = usernameThrottleKey(byUsername[i].Key)
+		byUsername[i].BlockedUntil = usernameThrottlePolicy.blockedUntil(store.State(byUsername[i].ThrottleKey))
+	}
+
+	data := map[string]interface{}{
+		"LoggedIn":   true,
+		"Username":   user.Username,
+		"ByIP":       byIP,
+		"ByUsername": byUsername,
+		"Recent":     recent,
+		"Unlocked":   r.URL.Query().Get("unlocked") == "1",
+	}
+
+	err = RenderTemplate(w, "admin-security.html", data)
+	if err != nil {
+		Error500Handler(w, r)
+	}
+}
+
+// AdminUnlockHandler clears the throttle for a username or IP
+func AdminUnlockHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, true)
+	if !ok {
+		return
+	}
+
+	key := r.FormValue("key")
+	if !strings.HasPrefix(key, "user:") && !strings.HasPrefix(key, "ip:") {
+		Error400Handler(w, r)
+		return
+	}
+	getAttemptStore().Reset(key)
+	recordAudit(user, clientIP(r), AuditEvent{Action: AuditLoginUnlock, TargetType: "login", Target: key})
+
+	http.Redirect(w, r, "/admin/security?unlocked=1", http.StatusSeeOther)
+}
+
+// getFailureSummaries groups recent failures by column, counting distinct values of other.
+// Both column names come from the caller, never from user input.
+func getFailureSummaries(column, other string, since time.Time) ([]FailureSummary, error) {
+	rows, err := DB.Query(`
+		SELECT `+column+`, COUNT(*), COUNT(DISTINCT `+other+`), MAX(created_at)
+		FROM login_attempts
+		WHERE created_at > ?
+		GROUP BY `+column+`
+		ORDER BY COUNT(*) DESC
+		LIMIT 25
+	`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var summaries []FailureSummary
+	for rows.Next() {
+		var s FailureSummary
+		var last string
+		if err := rows.Scan(&s.Key, &s.Failures, &s.Distinct, &last); err != nil {
+			return nil, err
+		}
+		s.LastAttempt = parseSQLiteTime(last)
+		summaries = append(summaries, s)
+	}
+	return summaries, nil
+}
+
+func getRecentLoginAttempts(limit int) ([]LoginAttempt, error) {
+	rows, err := DB.Query(`
+		SELECT username, ip, COALESCE(user_agent, ''), reason, created_at
+		FROM login_attempts
+		ORDER BY created_at DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []LoginAttempt
+	for rows.Next() {
+		var a LoginAttempt
+		if err := rows.Scan(&a.Username, &a.IP, &a.UserAgent, &a.Reason, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, nil
+}
+
+// parseSQLiteTime parses timestamps returned by aggregate functions, which
+// the sqlite3 driver hands back as text instead of time.Time
+func parseSQLiteTime(value string) time.Time {
+	layouts := []string{
+		"2006-01-02 15:04:05.999999999-07:00",
+		"2006-01-02T15:04:05.999999999-07:00",
+		"2006-01-02 15:04:05",
+	}
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
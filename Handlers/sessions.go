@@ -168,7 +168,7 @@ func GetUserFromSession(r *http.Request) (*User, error) {
 
 func GetUserByID(id int) (*User, error) {
     var user User
-    err := DB.QueryRow("SELECT id, username, email FROM users WHERE id = ?", id).Scan(&user.ID, &user.Username, &user.Email)
+    err := DB.QueryRow("SELECT id, username, email, role, totp_enabled FROM users WHERE id = ?", id).Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.TOTPEnabled)
     if err != nil {
         return nil, err
     }
@@ -0,0 +1,436 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SettingsHandler shows the account settings page and applies the submitted action
+func SettingsHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		renderSettings(w, r, user, nil, settingsNotice(r))
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var errs ValidationErrors
+	var success string
+	switch r.FormValue("action") {
+	case "password":
+		errs = changePassword(r, user, r.FormValue("current_password"), r.FormValue("new_password"), r.FormValue("confirm_password"))
+		if len(errs) == 0 {
+			// Every session was revoked; give this browser a fresh one
+			if err := startUserSession(w, r, user.ID); err != nil {
+				log.Printf("Error creating session after password change: %v", err)
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+				return
+			}
+			http.Redirect(w, r, "/settings?saved=password", http.StatusSeeOther)
+			return
+		}
+	case "email":
+		var pending string
+		pending, errs = requestEmailChange(r, user, r.FormValue("email"), r.FormValue("email_password"))
+		if len(errs) == 0 {
+			success = "We sent a confirmation link to " + pending + ". Your email changes once you open it."
+		}
+	case "profile":
+		if !requireWritable(w, r, user) {
+			return
+		}
+		errs = updateProfile(user, r.FormValue("bio"), r.FormValue("location"), r.FormValue("website"))
+		if len(errs) == 0 {
+			http.Redirect(w, r, "/settings?saved=profile", http.StatusSeeOther)
+			return
+		}
+	case "username":
+		if !requireWritable(w, r, user) {
+			return
+		}
+		errs = changeUsername(user, r.FormValue("username"))
+		if len(errs) == 0 {
+			http.Redirect(w, r, "/settings?saved=username", http.StatusSeeOther)
+			return
+		}
+	case "delete":
+		errs = deleteAccount(r, user, r.FormValue("mode"), r.FormValue("delete_password"), r.FormValue("confirm_username"))
+		if len(errs) == 0 {
+			clearSessionCookie(w)
+			http.Redirect(w, r, "/?deleted=1", http.StatusSeeOther)
+			return
+		}
+	default:
+		Error400Handler(w, r)
+		return
+	}
+
+	renderSettings(w, r, user, errs, success)
+}
+
+// VerifyEmailHandler applies an email change from the link sent to the new address
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := ConfirmEmailChange(r.URL.Query().Get("token"))
+	if err != nil {
+		if err != ErrInvalidVerification && err != ErrEmailTaken {
+			log.Printf("Error confirming email change: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+		user, _ := GetUserFromSession(r)
+		if user == nil {
+			Error400Handler(w, r)
+			return
+		}
+		http.Redirect(w, r, "/settings?error=verification", http.StatusSeeOther)
+		return
+	}
+
+	user, _ := GetUserFromSession(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/settings?saved=email", http.StatusSeeOther)
+}
+
+func renderSettings(w http.ResponseWriter, r *http.Request, user *User, errs ValidationErrors, success string) {
+	current, err := GetUserByID(user.ID)
+	if err != nil {
+		log.Printf("Error fetching user: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	hasPassword, err := userHasPassword(user.ID)
+	if err != nil {
+		log.Printf("Error checking password: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	pending, err := GetPendingEmailChange(user.ID)
+	if err != nil {
+		log.Printf("Error fetching pending email change: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	history, err := GetUsernameHistory(user.ID)
+	if err != nil {
+		log.Printf("Error fetching username history: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	profile, err := getProfileFields(user.ID)
+	if err != nil {
+		log.Printf("Error fetching profile: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	// Keep what the user typed when the profile form is re-rendered with errors
+	if r.Method == http.MethodPost && r.FormValue("action") == "profile" {
+		profile = ProfileFields{Bio: r.FormValue("bio"), Location: r.FormValue("location"), Website: r.FormValue("website")}
+	}
+	avatarKey, err := getAvatarKey(user.ID)
+	if err != nil {
+		log.Printf("Error fetching avatar: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	export, err := getLatestExport(user.ID)
+	if err != nil {
+		log.Printf("Error fetching data export: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	blocked, err := getBlockedUsers(user.ID)
+	if err != nil {
+		log.Printf("Error fetching blocked users: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	muted, err := getMutedUsers(user.ID)
+	if err != nil {
+		log.Printf("Error fetching muted users: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	// Accounts without a password confirm sensitive changes with a provider
+	var reauthProviders []LinkedIdentity
+	if !hasPassword {
+		identities, err := getLinkedIdentities(user.ID)
+		if err != nil {
+			log.Printf("Error fetching linked accounts: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+		for _, li := range identities {
+			if _, ok := GetOAuthProvider(li.Provider); ok {
+				reauthProviders = append(reauthProviders, li)
+			}
+		}
+	}
+
+	data := map[string]interface{}{
+		"LoggedIn":            true,
+		"Username":            current.Username,
+		"Email":               current.Email,
+		"HasPassword":         hasPassword,
+		"ReauthProviders":     reauthProviders,
+		"Reauthenticated":     !hasPassword && recentlyReauthenticated(r, user.ID),
+		"PendingEmail":        pending,
+		"UsernameHistory":     history,
+		"Profile":             profile,
+		"AvatarURL":           AvatarURL(user.ID, avatarKey, AvatarSizeLarge),
+		"HasAvatar":           avatarKey != "",
+		"Export":              export,
+		"BlockedUsers":        blocked,
+		"MutedUsers":          muted,
+		"UnreadNotifications": UnreadNotificationCount(user.ID),
+		"UnreadMessages":      UnreadMessageCount(user.ID),
+		"Errors":              errs,
+		"Success":             success,
+	}
+	if success == "" {
+		switch r.URL.Query().Get("error") {
+		case "verification":
+			data["Message"] = "That confirmation link is invalid or has expired."
+		case "blockuser":
+			data["Message"] = "There is no other user with that username."
+		case "reauth":
+			data["Message"] = "That external account is not linked to yours, so it cannot confirm changes here."
+		}
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+
+	err = RenderTemplate(w, "settings.html", data)
+	if err != nil {
+		Error500Handler(w, r)
+	}
+}
+
+func settingsNotice(r *http.Request) string {
+	switch r.URL.Query().Get("saved") {
+	case "password":
+		return "Password changed. You have been signed out on every other device."
+	case "email":
+		return "Your email address has been updated."
+	case "username":
+		return "Username changed."
+	case "profile":
+		return "Profile updated."
+	case "avatar":
+		return "Avatar updated."
+	case "reauth":
+		return "Thanks for confirming. For the next few minutes you can change your email, set a password or delete your account."
+	}
+	if r.URL.Query().Get("export") == "queued" {
+		return "Your data export is being prepared. We will email you when it is ready to download."
+	}
+	return ""
+}
+
+func changePassword(r *http.Request, user *User, current, newPassword, confirm string) ValidationErrors {
+	errs := ValidationErrors{}
+	if msg := checkCurrentPassword(r, user, current); msg != "" {
+		errs.Add("current_password", msg)
+	}
+	if msg := ValidatePassword(newPassword, user.Username); msg != "" {
+		errs.Add("new_password", msg)
+	}
+	if newPassword != confirm {
+		errs.Add("confirm_password", "Passwords do not match")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("Error hashing password: %v", err)
+		errs.Add("new_password", "An error occurred. Please try again later.")
+		return errs
+	}
+	if err := ChangePassword(user.ID, string(hashedPassword)); err != nil {
+		log.Printf("Error changing password: %v", err)
+		errs.Add("new_password", "An error occurred. Please try again later.")
+	}
+	return errs
+}
+
+func requestEmailChange(r *http.Request, user *User, email, password string) (string, ValidationErrors) {
+	errs := ValidationErrors{}
+	if msg := checkCurrentPassword(r, user, password); msg != "" {
+		errs.Add("email_password", msg)
+	}
+	email, msg := ValidateEmail(email)
+	if msg != "" {
+		errs.Add("email", msg)
+	}
+	if len(errs) > 0 {
+		return "", errs
+	}
+
+	token, err := generateSessionToken()
+	if err != nil {
+		log.Printf("Error generating verification token: %v", err)
+		errs.Add("email", "An error occurred. Please try again later.")
+		return "", errs
+	}
+	err = CreateEmailChange(user.ID, email, token)
+	if err == ErrEmailTaken {
+		errs.Add("email", "An account with this email already exists")
+		return "", errs
+	}
+	if err != nil {
+		log.Printf("Error creating email change: %v", err)
+		errs.Add("email", "An error occurred. Please try again later.")
+		return "", errs
+	}
+
+	body := "Hi " + user.Username + ",\n\n" +
+		"Open this link to confirm the new email address for your Reboot Forums account:\n\n" +
+		siteURL() + "/settings/email/verify?token=" + token + "\n\n" +
+		"The link expires in " + emailVerificationTTL.String() + ". If you did not ask for this change, you can ignore this email.\n"
+	if err := sendMail(email, "Confirm your new email address", body); err != nil {
+		log.Printf("Error sending verification email: %v", err)
+		errs.Add("email", "We could not send the confirmation email. Please try again later.")
+		return "", errs
+	}
+	return email, errs
+}
+
+func changeUsername(user *User, username string) ValidationErrors {
+	errs := ValidationErrors{}
+	username, msg := ValidateUsername(username)
+	if msg != "" {
+		errs.Add("username", msg)
+		return errs
+	}
+
+	err := ChangeUsername(user.ID, username)
+	if err == ErrUsernameTaken {
+		errs.Add("username", "That username, or one that looks just like it, is already taken")
+	} else if err != nil {
+		log.Printf("Error changing username: %v", err)
+		errs.Add("username", "An error occurred. Please try again later.")
+	}
+	return errs
+}
+
+func deleteAccount(r *http.Request, user *User, mode, password, confirmUsername string) ValidationErrors {
+	errs := ValidationErrors{}
+	if mode != DeleteModeAnonymize && mode != DeleteModeDelete {
+		errs.Add("mode", "Choose what should happen to your posts and comments")
+	}
+	if msg := checkCurrentPassword(r, user, password); msg != "" {
+		errs.Add("delete_password", msg)
+	}
+	if confirmUsername != user.Username {
+		errs.Add("confirm_username", "Type your username exactly to confirm")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	if err := replaceAvatar(user.ID, ""); err != nil {
+		log.Printf("Error removing avatar: %v", err)
+		errs.Add("mode", "An error occurred. Please try again later.")
+		return errs
+	}
+	if err := removeUserExports(user.ID); err != nil {
+		log.Printf("Error removing data exports: %v", err)
+		errs.Add("mode", "An error occurred. Please try again later.")
+		return errs
+	}
+	var attachments []Attachment
+	if mode == DeleteModeDelete {
+		var err error
+		attachments, err = getUserAttachments(user.ID)
+		if err != nil {
+			log.Printf("Error fetching attachments: %v", err)
+			errs.Add("mode", "An error occurred. Please try again later.")
+			return errs
+		}
+	}
+	if err := DeleteAccount(user.ID, mode); err != nil {
+		log.Printf("Error deleting account: %v", err)
+		errs.Add("mode", "An error occurred. Please try again later.")
+		return errs
+	}
+	deleteAttachmentBlobs(attachments)
+	return errs
+}
+
+// reauthWindow is how long a fresh external login unlocks sensitive settings
+// for accounts without a password
+const reauthWindow = 10 * time.Minute
+
+// checkCurrentPassword verifies the user's password. Accounts created through an
+// external login have no password yet, so they must have signed in with the
+// provider again within reauthWindow instead.
+func checkCurrentPassword(r *http.Request, user *User, password string) string {
+	hasPassword, err := userHasPassword(user.ID)
+	if err != nil {
+		log.Printf("Error checking password: %v", err)
+		return "An error occurred. Please try again later."
+	}
+	if !hasPassword {
+		if !recentlyReauthenticated(r, user.ID) {
+			return "Confirm it's you with your external login first"
+		}
+		return ""
+	}
+	full, err := GetUserByUsername(user.Username)
+	if err != nil {
+		return "An error occurred. Please try again later."
+	}
+	if bcrypt.CompareHashAndPassword([]byte(full.Password), []byte(password)) != nil {
+		return "Incorrect password"
+	}
+	return ""
+}
+
+// recentlyReauthenticated reports whether this browser's session signed in
+// with an external login again within reauthWindow
+func recentlyReauthenticated(r *http.Request, userID int) bool {
+	c, err := r.Cookie("session_token")
+	if err != nil {
+		return false
+	}
+	var at sql.NullTime
+	err = DB.QueryRow("SELECT reauthenticated_at FROM sessions WHERE token = ? AND user_id = ?", c.Value, userID).Scan(&at)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error checking reauthentication: %v", err)
+	}
+	return at.Valid && time.Since(at.Time) < reauthWindow
+}
+
+func userHasPassword(userID int) (bool, error) {
+	var hasPassword bool
+	err := DB.QueryRow("SELECT has_password FROM users WHERE id = ?", userID).Scan(&hasPassword)
+	return hasPassword, err
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session_token",
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		Expires:  time.Now().Add(-1 * time.Hour),
+		MaxAge:   -1,
+	})
+}
@@ -0,0 +1,61 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Site setting keys
+const (
+	SettingRequireStaff2FA = "require_staff_2fa"
+	SettingSiteURL         = "site_url"
+	SettingTrustProxy      = "trust_proxy"
+	SettingProxyHops       = "proxy_hops"
+)
+
+// GetSetting returns the value stored for key, or def if it has never been set
+func GetSetting(key, def string) string {
+	var value string
+	err := DB.QueryRow("SELECT value FROM site_settings WHERE key = ?", key).Scan(&value)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error reading setting %s: %v", key, err)
+		}
+		return def
+	}
+	return value
+}
+
+// GetBoolSetting returns a setting parsed as a boolean
+func GetBoolSetting(key string, def bool) bool {
+	value, err := strconv.ParseBool(GetSetting(key, strconv.FormatBool(def)))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// GetIntSetting returns a setting parsed as an integer
+func GetIntSetting(key string, def int) int {
+	value, err := strconv.Atoi(GetSetting(key, strconv.Itoa(def)))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// SetSetting stores a site-wide setting
+func SetSetting(key, value string) error {
+	_, err := DB.Exec(`
+		INSERT INTO site_settings (key, value) VALUES (?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value
+	`, key, value)
+	return err
+}
+
+// siteURL returns the public base URL of the forum without a trailing slash
+func siteURL() string {
+	return strings.TrimRight(GetSetting(SettingSiteURL, "http://localhost:8080"), "/")
+}
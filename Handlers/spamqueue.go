@@ -0,0 +1,237 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HeldItem is a post or comment waiting for a moderator to approve it
+type HeldItem struct {
+	ID          int
+	Kind        string
+	UserID      int
+	Author      string
+	PostID      int
+	PostTitle   string
+	Title       string
+	Content     string
+	Categories  []int
+	Attachments []Attachment
+	Reasons     []FilterResult
+	IP          string
+	CreatedAt   time.Time
+}
+
+// HTML returns the held content rendered from Markdown
+func (h HeldItem) HTML() template.HTML {
+	return RenderMarkdown(h.Content)
+}
+
+// screenSubmission runs the content filters on something user is about to
+// publish. Staff skip the filters.
+func screenSubmission(user *User, kind, title, content string) (Submission, int, []FilterResult, error) {
+	s := Submission{Kind: kind, UserID: user.ID, Title: title, Content: content}
+	if actingStaff(user) {
+		return s, VerdictAllow, nil, nil
+	}
+	err := DB.QueryRow("SELECT created_at FROM users WHERE id = ?", user.ID).Scan(&s.AccountCreated)
+	if err != nil {
+		return s, VerdictAllow, nil, err
+	}
+	verdict, results := filterContent(s)
+	return s, verdict, results, nil
+}
+
+// holdContent puts a submission in the review queue
+func holdContent(h HeldItem) error {
+	categories, err := json.Marshal(h.Categories)
+	if err != nil {
+		return err
+	}
+	attachments, err := json.Marshal(h.Attachments)
+	if err != nil {
+		return err
+	}
+	reasons, err := json.Marshal(h.Reasons)
+	if err != nil {
+		return err
+	}
+	_, err = DB.Exec(`
+		INSERT INTO held_content (kind, user_id, post_id, title, content, categories, attachments, reasons, ip, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, h.Kind, h.UserID, nullableID(h.PostID), h.Title, h.Content, string(categories), string(attachments), string(reasons), h.IP, time.Now())
+	return err
+}
+
+const heldColumns = `
+	SELECT h.id, h.kind, h.user_id, u.username, COALESCE(h.post_id, 0), COALESCE(p.title, ''), h.title, h.content,
+	       h.categories, h.attachments, h.reasons, h.ip, h.created_at
+	FROM held_content h
+	JOIN users u ON u.id = h.user_id
+	LEFT JOIN posts p ON p.id = h.post_id`
+
+func scanHeldItem(row interface{ Scan(...interface{}) error }) (HeldItem, error) {
+	var h HeldItem
+	var categories, attachments, reasons string
+	err := row.Scan(&h.ID, &h.Kind, &h.UserID, &h.Author, &h.PostID, &h.PostTitle, &h.Title, &h.Content,
+		&categories, &attachments, &reasons, &h.IP, &h.CreatedAt)
+	if err != nil {
+		return h, err
+	}
+	if err := json.Unmarshal([]byte(categories), &h.Categories); err != nil {
+		return h, err
+	}
+	if err := json.Unmarshal([]byte(attachments), &h.Attachments); err != nil {
+		return h, err
+	}
+	return h, json.Unmarshal([]byte(reasons), &h.Reasons)
+}
+
+// getHeldContent returns the review queue, oldest first
+func getHeldContent() ([]HeldItem, error) {
+	rows, err := DB.Query(heldColumns + " ORDER BY h.created_at ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []HeldItem
+	for rows.Next() {
+		h, err := scanHeldItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, h)
+	}
+	return items, rows.Err()
+}
+
+// HeldContentCount returns how many posts and comments wait for review
+func HeldContentCount() int {
+	var count int
+	if err := DB.QueryRow("SELECT COUNT(*) FROM held_content").Scan(&count); err != nil {
+		log.Printf("Error counting held content: %v", err)
+	}
+	return count
+}
+
+// publishHeld publishes an approved item as if it had just been submitted
+func publishHeld(h HeldItem) (string, error) {
+	if h.Kind == "post" {
+		postID, err := createPost(h.UserID, h.Title, h.Content, h.Categories, h.Attachments)
+		return "/post/" + strconv.Itoa(postID), err
+	}
+	commentID, err := addComment(h.UserID, h.PostID, h.Content)
+	if err != nil {
+		return "", err
+	}
+	if comment, err := getComment(commentID); err != nil {
+		log.Printf("Error fetching new comment: %v", err)
+	} else {
+		publishComment(comment)
+	}
+	return "/post/" + strconv.Itoa(h.PostID) + "#comment-" + strconv.Itoa(commentID), nil
+}
+
+// ModSpamHandler lists the posts and comments the spam filter held
+func ModSpamHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, false)
+	if !ok {
+		return
+	}
+
+	items, err := getHeldContent()
+	if err != nil {
+		log.Printf("Error fetching held content: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	data := map[string]interface{}{
+		"LoggedIn": true,
+		"Username": user.Username,
+		"Items":    items,
+		"Decided":  r.URL.Query().Get("decided"),
+	}
+	if err := RenderTemplate(w, "mod-spam.html", data); err != nil {
+		log.Printf("Error rendering spam queue: %v", err)
+		Error500Handler(w, r)
+	}
+}
+
+// ModSpamDecisionHandler approves or rejects a held item. Either way the
+// decision trains the spam classifier.
+func ModSpamDecisionHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireStaff(w, r, false)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+	item, err := scanHeldItem(DB.QueryRow(heldColumns+" WHERE h.id = ?", id))
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching held content: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	decision := r.FormValue("decision")
+	if decision != "approved" && decision != "rejected" {
+		Error400Handler(w, r)
+		return
+	}
+
+	// Take the item out of the queue first so it cannot be decided twice
+	result, err := DB.Exec("DELETE FROM held_content WHERE id = ?", id)
+	if err != nil {
+		log.Printf("Error deciding held content: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		Error404Handler(w, r)
+		return
+	}
+
+	event := AuditEvent{Action: AuditSpamReject, TargetType: "held", TargetID: id, Target: item.Title,
+		Before: map[string]interface{}{"kind": item.Kind, "author": item.Author, "content": item.Content, "reasons": item.Reasons}}
+	if decision == "approved" {
+		link, err := publishHeld(item)
+		if err != nil {
+			if holdErr := holdContent(item); holdErr != nil {
+				log.Printf("Error putting back held content: %v", holdErr)
+			}
+			if err == sql.ErrNoRows || err == ErrLocked || err == ErrBlocked {
+				http.Error(w, "The post this comment was for is gone or locked, or its author blocked the commenter; reject the comment instead", http.StatusConflict)
+				return
+			}
+			log.Printf("Error publishing held content: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+		event.Action = AuditSpamApprove
+		event.After = map[string]string{"link": link}
+	} else {
+		deleteAttachmentBlobs(item.Attachments)
+	}
+	recordAudit(user, clientIP(r), event)
+
+	text := Submission{Title: item.Title, Content: item.Content}.Text()
+	if err := trainSpamFilter(text, decision == "rejected"); err != nil {
+		log.Printf("Error training spam filter: %v", err)
+	}
+	http.Redirect(w, r, "/mod/spam?decided="+decision, http.StatusSeeOther)
+}
@@ -0,0 +1,113 @@
+package RebootForums
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key from the RFC 6238 test vectors, "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// The RFC lists 8-digit codes; a 6-digit code is the last six of them
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(rfcSecret, totpStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatalf("totpCode at %d: %v", tt.unix, err)
+		}
+		if got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := totpStep(now)
+	codeAt := func(step int64) string {
+		code, err := totpCode(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", codeAt(current), 0, current, true},
+		{"one step behind", codeAt(current - 1), 0, current - 1, true},
+		{"one step ahead", codeAt(current + 1), 0, current + 1, true},
+		{"two steps behind", codeAt(current - 2), 0, 0, false},
+		{"two steps ahead", codeAt(current + 2), 0, 0, false},
+		{"spaces are ignored", codeAt(current)[:3] + " " + codeAt(current)[3:], 0, current, true},
+		{"too short", codeAt(current)[:5], 0, 0, false},
+		{"wrong code", "000000", 0, 0, false},
+		{"replay of the last step", codeAt(current), current, 0, false},
+		{"replay of an earlier step", codeAt(current - 1), current, 0, false},
+		{"newer than the last step", codeAt(current + 1), current, current + 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := validateTOTP(rfcSecret, tt.code, now, tt.lastStep)
+			if ok != tt.wantOK || step != tt.wantStep {
+				t.Errorf("validateTOTP(%q, last step %d) = %d, %v; want %d, %v",
+					tt.code, tt.lastStep, step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+// openTestDB points DB at a new database in a temporary directory
+func openTestDB(t *testing.T) {
+	t.Helper()
+	if err := InitDB(filepath.Join(t.TempDir(), "forum.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DB.Close() })
+	if err := CreateTables(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyMigrations(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyTOTPOnlyRejectsReplay(t *testing.T) {
+	openTestDB(t)
+	result, err := DB.Exec("INSERT INTO users (username, username_key, email, password, totp_secret, totp_enabled) VALUES ('alice', 'alice', 'alice@example.com', '', ?, 1)", rfcSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, _ := result.LastInsertId()
+	code, err := totpCode(rfcSecret, totpStep(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []bool{true, false} {
+		ok, err := verifyTOTPOnly(int(userID), code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("use %d of the same code: got %v, want %v", i+1, ok, want)
+		}
+	}
+}
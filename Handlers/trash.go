@@ -0,0 +1,240 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// TrashRetentionDays is how long deleted posts and comments can be restored
+// before the purge job removes them for good
+const TrashRetentionDays = 30
+
+// TrashItem is a deleted post or comment waiting to be purged
+type TrashItem struct {
+	Type        string
+	ID          int
+	PostID      int
+	Title       string
+	Content     string
+	AuthorID    int
+	Author      string
+	DeletedByID int
+	DeletedBy   string
+	DeletedAt   time.Time
+}
+
+// PurgeAt is when the item will be removed for good
+func (t TrashItem) PurgeAt() time.Time {
+	return t.DeletedAt.AddDate(0, 0, TrashRetentionDays)
+}
+
+// trashCutoff is the deletion time before which items are purged
+func trashCutoff() time.Time {
+	return time.Now().AddDate(0, 0, -TrashRetentionDays)
+}
+
+// softDeletePost moves a post to the trash. Its comments, likes and
+// attachments stay until the post is purged.
+func softDeletePost(postID, deletedBy int) error {
+	_, err := DB.Exec("UPDATE posts SET deleted_at = ?, deleted_by = ? WHERE id = ? AND deleted_at IS NULL",
+		time.Now(), deletedBy, postID)
+	return err
+}
+
+// softDeleteComment moves a comment to the trash
+func softDeleteComment(commentID, deletedBy int) error {
+	_, err := DB.Exec("UPDATE comments SET deleted_at = ?, deleted_by = ? WHERE id = ? AND deleted_at IS NULL",
+		time.Now(), deletedBy, commentID)
+	return err
+}
+
+// getTrashItem returns a deleted post or comment that can still be restored,
+// or sql.ErrNoRows
+func getTrashItem(itemType string, id int) (TrashItem, error) {
+	item := TrashItem{Type: itemType, ID: id}
+	var err error
+	switch itemType {
+	case "post":
+		err = DB.QueryRow(`
+			SELECT p.id, p.title, p.content, u.username, p.user_id, p.deleted_by, p.deleted_at
+			FROM posts p JOIN users u ON u.id = p.user_id
+			WHERE p.id = ? AND p.deleted_at > ?
+		`, id, trashCutoff()).Scan(&item.PostID, &item.Title, &item.Content, &item.Author, &item.AuthorID, &item.DeletedByID, &item.DeletedAt)
+	case "comment":
+		err = DB.QueryRow(`
+			SELECT c.post_id, p.title, c.content, u.username, c.user_id, c.deleted_by, c.deleted_at
+			FROM comments c JOIN posts p ON p.id = c.post_id JOIN users u ON u.id = c.user_id
+			WHERE c.id = ? AND c.deleted_at > ?
+		`, id, trashCutoff()).Scan(&item.PostID, &item.Title, &item.Content, &item.Author, &item.AuthorID, &item.DeletedByID, &item.DeletedAt)
+	default:
+		err = sql.ErrNoRows
+	}
+	return item, err
+}
+
+// getTrash lists the restorable posts and comments, newest deletion first.
+// Staff see everything; other users see what they deleted themselves.
+func getTrash(user *User) ([]TrashItem, error) {
+	rows, err := DB.Query(`
+		SELECT 'post', p.id, p.id, p.title, p.content, u.username, COALESCE(d.username, ''), p.deleted_at
+		FROM posts p
+		JOIN users u ON u.id = p.user_id
+		LEFT JOIN users d ON d.id = p.deleted_by
+		WHERE p.deleted_at > ? AND (? OR (p.user_id = ? AND p.deleted_by = ?))
+		UNION ALL
+		SELECT 'comment', c.id, c.post_id, p.title, c.content, u.username, COALESCE(d.username, ''), c.deleted_at
+		FROM comments c
+		JOIN posts p ON p.id = c.post_id
+		JOIN users u ON u.id = c.user_id
+		LEFT JOIN users d ON d.id = c.deleted_by
+		WHERE c.deleted_at > ? AND (? OR (c.user_id = ? AND c.deleted_by = ?))
+		ORDER BY 8 DESC
+	`, trashCutoff(), actingStaff(user), user.ID, user.ID, trashCutoff(), actingStaff(user), user.ID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []TrashItem
+	for rows.Next() {
+		var t TrashItem
+		if err := rows.Scan(&t.Type, &t.ID, &t.PostID, &t.Title, &t.Content, &t.Author, &t.DeletedBy, &t.DeletedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, t)
+	}
+	return items, rows.Err()
+}
+
+// TrashHandler lists deleted posts and comments that can still be restored
+func TrashHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	items, err := getTrash(user)
+	if err != nil {
+		log.Printf("Error fetching trash: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	data := map[string]interface{}{
+		"LoggedIn":            true,
+		"Username":            user.Username,
+		"IsStaff":             actingStaff(user),
+		"Items":               items,
+		"RetentionDays":       TrashRetentionDays,
+		"Deleted":             r.URL.Query().Get("deleted"),
+		"Restored":            r.URL.Query().Get("restored") == "1",
+		"UnreadNotifications": UnreadNotificationCount(user.ID),
+		"UnreadMessages":      UnreadMessageCount(user.ID),
+	}
+	if err := RenderTemplate(w, "trash.html", data); err != nil {
+		log.Printf("Error rendering trash: %v", err)
+		Error500Handler(w, r)
+	}
+}
+
+// RestoreHandler takes a post or comment out of the trash. Authors can undo
+// their own deletions; moderators can restore anything.
+func RestoreHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	itemType := r.PathValue("type")
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+	item, err := getTrashItem(itemType, id)
+	if err == sql.ErrNoRows || (err == nil && !actingStaff(user) && (item.AuthorID != user.ID || item.DeletedByID != user.ID)) {
+		Error404Handler(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching deleted %s: %v", itemType, err)
+		Error500Handler(w, r)
+		return
+	}
+	if !requireWritable(w, r, user) {
+		return
+	}
+
+	table := "posts"
+	action := AuditPostRestore
+	if itemType == "comment" {
+		table = "comments"
+		action = AuditCommentRestore
+	}
+	// The table name is one of the two above, never user input
+	if _, err := DB.Exec("UPDATE "+table+" SET deleted_at = NULL, deleted_by = NULL WHERE id = ?", id); err != nil {
+		log.Printf("Error restoring %s: %v", itemType, err)
+		Error500Handler(w, r)
+		return
+	}
+	if actingStaff(user) && item.AuthorID != user.ID {
+		recordAudit(user, clientIP(r), AuditEvent{Action: action, TargetType: itemType, TargetID: id, Target: item.Title,
+			After: map[string]string{"author": item.Author, "content": item.Content}})
+	}
+	http.Redirect(w, r, "/trash?restored=1", http.StatusSeeOther)
+}
+
+// purgeTrash removes posts and comments that have been in the trash for
+// longer than the retention period, with everything attached to them
+func purgeTrash() error {
+	for _, q := range []struct {
+		query string
+		purge func(int) error
+	}{
+		{"SELECT id FROM posts WHERE deleted_at <= ?", purgePost},
+		{"SELECT id FROM comments WHERE deleted_at <= ?", purgeComment},
+	} {
+		rows, err := DB.Query(q.query, trashCutoff())
+		if err != nil {
+			return err
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := q.purge(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// StartTrashPurger purges expired trash now and then every hour
+func StartTrashPurger() {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			if err := purgeTrash(); err != nil {
+				log.Printf("Error purging trash: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
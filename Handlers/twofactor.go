@@ -0,0 +1,448 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"rsc.io/qr"
+)
+
+const (
+	pendingLoginCookie      = "pending_login"
+	pendingLoginTTL         = 5 * time.Minute
+	maxSecondFactorAttempts = 5
+)
+
+// staffNeeds2FA reports whether the site policy forces this user to enroll before continuing
+func staffNeeds2FA(user *User) bool {
+	return user.IsStaff() && !user.TOTPEnabled && GetBoolSetting(SettingRequireStaff2FA, false)
+}
+
+// actingStaff reports whether user may use moderator powers right now. Staff
+// who still have to enroll in 2FA, or who are suspended, are treated as
+// ordinary users until they enroll or the suspension ends.
+func actingStaff(user *User) bool {
+	return user != nil && user.IsStaff() && !staffNeeds2FA(user) && suspendedMessage(user.ID) == ""
+}
+
+// LoginTwoFactorHandler handles the second login step for users with 2FA enabled
+func LoginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	c, err := r.Cookie(pendingLoginCookie)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	userID, attempts, err := getPendingLogin(c.Value)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error fetching pending login: %v", err)
+		}
+		clearPendingLoginCookie(w)
+		renderLogin(w, r, "Your login attempt expired. Please log in again.", true)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		RenderTemplate(w, "login-2fa.html", nil)
+		return
+	}
+
+	user, err := GetUserByID(userID)
+	if err != nil {
+		log.Printf("Error loading user for second factor: %v", err)
+		renderLogin(w, r, "An error occurred. Please try again later.", true)
+		return
+	}
+	ip := clientIP(r)
+	if wait := reserveLoginAttempt(user.Username, ip, time.Now()); wait > 0 {
+		deletePendingLogin(c.Value)
+		clearPendingLoginCookie(w)
+		recordLoginAttempt(r, user.Username, ip, LoginFailThrottled)
+		renderThrottledLogin(w, r, user.Username, ip, wait)
+		return
+	}
+
+	if attempts >= maxSecondFactorAttempts {
+		releaseLoginAttempt(user.Username, ip)
+		deletePendingLogin(c.Value)
+		clearPendingLoginCookie(w)
+		renderLogin(w, r, "Too many invalid codes. Please log in again.", true)
+		return
+	}
+
+	ok, err := verifySecondFactor(userID, r.FormValue("code"))
+	if err != nil {
+		releaseLoginAttempt(user.Username, ip)
+		log.Printf("Error verifying second factor: %v", err)
+		RenderTemplate(w, "login-2fa.html", map[string]interface{}{"Message": "An error occurred. Please try again later."})
+		return
+	}
+	if !ok {
+		if err := incrementPendingLoginAttempts(c.Value); err != nil {
+			log.Printf("Error recording second factor attempt: %v", err)
+		}
+		recordLoginAttempt(r, user.Username, ip, LoginFailBad2FA)
+		RenderTemplate(w, "login-2fa.html", map[string]interface{}{"Message": "Invalid authentication or recovery code"})
+		return
+	}
+
+	deletePendingLogin(c.Value)
+	clearPendingLoginCookie(w)
+	releaseLoginAttempt(user.Username, ip)
+	recordLoginSuccess(user.Username)
+
+	if err := startUserSession(w, r, userID); err != nil {
+		log.Printf("Error creating session: %v", err)
+		renderLogin(w, r, "An error occurred. Please try again later.", true)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// TwoFactorSettingsHandler shows enrollment and management of TOTP for the logged in user
+func TwoFactorSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserFromSession(r)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	hasPassword, err := userHasPassword(user.ID)
+	if err != nil {
+		log.Printf("Error checking password: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	data := map[string]interface{}{
+		"LoggedIn":        true,
+		"Username":        user.Username,
+		"Enabled":         user.TOTPEnabled,
+		"Required":        staffNeeds2FA(user),
+		"HasPassword":     hasPassword,
+		"Reauthenticated": !hasPassword && recentlyReauthenticated(r, user.ID),
+	}
+
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "enable":
+			codes, msg := enableTwoFactor(r, user, r.FormValue("password"), r.FormValue("code"))
+			if codes != nil {
+				data["Enabled"] = true
+				data["Required"] = false
+				data["RecoveryCodes"] = codes
+				data["Success"] = "Two-factor authentication is now enabled. Store these recovery codes somewhere safe; they will not be shown again."
+			} else {
+				data["Message"] = msg
+			}
+		case "regenerate":
+			codes, msg := regenerateRecoveryCodes(user, r.FormValue("code"))
+			if codes != nil {
+				data["RecoveryCodes"] = codes
+				data["Success"] = "New recovery codes generated. Your old codes no longer work."
+			} else {
+				data["Message"] = msg
+			}
+		case "disable":
+			msg := disableTwoFactor(r, user, r.FormValue("password"), r.FormValue("code"))
+			if msg == "" {
+				data["Enabled"] = false
+				data["Success"] = "Two-factor authentication has been disabled."
+			} else {
+				data["Message"] = msg
+			}
+		default:
+			Error400Handler(w, r)
+			return
+		}
+	}
+
+	if enabled, _ := data["Enabled"].(bool); !enabled {
+		secret, err := getOrCreateEnrollmentSecret(user.ID)
+		if err != nil {
+			log.Printf("Error preparing 2FA enrollment: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+		uri := totpURI(user.Username, secret)
+		code, err := qr.Encode(uri, qr.M)
+		if err != nil {
+			log.Printf("Error encoding 2FA QR code: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+		data["Secret"] = secret
+		data["QRCode"] = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(code.PNG()))
+	}
+
+	if r.URL.Query().Get("required") == "1" && data["Required"] == true {
+		data["Message"] = "Your role requires two-factor authentication. Please enroll to continue."
+	}
+
+	err = RenderTemplate(w, "two-factor.html", data)
+	if err != nil {
+		Error500Handler(w, r)
+	}
+}
+
+func enableTwoFactor(r *http.Request, user *User, password, code string) ([]string, string) {
+	if user.TOTPEnabled {
+		return nil, "Two-factor authentication is already enabled"
+	}
+	// Otherwise someone at an unlocked, signed-in browser could enroll their
+	// own device and lock the owner out
+	if msg := checkCurrentPassword(r, user, password); msg != "" {
+		return nil, msg
+	}
+	secret, _, _, err := getTOTPState(user.ID)
+	if err != nil || !secret.Valid {
+		return nil, "Enrollment expired, please scan the new QR code"
+	}
+	step, ok := validateTOTP(secret.String, code, time.Now(), 0)
+	if !ok {
+		return nil, "That code is not valid. Check your device clock and try again."
+	}
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		log.Printf("Error generating recovery codes: %v", err)
+		return nil, "An error occurred. Please try again later."
+	}
+	if err := enableTOTP(user.ID, step, codes); err != nil {
+		log.Printf("Error enabling 2FA: %v", err)
+		return nil, "An error occurred. Please try again later."
+	}
+	return codes, ""
+}
+
+func regenerateRecoveryCodes(user *User, code string) ([]string, string) {
+	if !user.TOTPEnabled {
+		return nil, "Two-factor authentication is not enabled"
+	}
+	ok, err := verifyTOTPOnly(user.ID, code)
+	if err != nil {
+		log.Printf("Error verifying TOTP: %v", err)
+		return nil, "An error occurred. Please try again later."
+	}
+	if !ok {
+		return nil, "That code is not valid"
+	}
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		log.Printf("Error generating recovery codes: %v", err)
+		return nil, "An error occurred. Please try again later."
+	}
+	if err := replaceRecoveryCodes(user.ID, codes); err != nil {
+		log.Printf("Error storing recovery codes: %v", err)
+		return nil, "An error occurred. Please try again later."
+	}
+	return codes, ""
+}
+
+func disableTwoFactor(r *http.Request, user *User, password, code string) string {
+	if !user.TOTPEnabled {
+		return "Two-factor authentication is not enabled"
+	}
+	if user.IsStaff() && GetBoolSetting(SettingRequireStaff2FA, false) {
+		return "Your role requires two-factor authentication, so it cannot be disabled"
+	}
+	if msg := checkCurrentPassword(r, user, password); msg != "" {
+		return msg
+	}
+	ok, err := verifySecondFactor(user.ID, code)
+	if err != nil {
+		log.Printf("Error verifying second factor: %v", err)
+		return "An error occurred. Please try again later."
+	}
+	if !ok {
+		return "That code is not valid"
+	}
+	if err := disableTOTP(user.ID); err != nil {
+		log.Printf("Error disabling 2FA: %v", err)
+		return "An error occurred. Please try again later."
+	}
+	return ""
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused recovery code
+func verifySecondFactor(userID int, code string) (bool, error) {
+	ok, err := verifyTOTPOnly(userID, code)
+	if err != nil || ok {
+		return ok, err
+	}
+	return useRecoveryCode(userID, code)
+}
+
+func verifyTOTPOnly(userID int, code string) (bool, error) {
+	secret, enabled, lastStep, err := getTOTPState(userID)
+	if err != nil {
+		return false, err
+	}
+	if !enabled || !secret.Valid {
+		return false, nil
+	}
+	step, ok := validateTOTP(secret.String, code, time.Now(), lastStep)
+	if !ok {
+		return false, nil
+	}
+	// Only one request can move past a step, so the same code cannot be
+	// replayed by a second request racing the first
+	result, err := DB.Exec("UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?", step, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func getTOTPState(userID int) (secret sql.NullString, enabled bool, lastStep int64, err error) {
+	err = DB.QueryRow("SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = ?", userID).Scan(&secret, &enabled, &lastStep)
+	return
+}
+
+// getOrCreateEnrollmentSecret keeps the same secret across page reloads until enrollment completes
+func getOrCreateEnrollmentSecret(userID int) (string, error) {
+	secret, enabled, _, err := getTOTPState(userID)
+	if err != nil {
+		return "", err
+	}
+	if secret.Valid && !enabled {
+		return secret.String, nil
+	}
+	newSecret, err := generateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	_, err = DB.Exec("UPDATE users SET totp_secret = ?, totp_enabled = 0 WHERE id = ?", newSecret, userID)
+	return newSecret, err
+}
+
+func enableTOTP(userID int, step int64, codes []string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE users SET totp_enabled = 1, totp_last_step = ? WHERE id = ?", step, userID)
+	if err != nil {
+		return err
+	}
+	if err := insertRecoveryCodes(tx, userID, codes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func disableTOTP(userID int) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE users SET totp_secret = NULL, totp_enabled = 0, totp_last_step = 0 WHERE id = ?", userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(userID int, codes []string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertRecoveryCodes(tx, userID, codes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertRecoveryCodes(tx *sql.Tx, userID int, codes []string) error {
+	_, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	for _, code := range codes {
+		_, err = tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hashRecoveryCode(code))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// useRecoveryCode marks a matching unused recovery code as spent
+func useRecoveryCode(userID int, code string) (bool, error) {
+	if code == "" {
+		return false, nil
+	}
+	result, err := DB.Exec("UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		time.Now(), userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// createPendingLogin records a user that passed the password check but still owes a second factor
+func createPendingLogin(w http.ResponseWriter, r *http.Request, userID int) error {
+	token, err := generateSessionToken()
+	if err != nil {
+		return err
+	}
+	expiry := time.Now().Add(pendingLoginTTL)
+	_, err = DB.Exec("INSERT INTO pending_logins (token, user_id, expiry) VALUES (?, ?, ?)", token, userID, expiry)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     pendingLoginCookie,
+		Value:    token,
+		Expires:  expiry,
+		Path:     "/login",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func getPendingLogin(token string) (userID int, attempts int, err error) {
+	err = DB.QueryRow("SELECT user_id, attempts FROM pending_logins WHERE token = ? AND expiry > ?", token, time.Now()).Scan(&userID, &attempts)
+	return
+}
+
+func incrementPendingLoginAttempts(token string) error {
+	_, err := DB.Exec("UPDATE pending_logins SET attempts = attempts + 1 WHERE token = ?", token)
+	return err
+}
+
+func deletePendingLogin(token string) {
+	_, err := DB.Exec("DELETE FROM pending_logins WHERE token = ? OR expiry < ?", token, time.Now())
+	if err != nil {
+		log.Printf("Error deleting pending login: %v", err)
+	}
+}
+
+func clearPendingLoginCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     pendingLoginCookie,
+		Value:    "",
+		Path:     "/login",
+		HttpOnly: true,
+		MaxAge:   -1,
+	})
+}
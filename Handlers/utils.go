@@ -4,12 +4,20 @@ import (
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
+	"strings"
 )
 
+// templateFuncs are available to every page template
+var templateFuncs = template.FuncMap{
+	"announcements": getAnnouncements,
+}
+
 // RenderTemplate renders a template with the given data
 func RenderTemplate(w http.ResponseWriter, tmplName string, data interface{}) error {
-	tmpl, err := template.ParseFiles("templates/" + tmplName)
+	tmpl, err := template.New(tmplName).Funcs(templateFuncs).ParseFiles("templates/" + tmplName)
 	if err != nil {
 		log.Printf("Error parsing template: %v", err)
 		return fmt.Errorf("error parsing template: %v", err)
@@ -23,3 +31,38 @@ func RenderTemplate(w http.ResponseWriter, tmplName string, data interface{}) er
 
 	return nil
 }
+
+// clientIP returns the address of the client. X-Forwarded-For is only
+// honoured when the trust_proxy setting says we run behind a reverse proxy,
+// and then only the entry our own proxies added: anything to the left of it
+// came from the client and can be forged.
+func clientIP(r *http.Request) string {
+	if GetBoolSetting(SettingTrustProxy, false) {
+		if ip, ok := forwardedIP(r.Header.Values("X-Forwarded-For"), GetIntSetting(SettingProxyHops, 1)); ok {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// forwardedIP picks the client address from X-Forwarded-For headers passed
+// through hops trusted proxies. Each proxy appends the address it saw, so the
+// client is hops entries from the right.
+func forwardedIP(headers []string, hops int) (string, bool) {
+	var entries []string
+	for _, header := range headers {
+		entries = append(entries, strings.Split(header, ",")...)
+	}
+	if hops < 1 || len(entries) < hops {
+		return "", false
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(entries[len(entries)-hops]))
+	if err != nil {
+		return "", false
+	}
+	return addr.Unmap().String(), true
+}
@@ -0,0 +1,35 @@
+package RebootForums
+
+import "testing"
+
+func TestForwardedIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		hops    int
+		want    string
+		wantOK  bool
+	}{
+		{"one proxy", []string{"203.0.113.7"}, 1, "203.0.113.7", true},
+		{"forged entries are skipped", []string{"1.2.3.4, 5.6.7.8, 203.0.113.7"}, 1, "203.0.113.7", true},
+		{"two proxies", []string{"1.2.3.4, 203.0.113.7, 10.0.0.2"}, 2, "203.0.113.7", true},
+		{"entries across headers", []string{"1.2.3.4", "203.0.113.7, 10.0.0.2"}, 2, "203.0.113.7", true},
+		{"spaces around entries", []string{" 1.2.3.4 ,  203.0.113.7 "}, 1, "203.0.113.7", true},
+		{"IPv6", []string{"2001:db8::1"}, 1, "2001:db8::1", true},
+		{"IPv4-mapped IPv6", []string{"::ffff:203.0.113.7"}, 1, "203.0.113.7", true},
+		{"fewer entries than hops", []string{"203.0.113.7"}, 2, "", false},
+		{"no header", nil, 1, "", false},
+		{"zero hops", []string{"203.0.113.7"}, 0, "", false},
+		{"not an address", []string{"1.2.3.4, unknown"}, 1, "", false},
+		{"address with port", []string{"203.0.113.7:8080"}, 1, "", false},
+		{"empty entry", []string{"1.2.3.4,"}, 1, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := forwardedIP(tt.headers, tt.hops)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("forwardedIP(%q, %d) = %q, %v; want %q, %v", tt.headers, tt.hops, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,352 @@
+package RebootForums
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net/mail"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mattn/go-sqlite3"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Registration field limits
+const (
+	MinUsernameLength = 3
+	MaxUsernameLength = 20
+	MaxEmailLength    = 254
+	MinPasswordLength = 8
+	// bcrypt ignores everything after 72 bytes, so longer passwords are refused
+	MaxPasswordBytes = 72
+)
+
+// PasswordBlocklistPath is the file of breached passwords, one per line
+var PasswordBlocklistPath = "data/breached-passwords.txt"
+
+// ValidationErrors maps a form field name to a message for that field
+type ValidationErrors map[string]string
+
+// Add records msg for field unless the field already has an error
+func (v ValidationErrors) Add(field, msg string) {
+	if _, exists := v[field]; !exists {
+		v[field] = msg
+	}
+}
+
+// RegistrationForm holds the submitted registration values for re-rendering
+type RegistrationForm struct {
+	Username string
+	Email    string
+}
+
+// scriptGroups are the writing systems a username may use. Letters from
+// different groups cannot be mixed, which blocks most homograph tricks.
+var scriptGroups = []struct {
+	name   string
+	tables []*unicode.RangeTable
+}{
+	{"Latin", []*unicode.RangeTable{unicode.Latin}},
+	{"Cyrillic", []*unicode.RangeTable{unicode.Cyrillic}},
+	{"Greek", []*unicode.RangeTable{unicode.Greek}},
+	{"Arabic", []*unicode.RangeTable{unicode.Arabic}},
+	{"Hebrew", []*unicode.RangeTable{unicode.Hebrew}},
+	{"Devanagari", []*unicode.RangeTable{unicode.Devanagari}},
+	{"Thai", []*unicode.RangeTable{unicode.Thai}},
+	{"Hangul", []*unicode.RangeTable{unicode.Hangul}},
+	{"CJK", []*unicode.RangeTable{unicode.Han, unicode.Hiragana, unicode.Katakana}},
+}
+
+// confusables maps lower-case characters to the Latin character they are
+// commonly mistaken for. Applied after NFKC normalisation and lower-casing,
+// so "I" (capital i) and "l" fold together through 'i'.
+var confusables = map[rune]rune{
+	// ASCII lookalikes
+	'0': 'o', '1': 'l', 'i': 'l', '|': 'l', '-': '_', '.': '_',
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o',
+	'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'l', 'ј': 'j', 'ѕ': 's',
+	'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ζ': 'z', 'η': 'n', 'ι': 'l', 'κ': 'k', 'μ': 'u',
+	'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+}
+
+// UsernameKey folds a username to a canonical form so that names which only
+// differ by case, width, separators or lookalike characters compare equal.
+func UsernameKey(username string) string {
+	normalized := strings.ToLower(norm.NFKC.String(username))
+	var b strings.Builder
+	for _, r := range normalized {
+		if mapped, ok := confusables[r]; ok {
+			r = mapped
+		}
+		b.WriteRune(r)
+	}
+	// "rn" renders almost exactly like "m" in most fonts
+	return strings.ReplaceAll(b.String(), "rn", "m")
+}
+
+// ValidateUsername checks length and character rules and returns the NFKC-normalised name
+func ValidateUsername(username string) (string, string) {
+	username = norm.NFKC.String(strings.TrimSpace(username))
+	length := utf8.RuneCountInString(username)
+	if length < MinUsernameLength || length > MaxUsernameLength {
+		return username, "Username must be between 3 and 20 characters"
+	}
+
+	script := ""
+	for i, r := range username {
+		switch {
+		case unicode.IsLetter(r):
+			group := letterScript(r)
+			if group == "" {
+				return username, "Username contains unsupported characters"
+			}
+			if script != "" && script != group {
+				return username, "Username cannot mix letters from different alphabets"
+			}
+			script = group
+		case unicode.Is(unicode.Nd, r):
+			if r > unicode.MaxASCII {
+				return username, "Username digits must be 0-9"
+			}
+		case r == '_' || r == '-' || r == '.':
+			if i == 0 {
+				return username, "Username must start with a letter or digit"
+			}
+		default:
+			return username, "Username can only contain letters, digits, '_', '-' and '.'"
+		}
+	}
+	return username, ""
+}
+
+func letterScript(r rune) string {
+	for _, group := range scriptGroups {
+		for _, table := range group.tables {
+			if unicode.Is(table, r) {
+				return group.name
+			}
+		}
+	}
+	return ""
+}
+
+// ValidateEmail parses an RFC 5322 address and returns it with a lower-cased domain
+func ValidateEmail(email string) (string, string) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return email, "Email is required"
+	}
+	if len(email) > MaxEmailLength {
+		return email, "Email is too long"
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return email, "Enter a valid email address, like name@example.com"
+	}
+	at := strings.LastIndex(addr.Address, "@")
+	local, domain := addr.Address[:at], strings.ToLower(addr.Address[at+1:])
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return email, "Enter a valid email address, like name@example.com"
+	}
+	return local + "@" + domain, ""
+}
+
+// ValidatePassword enforces the policy shown on the registration form and
+// rejects passwords from the breached-password blocklist
+func ValidatePassword(password, username string) string {
+	if utf8.RuneCountInString(password) < MinPasswordLength {
+		return "Password must be at least 8 characters long"
+	}
+	if len(password) > MaxPasswordBytes {
+		return "Password must be at most 72 bytes long"
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSpecial bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			hasSpecial = true
+		}
+	}
+	if !hasUpper || !hasLower || !hasDigit || !hasSpecial {
+		return "Password needs an uppercase letter, a lowercase letter, a number and a special character"
+	}
+
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return "Password must not contain your username"
+	}
+	if isBreachedPassword(password) {
+		return "This password has appeared in a data breach. Please choose a different one."
+	}
+	return ""
+}
+
+var (
+	breachedPasswords     map[string]struct{}
+	breachedPasswordsOnce sync.Once
+)
+
+// isBreachedPassword checks the blocklist, loading it on first use. Entries
+// are compared case-insensitively so "Password1!" matches "password1!".
+func isBreachedPassword(password string) bool {
+	breachedPasswordsOnce.Do(loadBreachedPasswords)
+	_, found := breachedPasswords[strings.ToLower(password)]
+	return found
+}
+
+func loadBreachedPasswords() {
+	breachedPasswords = make(map[string]struct{})
+	f, err := os.Open(PasswordBlocklistPath)
+	if err != nil {
+		log.Printf("Password blocklist not loaded: %v", err)
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		breachedPasswords[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Error reading password blocklist: %v", err)
+	}
+	log.Printf("Loaded %d breached passwords", len(breachedPasswords))
+}
+
+// usernameTaken reports whether another user already has a name that folds to the same key
+func usernameTaken(username string, exceptUserID int) (bool, error) {
+	var exists bool
+	err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username_key = ? AND id != ?)",
+		UsernameKey(username), exceptUserID).Scan(&exists)
+	return exists, err
+}
+
+// isUniqueViolation reports whether err is SQLite refusing a duplicate value
+// in column, given as "table.column"
+func isUniqueViolation(err error, column string) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) || sqliteErr.ExtendedCode != sqlite3.ErrConstraintUnique {
+		return false
+	}
+	// The message reads "UNIQUE constraint failed: users.email"
+	_, columns, _ := strings.Cut(sqliteErr.Error(), "failed: ")
+	return slices.Contains(strings.Split(columns, ", "), column)
+}
+
+// isUsernameConflict reports whether err is an insert or update losing a race
+// for a username, or one that looks just like it
+func isUsernameConflict(err error) bool {
+	return isUniqueViolation(err, "users.username") || isUniqueViolation(err, "users.username_key")
+}
+
+// emailTaken reports whether another user already registered the email, ignoring case
+func emailTaken(email string, exceptUserID int) (bool, error) {
+	var exists bool
+	err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email) = LOWER(?) AND id != ?)",
+		email, exceptUserID).Scan(&exists)
+	return exists, err
+}
+
+// validateRegistration runs every registration rule and returns the cleaned form values
+func validateRegistration(username, email, password string) (RegistrationForm, ValidationErrors, error) {
+	errs := ValidationErrors{}
+	form := RegistrationForm{}
+
+	var msg string
+	form.Username, msg = ValidateUsername(username)
+	if msg != "" {
+		errs.Add("username", msg)
+	}
+	form.Email, msg = ValidateEmail(email)
+	if msg != "" {
+		errs.Add("email", msg)
+	}
+	if msg = ValidatePassword(password, form.Username); msg != "" {
+		errs.Add("password", msg)
+	}
+
+	if _, bad := errs["username"]; !bad {
+		taken, err := usernameTaken(form.Username, 0)
+		if err != nil {
+			return form, errs, err
+		}
+		if taken {
+			errs.Add("username", "That username, or one that looks just like it, is already taken")
+		}
+	}
+	if _, bad := errs["email"]; !bad {
+		taken, err := emailTaken(form.Email, 0)
+		if err != nil {
+			return form, errs, err
+		}
+		if taken {
+			errs.Add("email", "An account with this email already exists")
+		}
+	}
+	return form, errs, nil
+}
+
+// BackfillUsernameKeys computes username_key for users created before the column existed
+func BackfillUsernameKeys() error {
+	rows, err := DB.Query("SELECT id, username FROM users WHERE username_key IS NULL")
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		id       int
+		username string
+	}
+	var users []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.username); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, p)
+	}
+	rows.Close()
+
+	for _, u := range users {
+		_, err := DB.Exec("UPDATE users SET username_key = ? WHERE id = ?", UsernameKey(u.username), u.id)
+		if isUniqueViolation(err, "users.username_key") {
+			log.Printf("Username %q (user %d) looks just like another account's name; rename it so lookalikes are blocked", u.username, u.id)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearDuplicateUsernameKeys removes username_key from every account whose
+// name folds to the same key as an older account's, so the key can be made
+// unique. BackfillUsernameKeys logs them until they are renamed.
+func clearDuplicateUsernameKeys() error {
+	_, err := DB.Exec(`
+		UPDATE users SET username_key = NULL
+		WHERE username_key IS NOT NULL AND EXISTS(
+			SELECT 1 FROM users older WHERE older.username_key = users.username_key AND older.id < users.id
+		)
+	`)
+	return err
+}
@@ -0,0 +1,51 @@
+package RebootForums
+
+import "testing"
+
+func TestUsernameKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		want     string
+	}{
+		{"lower case", "bob", "bob"},
+		{"upper case", "BOB", "bob"},
+		{"full width", "ＢＯＢ", "bob"},
+		{"digit zero as o", "b0b", "bob"},
+		{"digit one and i as l", "1ris", "lrls"},
+		{"capital i as l", "Iris", "lrls"},
+		{"separators", "john.doe-x", "john_doe_x"},
+		{"rn as m", "adrnin", "admln"},
+		{"Cyrillic lookalikes", "раураl", "paypal"},
+		{"Greek lookalikes", "κοτ", "kot"},
+		{"other letters unchanged", "zoë", "zoë"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := UsernameKey(tt.username); got != tt.want {
+				t.Errorf("UsernameKey(%q) = %q, want %q", tt.username, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsernameKeyCollisions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"alice", "ALICE", true},
+		{"alice", "аlice", true}, // Cyrillic а
+		{"admin", "adrnin", true},
+		{"bob_1", "bob-l", true},
+		{"paul", "pau1", true},
+		{"alice", "alicia", false},
+		{"bob", "bop", false},
+		{"mary", "nary", false},
+	}
+	for _, tt := range tests {
+		if same := UsernameKey(tt.a) == UsernameKey(tt.b); same != tt.same {
+			t.Errorf("%q and %q: same key = %v, want %v", tt.a, tt.b, same, tt.same)
+		}
+	}
+}
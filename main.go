@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strings"
 
 	RebootForums "RebootForums/Handlers"
 
@@ -37,6 +39,47 @@ func main() {
 		log.Fatal("Failed to add updated_at column:", err)
 	}
 
+	// Add columns introduced after the initial schema
+	err = RebootForums.ApplyMigrations()
+	if err != nil {
+		log.Fatal("Failed to apply migrations:", err)
+	}
+
+	// Bootstrap admins from a comma separated list of usernames
+	if admins := os.Getenv("FORUM_ADMINS"); admins != "" {
+		err = RebootForums.PromoteUsers(RebootForums.RoleAdmin, strings.Split(admins, ","))
+		if err != nil {
+			log.Fatal("Failed to promote admins:", err)
+		}
+	}
+
+	// Send email through SMTP when configured; otherwise emails are written to the log
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		RebootForums.SetMailer(RebootForums.SMTPMailer{
+			Addr:     addr,
+			From:     os.Getenv("SMTP_FROM"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		})
+	}
+
+	// Keep uploads in an S3 compatible bucket when configured; otherwise under data/blobs
+	if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
+		store := RebootForums.NewS3BlobStore(endpoint, os.Getenv("S3_REGION"), os.Getenv("S3_BUCKET"),
+			os.Getenv("S3_ACCESS_KEY"), os.Getenv("S3_SECRET_KEY"))
+		store.PublicURL = os.Getenv("S3_PUBLIC_URL")
+		RebootForums.SetBlobStore(store)
+	}
+
+	// Build queued personal data exports in the background
+	RebootForums.StartExportWorker()
+
+	// Remove posts and comments that have been in the trash too long
+	RebootForums.StartTrashPurger()
+
+	// Forget failed logins once they are too old to be useful
+	RebootForums.StartLoginAttemptPurger()
+
 	// Get the absolute path to the templates directory
 	templatesDir, err := filepath.Abs("./templates")
 	if err != nil {
@@ -52,16 +95,79 @@ func main() {
 
 	// Set up routes
 	mux.HandleFunc("/", RebootForums.HomeHandler)
-	mux.HandleFunc("POST /register", makeHandler(RebootForums.RegisterHandler))
-	mux.HandleFunc("POST /login", makeHandler(RebootForums.LoginHandler))
+	mux.HandleFunc("/register", makeHandler(RebootForums.RateLimit(RebootForums.RegisterRateLimit, RebootForums.RegisterHandler)))
+	mux.HandleFunc("/login", makeHandler(RebootForums.LoginHandler))
+	mux.HandleFunc("GET /captcha/{id}/image", makeHandler(RebootForums.CaptchaHandler))
+	mux.HandleFunc("GET /captcha/{id}/audio", makeHandler(RebootForums.CaptchaAudioHandler))
+	mux.HandleFunc("/login/2fa", makeHandler(RebootForums.LoginTwoFactorHandler))
 	mux.HandleFunc("/logout", makeHandler(RebootForums.LogoutHandler))
 	// Post-related routes
-	mux.HandleFunc("/create-post", makeHandler(RebootForums.CreatePostFormHandler))
+	mux.HandleFunc("/create-post", makeHandler(RebootForums.RateLimit(RebootForums.PostRateLimit, RebootForums.CreatePostFormHandler)))
 	mux.HandleFunc("/post/", makeHandler(RebootForums.ViewPostHandler))
-	mux.HandleFunc("DELETE /delete-post/", makeHandler(RebootForums.DeletePostHandler))
-	mux.HandleFunc("/like-post", makeHandler(RebootForums.LikePostHandler))
-	mux.HandleFunc("/like-comment", makeHandler(RebootForums.LikeCommentHandler))
-	mux.HandleFunc("/add-comment", makeHandler(RebootForums.AddCommentHandler))
+	mux.HandleFunc("POST /delete-post/", makeHandler(RebootForums.DeletePostHandler))
+	mux.HandleFunc("GET /trash", makeHandler(RebootForums.TrashHandler))
+	mux.HandleFunc("POST /trash/{type}/{id}/restore", makeHandler(RebootForums.RestoreHandler))
+	mux.HandleFunc("/like-post", makeHandler(RebootForums.RateLimit(RebootForums.VoteRateLimit, RebootForums.LikePostHandler)))
+	mux.HandleFunc("/like-comment", makeHandler(RebootForums.RateLimit(RebootForums.VoteRateLimit, RebootForums.LikeCommentHandler)))
+	mux.HandleFunc("/add-comment", makeHandler(RebootForums.RateLimit(RebootForums.CommentRateLimit, RebootForums.AddCommentHandler)))
+	mux.HandleFunc("GET /auth/{provider}/login", makeHandler(RebootForums.OAuthLoginHandler))
+	mux.HandleFunc("GET /auth/{provider}/callback", makeHandler(RebootForums.OAuthCallbackHandler))
+	mux.HandleFunc("GET /user/{username}", makeHandler(RebootForums.ProfileHandler))
+	mux.HandleFunc("GET /api/users/suggest", makeHandler(RebootForums.UserSuggestHandler))
+	mux.HandleFunc("GET /events", makeHandler(RebootForums.EventsHandler))
+	mux.HandleFunc("GET /chat/{id}", makeHandler(RebootForums.ChatRoomHandler))
+	mux.HandleFunc("GET /chat/{id}/ws", makeHandler(RebootForums.ChatSocketHandler))
+	mux.HandleFunc("GET /messages", makeHandler(RebootForums.InboxHandler))
+	mux.HandleFunc("POST /messages", makeHandler(RebootForums.InboxHandler))
+	mux.HandleFunc("GET /messages/{id}", makeHandler(RebootForums.ConversationHandler))
+	mux.HandleFunc("POST /messages/{id}", makeHandler(RebootForums.ConversationHandler))
+	mux.HandleFunc("POST /messages/report/{id}", makeHandler(RebootForums.ReportMessageHandler))
+	mux.HandleFunc("POST /user/{username}/block", makeHandler(RebootForums.BlockUserHandler))
+	mux.HandleFunc("POST /user/{username}/mute", makeHandler(RebootForums.MuteUserHandler))
+	mux.HandleFunc("POST /report", makeHandler(RebootForums.ReportHandler))
+	mux.HandleFunc("GET /mod/queue", makeHandler(RebootForums.ModQueueHandler))
+	mux.HandleFunc("POST /mod/queue/{type}/{id}", makeHandler(RebootForums.ModResolveReportHandler))
+	mux.HandleFunc("GET /mod/sanctions", makeHandler(RebootForums.ModSanctionsHandler))
+	mux.HandleFunc("POST /mod/sanctions", makeHandler(RebootForums.ModSanctionHandler))
+	mux.HandleFunc("POST /mod/sanctions/{id}/lift", makeHandler(RebootForums.ModLiftSanctionHandler))
+	mux.HandleFunc("POST /mod/ip-bans", makeHandler(RebootForums.ModIPBanHandler))
+	mux.HandleFunc("POST /mod/ip-bans/{id}/lift", makeHandler(RebootForums.ModLiftIPBanHandler))
+	mux.HandleFunc("GET /mod/messages", makeHandler(RebootForums.ModMessageReportsHandler))
+	mux.HandleFunc("POST /mod/messages/{id}", makeHandler(RebootForums.ModResolveMessageReportHandler))
+	mux.HandleFunc("GET /mod/spam", makeHandler(RebootForums.ModSpamHandler))
+	mux.HandleFunc("POST /mod/spam/{id}", makeHandler(RebootForums.ModSpamDecisionHandler))
+	mux.HandleFunc("POST /mod/post/{id}/state", makeHandler(RebootForums.ModPostStateHandler))
+	mux.HandleFunc("GET /notifications", makeHandler(RebootForums.NotificationsHandler))
+	mux.HandleFunc("GET /notifications/{id}", makeHandler(RebootForums.OpenNotificationHandler))
+	mux.HandleFunc("POST /notifications/read", makeHandler(RebootForums.MarkNotificationsReadHandler))
+	mux.HandleFunc("POST /notifications/preferences", makeHandler(RebootForums.NotificationPreferencesHandler))
+	mux.HandleFunc("GET /identicon/{id}", makeHandler(RebootForums.IdenticonHandler))
+	mux.HandleFunc("GET /media/{key...}", makeHandler(RebootForums.MediaHandler))
+	mux.HandleFunc("GET /attachments/{id}", makeHandler(RebootForums.AttachmentHandler))
+	mux.HandleFunc("GET /attachments/{id}/thumb", makeHandler(RebootForums.AttachmentThumbHandler))
+	// Account settings routes
+	mux.HandleFunc("/settings", makeHandler(RebootForums.SettingsHandler))
+	mux.HandleFunc("GET /settings/email/verify", makeHandler(RebootForums.VerifyEmailHandler))
+	mux.HandleFunc("POST /settings/avatar", makeHandler(RebootForums.AvatarHandler))
+	mux.HandleFunc("POST /settings/blocked", makeHandler(RebootForums.BlockListHandler))
+	mux.HandleFunc("POST /settings/export", makeHandler(RebootForums.ExportHandler))
+	mux.HandleFunc("GET /settings/export/{id}/download", makeHandler(RebootForums.ExportDownloadHandler))
+	mux.HandleFunc("/settings/2fa", makeHandler(RebootForums.TwoFactorSettingsHandler))
+	mux.HandleFunc("GET /settings/accounts", makeHandler(RebootForums.LinkedAccountsHandler))
+	mux.HandleFunc("POST /settings/accounts/unlink", makeHandler(RebootForums.UnlinkAccountHandler))
+	// Admin routes
+	mux.HandleFunc("GET /admin", makeHandler(RebootForums.AdminHandler))
+	mux.HandleFunc("POST /admin/settings", makeHandler(RebootForums.AdminSettingsHandler))
+	mux.HandleFunc("POST /admin/role", makeHandler(RebootForums.AdminRoleHandler))
+	mux.HandleFunc("POST /admin/oauth", makeHandler(RebootForums.AdminOAuthSettingsHandler))
+	mux.HandleFunc("POST /admin/attachments", makeHandler(RebootForums.AdminAttachmentSettingsHandler))
+	mux.HandleFunc("POST /admin/chat", makeHandler(RebootForums.AdminChatSettingsHandler))
+	mux.HandleFunc("POST /admin/spam", makeHandler(RebootForums.AdminSpamSettingsHandler))
+	mux.HandleFunc("POST /admin/captcha", makeHandler(RebootForums.AdminCaptchaSettingsHandler))
+	mux.HandleFunc("GET /admin/audit", makeHandler(RebootForums.AdminAuditHandler))
+	mux.HandleFunc("GET /admin/audit.csv", makeHandler(RebootForums.AdminAuditExportHandler))
+	mux.HandleFunc("GET /admin/security", makeHandler(RebootForums.AdminSecurityHandler))
+	mux.HandleFunc("POST /admin/security/unlock", makeHandler(RebootForums.AdminUnlockHandler))
 	// Explicit error routes
 	mux.HandleFunc("/400", RebootForums.Error400Handler)
 	mux.HandleFunc("/404", RebootForums.Error404Handler)
@@ -0,0 +1,375 @@
+// Command digitvoice synthesizes the spoken digits the audio CAPTCHA is built
+// from, so the forum needs no speech engine or recorded voice. It is a small
+// formant synthesizer after Klatt's: a glottal pulse train and noise are
+// shaped by resonators whose frequencies follow a hand-written track for each
+// word. Run it through go generate in Handlers after changing a track.
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const sampleRate = 16000
+
+// words holds a track per digit. Each line is a time in milliseconds followed
+// by the parameters that reach a new value then; every parameter moves in a
+// straight line from one of its values to the next.
+//
+//	AV, AH, AF  voicing, aspiration and frication amplitude, 1 being a vowel
+//	F1-F3, B1-B3  formant frequencies and bandwidths in Hz
+//	FF, FB  centre and bandwidth of the frication noise
+//	N  how nasal the sound is, from 0 to 1
+var words = [10]string{
+	// zero: z ɪ ɹ oʊ
+	`0 AV=0 AF=0 F1=250 F2=1700 F3=2600 FF=5500 FB=1800
+	10 AV=.2 AF=.3
+	110 AV=.2 AF=.3
+	130 AV=.8 AF=0 F1=400 F2=1850 F3=2600
+	200 AV=1 F1=400 F2=1850 F3=2600
+	260 AV=.9 F1=330 F2=1150 F3=1500
+	330 AV=1 F1=500 F2=1000 F3=2300
+	460 AV=.9 F1=400 F2=900 F3=2250
+	540 AV=0`,
+	// one: w ʌ n
+	`0 AV=0 F1=290 F2=610 F3=2150
+	30 AV=.6
+	100 AV=.75 F1=300 F2=650 F3=2200
+	190 AV=1 F1=620 F2=1200 F3=2550
+	300 AV=1 F1=600 F2=1250 F3=2550 N=0 B2=100 B3=150
+	360 AV=.5 F1=280 F2=1600 F3=2600 N=1 B2=200 B3=300
+	460 AV=.45
+	520 AV=0`,
+	// two: t u
+	`0 AV=0 AF=0 AH=0 F1=350 F2=1600 F3=2500 FF=4500 FB=2500
+	60 AF=0
+	61 AF=.7
+	72 AF=.7 AH=0
+	75 AF=0 AH=.35
+	120 AH=.3 AV=0
+	130 AH=0 AV=.9 F1=350 F2=1500 F3=2500
+	260 AV=1 F1=320 F2=1100 F3=2300
+	430 AV=.9 F1=310 F2=950 F3=2250
+	490 AV=0`,
+	// three: θ ɹ i
+	`0 AF=0 AV=0 FF=6000 FB=4000 F1=310 F2=1060 F3=1380
+	15 AF=.12
+	120 AF=.12 AV=0
+	140 AF=0 AV=.6
+	200 AV=.85 F1=320 F2=1100 F3=1450
+	290 AV=1 F1=300 F2=2200 F3=2950
+	450 AV=.9 F1=290 F2=2250 F3=2950
+	520 AV=0`,
+	// four: f ɔ ɹ
+	`0 AF=0 AV=0 FF=6000 FB=4000 F1=550 F2=1000 F3=2500
+	15 AF=.14
+	120 AF=.14 AV=0
+	140 AF=0 AV=.8
+	250 AV=1 F1=600 F2=950 F3=2550
+	350 AV=1 F1=500 F2=1050 F3=1900
+	450 AV=.8 F1=400 F2=1100 F3=1500
+	520 AV=0`,
+	// five: f aɪ v
+	`0 AF=0 AV=0 FF=6000 FB=4000 F1=700 F2=1150 F3=2500
+	15 AF=.14
+	120 AF=.14 AV=0
+	140 AF=0 AV=.8
+	250 AV=1 F1=720 F2=1250 F3=2550
+	380 AV=.9 F1=420 F2=1900 F3=2550
+	430 AV=.45 AF=0 F1=250 F2=1300 F3=2300 FF=5000 FB=3000
+	450 AF=.06
+	520 AV=.3 AF=.05
+	560 AV=0 AF=0`,
+	// six: s ɪ k s
+	`0 AF=0 AV=0 AH=0 FF=5500 FB=1800 F1=380 F2=1800 F3=2600
+	20 AF=.5
+	130 AF=.5 AV=0
+	150 AF=0 AV=.8
+	240 AV=1 F1=400 F2=1850 F3=2600 FF=5500 FB=1800
+	280 AV=0 F1=300 F2=2200 F3=2800
+	330 AF=0 FF=2800 FB=1000
+	331 AF=.5
+	341 AF=.5 AH=0
+	344 AF=0 AH=.25 FF=2800
+	365 AH=.25 AF=0 FF=5500 FB=1800
+	375 AH=0 AF=.5
+	500 AF=.5
+	540 AF=0`,
+	// seven: s ɛ v ə n
+	`0 AF=0 AV=0 FF=5500 FB=1800 F1=480 F2=1750 F3=2500
+	20 AF=.5
+	130 AF=.5 AV=0
+	150 AF=0 AV=.8
+	230 AV=1 F1=550 F2=1750 F3=2500 FF=5000 FB=3000
+	290 AV=.5 AF=.05 F1=300 F2=1300 F3=2300
+	330 AV=.5 AF=.05
+	370 AV=.9 AF=0 F1=500 F2=1450 F3=2500 N=0 B2=100 B3=150
+	420 AV=.45 F1=280 F2=1600 F3=2600 N=1 B2=200 B3=300
+	520 AV=.4
+	560 AV=0`,
+	// eight: eɪ t
+	`0 AV=0 AF=0 AH=0 F1=480 F2=1900 F3=2550 FF=4500 FB=2500
+	25 AV=1
+	180 AV=1 F1=450 F2=1950 F3=2600
+	280 AV=.9 F1=380 F2=2150 F3=2700
+	300 AV=0
+	360 AF=0
+	361 AF=.6
+	371 AF=.6 AH=0
+	374 AF=0 AH=.2
+	420 AH=0`,
+	// nine: n aɪ n
+	`0 AV=0 N=1 F1=280 F2=1500 F3=2600 B2=200 B3=300
+	20 AV=.4
+	90 AV=.45 N=1 B2=200 B3=300
+	130 AV=.9 N=0 F1=700 F2=1200 F3=2550 B2=100 B3=150
+	250 AV=1 F1=720 F2=1250 F3=2550
+	380 AV=.9 F1=420 F2=1900 F3=2550 N=0 B2=100 B3=150
+	430 AV=.45 F1=280 F2=1700 F3=2600 N=1 B2=200 B3=300
+	520 AV=.4
+	560 AV=0`,
+}
+
+// defaults hold parameters a track never sets
+var defaults = map[string]float64{
+	"AV": 0, "AH": 0, "AF": 0, "N": 0,
+	"F1": 500, "F2": 1500, "F3": 2500,
+	"B1": 80, "B2": 100, "B3": 150,
+	"FF": 5000, "FB": 2000,
+}
+
+type keyframe struct {
+	ms    float64
+	value float64
+}
+
+// track is a word's parameters over time
+type track struct {
+	params map[string][]keyframe
+	length float64
+}
+
+func parseTrack(text string) (track, error) {
+	t := track{params: make(map[string][]keyframe)}
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ms, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return t, fmt.Errorf("bad time %q", fields[0])
+		}
+		t.length = math.Max(t.length, ms)
+		for _, f := range fields[1:] {
+			name, value, ok := strings.Cut(f, "=")
+			if _, known := defaults[name]; !ok || !known {
+				return t, fmt.Errorf("bad parameter %q", f)
+			}
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return t, fmt.Errorf("bad value %q", f)
+			}
+			t.params[name] = append(t.params[name], keyframe{ms, v})
+		}
+	}
+	for _, frames := range t.params {
+		sort.SliceStable(frames, func(i, j int) bool { return frames[i].ms < frames[j].ms })
+	}
+	return t, nil
+}
+
+// at returns the value of a parameter ms into the word
+func (t track) at(name string, ms float64) float64 {
+	frames := t.params[name]
+	if len(frames) == 0 {
+		return defaults[name]
+	}
+	if ms <= frames[0].ms {
+		return frames[0].value
+	}
+	for i := 1; i < len(frames); i++ {
+		if ms <= frames[i].ms {
+			a, b := frames[i-1], frames[i]
+			return a.value + (b.value-a.value)*(ms-a.ms)/(b.ms-a.ms)
+		}
+	}
+	return frames[len(frames)-1].value
+}
+
+// resonator is a two-pole filter; with zero set it becomes the matching
+// antiresonator
+type resonator struct {
+	a, b, c, y1, y2 float64
+	zero            bool
+}
+
+func (r *resonator) set(freq, bw float64) {
+	r.c = -math.Exp(-2 * math.Pi * bw / sampleRate)
+	r.b = 2 * math.Exp(-math.Pi*bw/sampleRate) * math.Cos(2*math.Pi*freq/sampleRate)
+	r.a = 1 - r.b - r.c
+}
+
+func (r *resonator) step(x float64) float64 {
+	if r.zero {
+		// y[n] = (x[n] - b x[n-1] - c x[n-2]) / a, keeping inputs in y1, y2
+		y := (x - r.b*r.y1 - r.c*r.y2) / r.a
+		r.y2, r.y1 = r.y1, x
+		return y
+	}
+	y := r.a*x + r.b*r.y1 + r.c*r.y2
+	r.y2, r.y1 = r.y1, y
+	return y
+}
+
+// synthesizer turns a track into samples
+type synthesizer struct {
+	rng                  *rand.Rand
+	phase                float64
+	lastFlow             float64
+	nasalPole, nasalZero resonator
+	formants             [5]resonator
+	frication            resonator
+	fricGain, aspGain    float64
+}
+
+func newSynthesizer() *synthesizer {
+	s := &synthesizer{rng: rand.New(rand.NewPCG(1, 2)), fricGain: 1, aspGain: 1}
+	s.nasalZero.zero = true
+	s.formants[3].set(3300, 250)
+	s.formants[4].set(3750, 300)
+	return s
+}
+
+// glottalFlow is a Rosenberg pulse: the folds open over 40% of the period,
+// close over 16% and stay shut for the rest
+func glottalFlow(phase float64) float64 {
+	const open, closing = 0.4, 0.16
+	switch {
+	case phase < open:
+		return 0.5 * (1 - math.Cos(math.Pi*phase/open))
+	case phase < open+closing:
+		return math.Cos(math.Pi / 2 * (phase - open) / closing)
+	}
+	return 0
+}
+
+func (s *synthesizer) sample(t track, ms float64) float64 {
+	// Pitch falls through the word the way a digit read from a list does
+	f0 := 128 - 30*ms/t.length + s.rng.NormFloat64()*0.6
+	s.phase += f0 / sampleRate
+	if s.phase >= 1 {
+		s.phase--
+	}
+	flow := glottalFlow(s.phase)
+	// The flow's derivative includes the lift the lips give high frequencies
+	voice := (flow - s.lastFlow) * 12 * t.at("AV", ms)
+	s.lastFlow = flow
+	noise := s.rng.Float64()*2 - 1
+
+	x := voice + noise*s.aspGain*t.at("AH", ms)
+	nasal := t.at("N", ms)
+	s.nasalPole.set(270, 100)
+	s.nasalZero.set(270+nasal*180, 100)
+	x = s.nasalPole.step(s.nasalZero.step(x))
+	s.formants[2].set(t.at("F3", ms), t.at("B3", ms))
+	s.formants[1].set(t.at("F2", ms), t.at("B2", ms))
+	s.formants[0].set(t.at("F1", ms), t.at("B1", ms)+nasal*60)
+	for i := len(s.formants) - 1; i >= 0; i-- {
+		x = s.formants[i].step(x)
+	}
+
+	s.frication.set(t.at("FF", ms), t.at("FB", ms))
+	return x + s.frication.step(noise)*s.fricGain*t.at("AF", ms)
+}
+
+func (s *synthesizer) render(t track) []float64 {
+	n := int(t.length * sampleRate / 1000)
+	out := make([]float64, n)
+	for i := range out {
+		out[i] = s.sample(t, float64(i)*1000/sampleRate)
+	}
+	return out
+}
+
+func rms(samples []float64) float64 {
+	var sum float64
+	for _, v := range samples {
+		sum += v * v
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
+
+// calibrate sets the noise gains so an amplitude of 1 is as loud as a vowel
+func (s *synthesizer) calibrate() {
+	steady := func(params string) float64 {
+		t, err := parseTrack("0 " + params + "\n400 " + params)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return rms(s.render(t)[sampleRate/10:])
+	}
+	vowel := steady("AV=1 F1=620 F2=1200 F3=2550")
+	s.aspGain = vowel / steady("AH=1 F1=620 F2=1200 F3=2550")
+	s.fricGain = vowel / steady("AF=1 FF=5500 FB=1800")
+}
+
+// writeWAV saves samples as 16-bit mono PCM, scaled so the loudest is at 90%
+func writeWAV(path string, samples []float64) error {
+	peak := 0.0
+	for _, v := range samples {
+		peak = math.Max(peak, math.Abs(v))
+	}
+	pcm := make([]int16, len(samples))
+	for i, v := range samples {
+		pcm[i] = int16(v / peak * 0.9 * math.MaxInt16)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	size := uint32(len(pcm) * 2)
+	header := []any{
+		[4]byte{'R', 'I', 'F', 'F'}, 36 + size, [4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '}, uint32(16), uint16(1), uint16(1),
+		uint32(sampleRate), uint32(sampleRate * 2), uint16(2), uint16(16),
+		[4]byte{'d', 'a', 't', 'a'}, size, pcm,
+	}
+	for _, v := range header {
+		if err := binary.Write(f, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+func main() {
+	out := flag.String("out", ".", "directory to write 0.wav to 9.wav into")
+	flag.Parse()
+
+	s := newSynthesizer()
+	s.calibrate()
+	for digit, text := range words {
+		t, err := parseTrack(text)
+		if err != nil {
+			log.Fatalf("Track for %d: %v", digit, err)
+		}
+		// A little silence after the word lets the filters ring out
+		samples := append(s.render(t), make([]float64, sampleRate/20)...)
+		path := filepath.Join(*out, strconv.Itoa(digit)+".wav")
+		if err := writeWAV(path, samples); err != nil {
+			log.Fatalf("Writing %s: %v", path, err)
+		}
+	}
+}